@@ -1,18 +1,52 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"forum/cmd/router"
 	"forum/internal/db"
+	"forum/internal/digest"
+	"forum/internal/filter"
+	"forum/internal/handlers"
+	"forum/internal/mail"
+	"forum/internal/reaction"
+	"forum/internal/static"
 	"forum/internal/templates"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
+	_ "time/tzdata" // Time zones for user settings, also where the system has none
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
 func main() {
+	imagesDryRun := flag.Bool("images-dry-run", false, "only report orphaned images, don't remove them")
+	dev := flag.Bool("dev", false, "serve templates and static files from disk and reload templates on change")
+	siteURL := flag.String("site-url", "http://localhost:8080", "address of the forum used in links of emails")
+	smtpAddr := flag.String("smtp", "", "mail server host:port for digest emails, login from SMTP_USERNAME and SMTP_PASSWORD")
+	mailFrom := flag.String("mail-from", "fika@localhost", "sender address of emails")
+	mailDir := flag.String("mail-dir", "data/mail", "folder emails are written to when no mail server is set")
+	archiveAfter := flag.Int("archive-after", 90, "days without posts after which a thread is archived, 0 to never archive")
+	makeModerator := flag.String("make-moderator", "", "give this user the moderator role and exit")
+	makeAdmin := flag.String("make-admin", "", "give this user the admin role and exit")
+	closedCategories := flag.Bool("closed-categories", false, "only admins create categories, users pick from them")
+	reactions := flag.String("reactions", reaction.Default, "emoji reactions offered on posts besides like and dislike, out of "+
+		strings.Join(reaction.Catalog(), ","))
+	userLimits := flag.String("user-limits", handlers.DefaultUserLimits, "most threads, replies and reactions of one user in a while")
+	addressLimits := flag.String("address-limits", handlers.DefaultAddressLimits, "most threads, replies and reactions from one address in a while")
+	limitExempt := flag.String("limit-exempt", "trusted", "trust level from which users aren't limited: new, member, trusted or none")
+	blocklist := flag.String("blocklist", "", "comma separated words and phrases that posts can't have")
+	newUserLinks := flag.Int("new-user-links", 2, "links a post of a new user can have before it is held for review")
+	spamThreshold := flag.Float64("spam-threshold", 0.9, "spam probability from which the classifier holds posts for review, above 1 to turn it off")
+	flag.Parse()
+	static.SetDev(*dev)
+
 	err := db.OpenDB() // Open database connection
 	if err != nil {
 		log.Fatal("Database connection failed:", err)
@@ -20,12 +54,84 @@ func main() {
 
 	defer db.DB.Close()
 	db.MakeTables()
+	if *makeModerator != "" || *makeAdmin != "" {
+		for role, username := range map[string]string{"moderator": *makeModerator, "admin": *makeAdmin} {
+			if username == "" {
+				continue
+			}
+			found, err := db.SetRole(username, role)
+			if err != nil {
+				log.Fatal("Setting role failed:", err)
+			}
+			if !found {
+				log.Fatal("No user named ", username)
+			}
+			fmt.Println(username, "is now", role)
+		}
+		return
+	}
+	handlers.ClosedCategories = *closedCategories
+	if err := reaction.Configure(*reactions); err != nil {
+		log.Fatal("Configuring reactions failed:", err)
+	}
+	if err := handlers.ConfigureLimits(*userLimits, *addressLimits, *limitExempt); err != nil {
+		log.Fatal("Configuring limits failed:", err)
+	}
+	filter.Use(filter.NewBlocklist(*blocklist), filter.LinkLimit{Max: *newUserLinks},
+		filter.Bayes{Threshold: *spamThreshold, MinTrained: 10})
+	cleanImages := func() { db.RemoveOrphanedImages(*imagesDryRun) }
 	db.DataCleanup(time.Hour, db.RemoveExpiredSessions, "session")     // Clean up sessions every hour
 	db.DataCleanup(6*time.Hour, db.RemoveUnusedCategories, "category") // Clean up categories every 6 hours
-	templates.InitTemplates()
+	db.DataCleanup(24*time.Hour, cleanImages, "image")                 // Clean up orphaned images once a day
+	db.DataCleanup(24*time.Hour, db.RemoveOldPostKeys, "post key")     // Forget keys of forms sent over a day ago
+	db.DataCleanup(10*time.Minute, handlers.PruneLimits, "rate limit") // Forget actions that no longer count
+	db.DataCleanup(6*time.Hour, db.RemoveOldDrafts, "draft")           // Drop drafts nobody came back to
+	db.QuietCleanup(time.Minute, handlers.RunScheduler)                // Publish and expire threads on time
+	if *archiveAfter > 0 {
+		archive := func() { db.ArchiveInactiveThreads(*archiveAfter) }
+		db.DataCleanup(6*time.Hour, archive, "archive") // Archive threads that have gone quiet
+	}
+
+	// Email digests go through the mail server, or to files for development
+	var mailer mail.Mailer = &mail.FileSink{Dir: *mailDir, From: *mailFrom}
+	if *smtpAddr != "" {
+		mailer = &mail.SMTP{Addr: *smtpAddr, From: *mailFrom, Username: os.Getenv("SMTP_USERNAME"), Password: os.Getenv("SMTP_PASSWORD")}
+	}
+	sendDigests := func() {
+		if sent, err := digest.Send(mailer, *siteURL); err != nil {
+			log.Println("Sending digests failed:", err)
+		} else if sent > 0 {
+			log.Println("Sent", sent, "digests")
+		}
+	}
+	db.DataCleanup(time.Hour, sendDigests, "digest") // Send daily and weekly digests that are due
+	if err := templates.InitTemplates(); err != nil {
+		log.Fatal("Template parsing failed:", err)
+	}
+	if static.Dev() {
+		templates.Watch(time.Second)
+	}
 	router.SetHandlers()
 
 	// Start the server
-	fmt.Println("Server running on http://localhost:8080")
-	log.Fatal(http.ListenAndServe(":8080", nil)) // Logs the error and exits.
+	server := &http.Server{Addr: ":8080"}
+	go func() {
+		fmt.Println("Server running on http://localhost:8080")
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err) // Logs the error and exits.
+		}
+	}()
+
+	// Shut down cleanly on Ctrl+C or docker stop
+	stop, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	<-stop.Done()
+
+	fmt.Println("Shutting down...")
+	handlers.LiveHub.Close() // Ends live streams, which would otherwise keep Shutdown waiting
+	ctx, cancelShutdown := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelShutdown()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Println("Shutdown:", err)
+	}
 }
@@ -2,23 +2,33 @@ package router
 
 import (
 	"forum/internal/handlers"
+	"forum/internal/static"
 	"net/http"
 )
 
 func SetHandlers() {
 
-	fileServer := http.FileServer(http.Dir("./"))
-	http.Handle("/internal/static/", fileServer)
-	http.Handle("/internal/static/images/", fileServer)
+	// Stylesheets, scripts and templates come from the binary, or from disk in development mode
+	staticServer := http.StripPrefix("/internal/static/", http.FileServer(http.FS(static.Files())))
+	http.Handle("/internal/static/", staticServer)
+	// Uploaded images are always on disk
+	http.Handle("/internal/static/images/", http.FileServer(http.Dir("./")))
 
 	http.HandleFunc("/favicon.ico", func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, "internal/static/favicon.ico")
+		http.ServeFileFS(w, r, static.Files(), "favicon.ico")
 	})
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		handlers.IndexHandler(w, r, "")
 	})
 	http.HandleFunc("/thread/", handlers.ThreadPageHandler)
+	http.HandleFunc("/thread/state", handlers.ThreadStateHandler)
+	http.HandleFunc("/thread/categories", handlers.ThreadCategoriesHandler)
+	http.HandleFunc("/thread/schedule", handlers.ThreadScheduleHandler)
+	http.HandleFunc("/post/", handlers.PostHandler)
+	http.HandleFunc("/category/", handlers.CategoryPageHandler)
+	http.HandleFunc("/admin/categories", handlers.AdminCategoriesHandler)
+	http.HandleFunc("/moderation", handlers.ModerationHandler)
 	http.HandleFunc("/add", handlers.AddThreadHandler)
 	http.HandleFunc("/reply", handlers.AddReplyHandler)
 	http.HandleFunc("/login", handlers.LogInHandler)
@@ -27,7 +37,17 @@ func SetHandlers() {
 	http.HandleFunc("/logout", handlers.LogoutHandler)
 	http.HandleFunc("/like", handlers.LikeHandler)
 	http.HandleFunc("/dislike", handlers.DislikeHandler)
-	http.HandleFunc("/expired", func(w http.ResponseWriter, r *http.Request) {
-		handlers.IndexHandler(w, r, "Session expired")
-	})
+	http.HandleFunc("/react", handlers.ReactHandler)
+	http.HandleFunc("/settings", handlers.SettingsHandler)
+	http.HandleFunc("/notifications", handlers.NotificationsHandler)
+	http.HandleFunc("/users/suggest", handlers.UserSuggestHandler)
+	http.HandleFunc("/subscribe", handlers.SubscribeHandler)
+	http.HandleFunc("/unsubscribe", handlers.UnsubscribeHandler)
+	http.HandleFunc("/messages", handlers.InboxHandler)
+	http.HandleFunc("/messages/", handlers.ConversationHandler)
+	http.HandleFunc("/messages/report", handlers.ReportMessageHandler)
+	http.HandleFunc("/block", handlers.BlockHandler)
+	http.HandleFunc("/events/", handlers.ThreadEventsHandler)
+	http.HandleFunc("/drafts", handlers.DraftsHandler)
+	http.HandleFunc("/expired", handlers.ExpiredHandler)
 }
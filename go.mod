@@ -8,3 +8,5 @@ require (
 )
 
 require github.com/gofrs/uuid v4.4.0+incompatible
+
+require golang.org/x/text v0.21.0
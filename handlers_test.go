@@ -1,31 +1,54 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"database/sql"
+	"fmt"
 	"forum/cmd/router"
 	"forum/internal/db"
+	"forum/internal/digest"
+	"forum/internal/filter"
 	"forum/internal/handlers"
+	"forum/internal/live"
+	"forum/internal/mail"
 	"forum/internal/templates"
+	"io"
+	"log"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 	"golang.org/x/crypto/bcrypt"
 )
 
 func Testinit() {
-	// Setup: create in-mem db; db is temp and lost upon prog termination
-	db.DB, _ = sql.Open("sqlite3", ":memory:")
+	// Setup: create in-mem db; db is temp and lost when the last connection closes.
+	// The cache is shared so every connection of the pool sees the same tables.
+	db.DB, _ = sql.Open("sqlite3", "file::memory:?cache=shared")
 
 	// Run our program
 	db.MakeTables()
-	templates.InitTemplates()
+	if err := templates.InitTemplates(); err != nil {
+		log.Fatal("Template parsing failed:", err)
+	}
 
 	// Clear existing handlers to avoid duplicate route registration
 	http.DefaultServeMux = new(http.ServeMux)
 	router.SetHandlers()
+
+	// Each test starts with nothing counted towards the rate limits
+	if err := handlers.ConfigureLimits(handlers.DefaultUserLimits, handlers.DefaultAddressLimits, "trusted"); err != nil {
+		log.Fatal("Configuring limits failed:", err)
+	}
 }
 
 func TestIndexHandler(t *testing.T) {
@@ -295,3 +318,1430 @@ func TestLogUserInHandler(t *testing.T) {
 		})
 	}
 }
+
+func TestThreadEventsHandler(t *testing.T) {
+	Testinit()
+	defer db.DB.Close()
+
+	_, err := db.DB.Exec(`INSERT INTO users (id, email, username, password) VALUES ('liveid', 'live@test.com', 'liveuser', 'x');
+		INSERT INTO posts (id, author, authorID, title, content) VALUES (1, 'liveuser', 'liveid', 'Live thread', 'Hello');`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.DefaultServeMux)
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		url      string
+		wantCode int
+	}{
+		{"invalid thread id", "/events/abc", http.StatusBadRequest},
+		{"unknown thread", "/events/99", http.StatusNotFound},
+		{"valid thread", "/events/1", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+tt.url, nil)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tt.wantCode {
+				t.Fatalf("got status %v but want %v", resp.StatusCode, tt.wantCode)
+			}
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+			if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+				t.Errorf("got content type %q", ct)
+			}
+
+			// A reply written after connecting arrives as rendered HTML
+			reader := bufio.NewReader(resp.Body)
+			if line, _ := reader.ReadString('\n'); !strings.HasPrefix(line, ": connected") {
+				t.Fatalf("unexpected first line %q", line)
+			}
+			res, err := db.DB.Exec(`INSERT INTO posts (base_id, author, authorID, content, parent_id) VALUES (1, 'liveuser', 'liveid', 'Live **reply**', 1);`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			replyID, _ := res.LastInsertId()
+			handlers.LiveHub.Publish(1, live.Event{Type: live.NewReply, PostID: int(replyID)})
+
+			var event, data string
+			for event == "" || data == "" {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					t.Fatalf("reading stream: %v", err)
+				}
+				if strings.HasPrefix(line, "event: ") {
+					event = strings.TrimSpace(line[len("event: "):])
+				} else if strings.HasPrefix(line, "data: ") {
+					data = line[len("data: "):]
+				}
+			}
+			if event != live.NewReply {
+				t.Errorf("got event %q", event)
+			}
+			if !strings.Contains(data, `\u003cstrong\u003ereply\u003c/strong\u003e`) { // JSON escapes < and >
+				t.Errorf("reply html missing from %s", data)
+			}
+		})
+	}
+}
+
+func TestLiveConnectionLimits(t *testing.T) {
+	Testinit()
+	defer db.DB.Close()
+	db.DB.Exec(`INSERT INTO posts (id, author, title, content) VALUES (1, 'liveuser', 'Live thread', 'Hello');`)
+
+	// A hub of its own, so that closing it leaves the other tests theirs
+	hub := handlers.LiveHub
+	handlers.LiveHub = live.NewHub(5, 1000)
+	defer func() { handlers.LiveHub = hub }()
+	server := httptest.NewServer(http.DefaultServeMux)
+	defer server.Close()
+
+	subscribe := func() *http.Response {
+		resp, err := http.Get(server.URL + "/events/1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	var open []*http.Response
+	for i := 0; i < 5; i++ {
+		resp := subscribe()
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("connection %d got status %d", i+1, resp.StatusCode)
+		}
+		open = append(open, resp)
+	}
+	resp := subscribe()
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("sixth connection from one address got status %d, want 429", resp.StatusCode)
+	}
+
+	// Shutting down ends the open streams
+	reader := bufio.NewReader(open[0].Body)
+	reader.ReadString('\n') // ": connected"
+	handlers.LiveHub.Close()
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.ReadAll(reader)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("stream ended with %v, want EOF", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("stream still open after closing the hub")
+	}
+}
+
+// addTestUser adds a month-old member with a session and returns the session cookie
+func addTestUser(t *testing.T, id, name string) *http.Cookie {
+	t.Helper()
+	_, err := db.DB.Exec(`INSERT INTO users (id, email, username, password, created_at)
+						  VALUES (?, ?, ?, 'x', datetime('now', '-30 days'));`, id, name+"@test.com", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.DB.Exec(`INSERT INTO sessions (user_id, username, session_token, expires_at) VALUES (?, ?, ?, ?);`,
+		id, name, id+"-token", time.Now().Add(30*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Cookie{Name: "session_token", Value: id + "-token"}
+}
+
+// postForm sends a form to the router as the user of the cookie
+func postForm(cookie *http.Cookie, url, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(cookie)
+	rr := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestNotifications(t *testing.T) {
+	Testinit()
+	defer db.DB.Close()
+
+	author := addTestUser(t, "authorid", "author")
+	other := addTestUser(t, "otherid", "other")
+	if _, err := db.DB.Exec(`INSERT INTO posts (id, author, authorID, title, content) VALUES (1, 'author', 'authorid', 'Topic', 'Hi');`); err != nil {
+		t.Fatal(err)
+	}
+
+	unread := func() (count int) {
+		db.DB.QueryRow(`SELECT COUNT(*) FROM notifications WHERE user_id = 'authorid' AND is_read = 0;`).Scan(&count)
+		return count
+	}
+
+	steps := []struct {
+		name       string
+		cookie     *http.Cookie
+		url, body  string
+		wantUnread int
+	}{
+		{"reply to own thread", author, "/reply", "content=mine&parentId=1&baseId=1", 0},
+		{"reply from other user", other, "/reply", "content=yours&parentId=1&baseId=1", 1},
+		{"like from other user", other, "/like", "post_id=1&base_id=1", 2},
+		{"like removed", other, "/like", "post_id=1&base_id=1", 2},
+		{"liked again is not repeated", other, "/like", "post_id=1&base_id=1", 2},
+		{"other user can't mark it read", other, "/notifications", "id=1", 2},
+		{"mark one read", author, "/notifications", "id=1", 1},
+		{"mark all read", author, "/notifications", "all=1", 0},
+	}
+	for _, step := range steps {
+		rr := postForm(step.cookie, step.url, step.body)
+		if got := unread(); got != step.wantUnread {
+			t.Errorf("%s: got %d unread notifications but want %d (status %d)", step.name, got, step.wantUnread, rr.Code)
+		}
+	}
+
+	// Turned off reactions don't notify
+	db.DB.Exec(`UPDATE users SET notify_reactions = 0 WHERE id = 'authorid';`)
+	postForm(other, "/dislike", "post_id=1&base_id=1")
+	if got := unread(); got != 0 {
+		t.Errorf("got %d unread notifications after a reaction with reactions turned off", got)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/notifications", nil)
+	req.AddCookie(author)
+	rr := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "other replied to your post") {
+		t.Errorf("notifications page: got status %d, reply notification listed: %v", rr.Code, strings.Contains(rr.Body.String(), "replied"))
+	}
+}
+
+func TestMentions(t *testing.T) {
+	Testinit()
+	defer db.DB.Close()
+
+	writer := addTestUser(t, "writerid", "writer")
+	addTestUser(t, "mentionedid", "mentioned")
+	if _, err := db.DB.Exec(`INSERT INTO posts (id, author, authorID, title, content) VALUES (1, 'writer', 'writerid', 'Topic', 'Hi');`); err != nil {
+		t.Fatal(err)
+	}
+
+	rr := postForm(writer, "/reply", "content=hey+@mentioned+and+@nosuchuser&parentId=1&baseId=1")
+	if rr.Code != http.StatusSeeOther {
+		t.Fatalf("reply got status %d", rr.Code)
+	}
+
+	var mentions, notifications int
+	db.DB.QueryRow(`SELECT COUNT(*) FROM mentions WHERE user_id = 'mentionedid';`).Scan(&mentions)
+	db.DB.QueryRow(`SELECT COUNT(*) FROM notifications WHERE user_id = 'mentionedid' AND type = 'mention';`).Scan(&notifications)
+	if mentions != 1 || notifications != 1 {
+		t.Errorf("got %d mentions and %d notifications, want 1 and 1", mentions, notifications)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/thread/1", nil)
+	rr = httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(rr, req)
+	if body := rr.Body.String(); !strings.Contains(body, `class="mention">@mentioned</a>`) || strings.Contains(body, "@nosuchuser</a>") {
+		t.Errorf("thread page doesn't link only the existing user")
+	}
+
+	tests := []struct {
+		name     string
+		cookie   *http.Cookie
+		query    string
+		wantCode int
+		wantBody string
+	}{
+		{"guest", nil, "men", http.StatusUnauthorized, ""},
+		{"prefix", writer, "men", http.StatusOK, `["mentioned"]`},
+		{"wildcard is literal", writer, "%", http.StatusOK, `[]`},
+		{"empty", writer, "", http.StatusOK, `[]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/users/suggest?q="+url.QueryEscape(tt.query), nil)
+			if tt.cookie != nil {
+				req.AddCookie(tt.cookie)
+			}
+			rr := httptest.NewRecorder()
+			http.DefaultServeMux.ServeHTTP(rr, req)
+			if rr.Code != tt.wantCode {
+				t.Errorf("got status %d but want %d", rr.Code, tt.wantCode)
+			}
+			if tt.wantBody != "" && strings.TrimSpace(rr.Body.String()) != tt.wantBody {
+				t.Errorf("got body %s but want %s", rr.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestSubscriptionsAndDigest(t *testing.T) {
+	Testinit()
+	defer db.DB.Close()
+
+	follower := addTestUser(t, "followerid", "follower")
+	addTestUser(t, "posterid", "poster")
+	_, err := db.DB.Exec(`INSERT INTO posts (id, author, authorID, title, content) VALUES (1, 'poster', 'posterid', 'Followed thread', 'Hi');
+		INSERT INTO categories (id, name) VALUES (1, 'coffee');
+		INSERT INTO posts_categories (post_id, category_id) VALUES (1, 1);`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, body := range []string{"thread=1&return_url=/thread/1", "category=coffee&return_url=/"} {
+		if rr := postForm(follower, "/subscribe", body); rr.Code != http.StatusSeeOther {
+			t.Fatalf("subscribing with %s got status %d", body, rr.Code)
+		}
+	}
+	if rr := postForm(follower, "/subscribe", "category=tea"); rr.Code != http.StatusNotFound {
+		t.Errorf("subscribing to a missing category got status %d", rr.Code)
+	}
+
+	// New activity since the last digest a day ago, and an old reply that was in it already
+	_, err = db.DB.Exec(`UPDATE users SET digest = 'daily', digest_sent_at = datetime('now', '-25 hours') WHERE id = 'followerid';
+		INSERT INTO posts (base_id, author, authorID, content, parent_id, created_at) VALUES (1, 'poster', 'posterid', 'old', 1, datetime('now', '-2 days'));
+		INSERT INTO posts (base_id, author, authorID, content, parent_id) VALUES (1, 'poster', 'posterid', 'new', 1);
+		INSERT INTO posts (id, author, authorID, title, content) VALUES (10, 'poster', 'posterid', 'Fresh brew', 'Hi');
+		INSERT INTO posts_categories (post_id, category_id) VALUES (10, 1);`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	mailer := &mail.FileSink{Dir: dir, From: "test@localhost"}
+	if sent, err := digest.Send(mailer, "http://forum.test"); sent != 1 || err != nil {
+		t.Fatalf("first digest run sent %d, error %v; want 1 sent", sent, err)
+	}
+	if sent, err := digest.Send(mailer, "http://forum.test"); sent != 0 || err != nil {
+		t.Errorf("second digest run sent %d, error %v; want nothing until tomorrow", sent, err)
+	}
+
+	files, _ := os.ReadDir(dir)
+	if len(files) != 1 {
+		t.Fatalf("got %d mail files, want 1", len(files))
+	}
+	content, _ := os.ReadFile(filepath.Join(dir, files[0].Name()))
+	msg := string(content)
+	for _, want := range []string{"To: follower@test.com", "Followed thread (1 new)", "New threads in coffee", "Fresh brew",
+		"List-Unsubscribe: <http://forum.test/unsubscribe?token="} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("digest mail doesn't contain %q:\n%s", want, msg)
+		}
+	}
+
+	// The thread's own unsubscribe link asks first, then unsubscribes
+	var token string
+	db.DB.QueryRow(`SELECT token FROM subscriptions WHERE user_id = 'followerid' AND target_type = 'thread';`).Scan(&token)
+	if !strings.Contains(msg, "/unsubscribe?token="+token) {
+		t.Errorf("digest mail doesn't have the thread unsubscribe link")
+	}
+	rr := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/unsubscribe?token="+token, nil))
+	var count int
+	db.DB.QueryRow(`SELECT COUNT(*) FROM subscriptions WHERE token = ?;`, token).Scan(&count)
+	if rr.Code != http.StatusOK || count != 1 {
+		t.Errorf("GET unsubscribe: got status %d, %d subscriptions left; want 200 and 1", rr.Code, count)
+	}
+
+	rr = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/unsubscribe", strings.NewReader("token="+token))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	http.DefaultServeMux.ServeHTTP(rr, req)
+	db.DB.QueryRow(`SELECT COUNT(*) FROM subscriptions WHERE token = ?;`, token).Scan(&count)
+	if rr.Code != http.StatusOK || count != 0 {
+		t.Errorf("POST unsubscribe: got status %d, %d subscriptions left; want 200 and 0", rr.Code, count)
+	}
+
+	rr = httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/unsubscribe?token=bogus", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("unknown token got status %d, want 404", rr.Code)
+	}
+}
+
+func TestDirectMessages(t *testing.T) {
+	Testinit()
+	defer db.DB.Close()
+
+	alice := addTestUser(t, "aliceid", "alice")
+	bob := addTestUser(t, "bobid", "bob")
+	eve := addTestUser(t, "eveid", "eve")
+
+	get := func(cookie *http.Cookie, url string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		req.AddCookie(cookie)
+		rr := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := postForm(alice, "/messages", "to=bob&subject=Coffee&content=Fika+at+three%3F")
+	if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/messages/1" {
+		t.Fatalf("starting a conversation got status %d, location %q", rr.Code, rr.Header().Get("Location"))
+	}
+	if rr := postForm(alice, "/messages", "to=nobody&subject=Hi&content=Hi"); rr.Code != http.StatusBadRequest {
+		t.Errorf("messaging an unknown user got status %d, want 400", rr.Code)
+	}
+
+	if n := unreadMessagesOf("bobid"); n != 1 {
+		t.Errorf("bob has %d unread messages, want 1", n)
+	}
+	if rr := get(bob, "/messages/1"); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "Fika at three?") {
+		t.Errorf("bob reading the conversation got status %d", rr.Code)
+	}
+	if n := unreadMessagesOf("bobid"); n != 0 {
+		t.Errorf("bob has %d unread messages after reading, want 0", n)
+	}
+
+	// Others can neither read nor write the conversation
+	if rr := get(eve, "/messages/1"); rr.Code != http.StatusNotFound {
+		t.Errorf("outsider reading the conversation got status %d, want 404", rr.Code)
+	}
+	if rr := postForm(eve, "/messages/1", "content=hi"); rr.Code != http.StatusNotFound {
+		t.Errorf("outsider writing to the conversation got status %d, want 404", rr.Code)
+	}
+	if rr := postForm(eve, "/messages/report", "message_id=1&reason=spam"); rr.Code != http.StatusNotFound {
+		t.Errorf("outsider reporting a message got status %d, want 404", rr.Code)
+	}
+
+	if rr := postForm(bob, "/messages/report", "message_id=1&reason=spam"); rr.Code != http.StatusSeeOther {
+		t.Errorf("reporting a message got status %d", rr.Code)
+	}
+	var reports int
+	db.DB.QueryRow(`SELECT COUNT(*) FROM reports WHERE target_type = 'message' AND target_id = 1 AND author_id = 'aliceid';`).Scan(&reports)
+	if reports != 1 {
+		t.Errorf("got %d reports, want 1", reports)
+	}
+
+	// Moderators see the open report on the moderation queue and resolve it
+	mod := addTestUser(t, "modid", "mod")
+	db.SetRole("mod", "moderator")
+	if rr := get(mod, "/moderation"); !strings.Contains(rr.Body.String(), "Fika at three?") {
+		t.Errorf("moderation queue doesn't show the reported message")
+	}
+	if rr := postForm(bob, "/moderation", "id=1&action=resolve"); rr.Code != http.StatusForbidden {
+		t.Errorf("non-moderator resolving a report got status %d, want 403", rr.Code)
+	}
+	if rr := postForm(mod, "/moderation", "id=1&action=resolve"); rr.Code != http.StatusSeeOther {
+		t.Errorf("resolving a report got status %d", rr.Code)
+	}
+	var status string
+	db.DB.QueryRow(`SELECT status FROM reports WHERE id = 1;`).Scan(&status)
+	if status != "resolved" {
+		t.Errorf("report is %q after resolving, want resolved", status)
+	}
+	if rr := postForm(mod, "/moderation", "id=1&action=resolve"); rr.Code != http.StatusNotFound {
+		t.Errorf("resolving a resolved report got status %d, want 404", rr.Code)
+	}
+
+	// After bob blocks alice, neither can write to the other
+	if rr := postForm(bob, "/block", "username=alice&action=block"); rr.Code != http.StatusSeeOther {
+		t.Fatalf("blocking got status %d", rr.Code)
+	}
+	if rr := postForm(alice, "/messages/1", "content=Hello%3F"); rr.Code != http.StatusBadRequest {
+		t.Errorf("writing to a user who blocked you got status %d, want 400", rr.Code)
+	}
+	if rr := postForm(bob, "/messages", "to=alice&subject=Hi&content=Hi"); rr.Code != http.StatusBadRequest {
+		t.Errorf("messaging a blocked user got status %d, want 400", rr.Code)
+	}
+	postForm(bob, "/block", "username=alice&action=unblock")
+	if rr := postForm(alice, "/messages/1", "content=Hello%3F"); rr.Code != http.StatusSeeOther {
+		t.Errorf("writing after unblocking got status %d", rr.Code)
+	}
+}
+
+// unreadMessagesOf counts a user's unread private messages
+func unreadMessagesOf(userID string) int {
+	var count int
+	db.DB.QueryRow(`SELECT COUNT(*) FROM messages m JOIN conversation_members cm ON cm.conversation_id = m.conversation_id
+		WHERE cm.user_id = ? AND m.id > cm.last_read_id AND m.sender_id != ?;`, userID, userID).Scan(&count)
+	return count
+}
+
+func TestThreadStates(t *testing.T) {
+	Testinit()
+	defer db.DB.Close()
+
+	author := addTestUser(t, "authorid", "author")
+	other := addTestUser(t, "otherid", "other")
+	mod := addTestUser(t, "modid", "mod")
+	if found, err := db.SetRole("mod", "moderator"); !found || err != nil {
+		t.Fatalf("setting moderator role: found %v, error %v", found, err)
+	}
+	_, err := db.DB.Exec(`INSERT INTO posts (id, author, authorID, title, content, created_at) VALUES (1, 'author', 'authorid', 'Old news', 'Hi', datetime('now', '-10 days'));
+		INSERT INTO posts (id, author, authorID, title, content, created_at) VALUES (2, 'author', 'authorid', 'Rules', 'Be nice', datetime('now', '-20 days'));
+		INSERT INTO posts (id, author, authorID, title, content) VALUES (3, 'author', 'authorid', 'Fresh', 'Hi');`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only moderators pin, authors can lock their own threads
+	if rr := postForm(other, "/thread/state", "thread=3&action=lock"); rr.Code != http.StatusForbidden {
+		t.Errorf("locking someone else's thread got status %d, want 403", rr.Code)
+	}
+	if rr := postForm(author, "/thread/state", "thread=3&action=pin"); rr.Code != http.StatusForbidden {
+		t.Errorf("author pinning got status %d, want 403", rr.Code)
+	}
+	if rr := postForm(author, "/thread/state", "thread=3&action=lock"); rr.Code != http.StatusSeeOther {
+		t.Errorf("author locking got status %d", rr.Code)
+	}
+	if rr := postForm(mod, "/thread/state", "thread=2&action=pin"); rr.Code != http.StatusSeeOther {
+		t.Errorf("moderator pinning got status %d", rr.Code)
+	}
+	if rr := postForm(author, "/thread/state", "thread=3&action=unlock"); rr.Code != http.StatusForbidden {
+		t.Errorf("author unlocking got status %d, want 403", rr.Code)
+	}
+	postForm(mod, "/thread/state", "thread=2&action=lock")
+	if rr := postForm(author, "/thread/state", "thread=2&action=unlock"); rr.Code != http.StatusForbidden {
+		t.Errorf("author unlocking a moderator's lock got status %d, want 403", rr.Code)
+	}
+	postForm(mod, "/thread/state", "thread=2&action=unlock")
+
+	// A locked thread takes no replies or reactions
+	rr := postForm(other, "/reply", "content=hello&parentId=3&baseId=3")
+	if rr.Code != http.StatusForbidden || !strings.Contains(rr.Body.String(), "locked") {
+		t.Errorf("replying to a locked thread got status %d, want 403 with a message", rr.Code)
+	}
+	if rr := postForm(other, "/like", "post_id=3&base_id=3"); rr.Code != http.StatusForbidden {
+		t.Errorf("liking in a locked thread got status %d, want 403", rr.Code)
+	}
+
+	// Inactive threads get archived, pinned ones stay open
+	db.ArchiveInactiveThreads(7)
+	var archived1, archived2, archived3 bool
+	db.DB.QueryRow(`SELECT (SELECT archived FROM posts WHERE id = 1), (SELECT archived FROM posts WHERE id = 2), (SELECT archived FROM posts WHERE id = 3);`).
+		Scan(&archived1, &archived2, &archived3)
+	if !archived1 || archived2 || archived3 {
+		t.Errorf("archived: old %v, pinned %v, fresh %v; want only the old one", archived1, archived2, archived3)
+	}
+	if rr := postForm(other, "/reply", "content=hello&parentId=1&baseId=1"); rr.Code != http.StatusForbidden {
+		t.Errorf("replying to an archived thread got status %d, want 403", rr.Code)
+	}
+
+	// The pinned thread comes first although it is the oldest
+	rr = httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	body := rr.Body.String()
+	if strings.Index(body, "Rules") > strings.Index(body, "Fresh") {
+		t.Errorf("pinned thread isn't listed first")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/thread/2", nil)
+	req.AddCookie(mod)
+	rr = httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(rr, req)
+	if !strings.Contains(rr.Body.String(), `value="unpin"`) {
+		t.Errorf("moderator doesn't see the unpin button")
+	}
+}
+
+func TestCategories(t *testing.T) {
+	Testinit()
+	defer db.DB.Close()
+	defer func() { handlers.ClosedCategories = false }()
+
+	admin := addTestUser(t, "adminid", "admin")
+	user := addTestUser(t, "userid", "user")
+	if found, err := db.SetRole("admin", "admin"); !found || err != nil {
+		t.Fatalf("setting admin role: found %v, error %v", found, err)
+	}
+
+	if rr := postForm(user, "/admin/categories", "action=create&name=drinks"); rr.Code != http.StatusForbidden {
+		t.Errorf("user creating a category got status %d, want 403", rr.Code)
+	}
+	if rr := postForm(admin, "/admin/categories", "action=create&name=Drinks&colour=%23aa5500&description=All+things+to+sip"); rr.Code != http.StatusSeeOther {
+		t.Fatalf("admin creating a category got status %d", rr.Code)
+	}
+	if rr := postForm(admin, "/admin/categories", "action=create&name=coffee&parent=1"); rr.Code != http.StatusSeeOther {
+		t.Fatalf("admin creating a subcategory got status %d", rr.Code)
+	}
+	if rr := postForm(admin, "/admin/categories", "action=update&id=1&parent=2"); rr.Code != http.StatusBadRequest {
+		t.Errorf("making a category its own grandparent got status %d, want 400", rr.Code)
+	}
+	if rr := postForm(admin, "/admin/categories", "action=create&name=tea&colour=red"); rr.Code != http.StatusBadRequest {
+		t.Errorf("bad colour got status %d, want 400", rr.Code)
+	}
+
+	// In a closed set, threads can only use the categories admins made
+	handlers.ClosedCategories = true
+	if rr := postForm(user, "/add", "title=Hi&content=Hello&categories=biscuits"); rr.Code != http.StatusBadRequest {
+		t.Errorf("unknown category in closed mode got status %d, want 400", rr.Code)
+	}
+	if rr := postForm(user, "/add", "title=Espresso+tips&content=Hello&categories=coffee"); rr.Code != http.StatusSeeOther {
+		t.Fatalf("known category in closed mode got status %d", rr.Code)
+	}
+
+	// The parent's page lists the threads of its subcategories too
+	rr := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/category/drinks", nil))
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "Espresso tips") || !strings.Contains(rr.Body.String(), "All things to sip") {
+		t.Errorf("category page got status %d without the thread or description", rr.Code)
+	}
+	rr = httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/category/nothing", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("missing category page got status %d, want 404", rr.Code)
+	}
+
+	// Curated categories survive the cleanup even when unused
+	db.RemoveUnusedCategories()
+	var count int
+	db.DB.QueryRow(`SELECT COUNT(*) FROM categories;`).Scan(&count)
+	if count != 2 {
+		t.Errorf("got %d categories after cleanup, want 2", count)
+	}
+}
+
+func TestReplyImages(t *testing.T) {
+	Testinit()
+	defer db.DB.Close()
+
+	user := addTestUser(t, "userid", "user")
+	postForm(user, "/add", "title=Pictures&content=x&categories=misc")
+	var body strings.Builder
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("content", "Look at this")
+	mw.WriteField("parentId", "1")
+	mw.WriteField("baseId", "1")
+	fw, _ := mw.CreateFormFile("files", "cat.png")
+	fw.Write([]byte("\x89PNG"))
+	mw.Close()
+	req := httptest.NewRequest(http.MethodPost, "/reply", strings.NewReader(body.String()))
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.AddCookie(user)
+	rr := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(rr, req)
+	if rr.Code != http.StatusSeeOther {
+		t.Fatalf("reply with an image got status %d", rr.Code)
+	}
+
+	// The image belongs to the reply, not the thread, and shows under it
+	var imageID string
+	var postID int
+	if err := db.DB.QueryRow(`SELECT id, post_id FROM images WHERE original_name = 'cat.png';`).Scan(&imageID, &postID); err != nil {
+		t.Fatalf("reading the image: %v", err)
+	}
+	defer os.Remove(filepath.Join(db.ImageDir, imageID))
+	if postID != 2 {
+		t.Errorf("image is stored for post %d, want the reply 2", postID)
+	}
+	req = httptest.NewRequest(http.MethodGet, "/thread/1", nil)
+	req.AddCookie(user)
+	rr = httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(rr, req)
+	page := rr.Body.String()
+	reply := strings.Index(page, `id="post-2"`)
+	image := strings.Index(page, "/internal/static/images/"+imageID)
+	if reply < 0 || image < reply {
+		t.Errorf("thread page doesn't show the image under the reply")
+	}
+}
+
+func TestCategoryAliasesAndMerging(t *testing.T) {
+	Testinit()
+	defer db.DB.Close()
+
+	admin := addTestUser(t, "adminid", "admin")
+	user := addTestUser(t, "userid", "user")
+	db.SetRole("admin", "admin")
+	for _, body := range []string{"title=One&content=x&categories=golang", "title=Two&content=x&categories=golang,goo", "title=Three&content=x&categories=goo"} {
+		if rr := postForm(user, "/add", body); rr.Code != http.StatusSeeOther {
+			t.Fatalf("adding a thread with %s got status %d", body, rr.Code)
+		}
+	}
+	categoryID := func(name string) (id int) {
+		db.DB.QueryRow(`SELECT id FROM categories WHERE name = ?;`, name).Scan(&id)
+		return id
+	}
+	golang := categoryID("golang")
+	countRows := func() (rows, categories int) {
+		db.DB.QueryRow(`SELECT COUNT(*) FROM posts_categories;`).Scan(&rows)
+		db.DB.QueryRow(`SELECT COUNT(*) FROM categories;`).Scan(&categories)
+		return rows, categories
+	}
+
+	// Thread two is in both, and can't get a second row for golang
+	if rr := postForm(admin, "/admin/categories", fmt.Sprintf("action=merge&id=%d&into=%d", categoryID("goo"), golang)); rr.Code != http.StatusSeeOther {
+		t.Fatalf("merging got status %d", rr.Code)
+	}
+	if rows, categories := countRows(); rows != 3 || categories != 1 {
+		t.Errorf("after merging: %d category rows, %d categories; want 3 and 1", rows, categories)
+	}
+
+	// Renaming keeps the old name as an alias, like merging does
+	if rr := postForm(admin, "/admin/categories", fmt.Sprintf("action=rename&id=%d&name=gopher", golang)); rr.Code != http.StatusSeeOther {
+		t.Fatalf("renaming got status %d", rr.Code)
+	}
+	if rr := postForm(admin, "/admin/categories", fmt.Sprintf("action=alias&id=%d&alias=go", golang)); rr.Code != http.StatusSeeOther {
+		t.Fatalf("adding an alias got status %d", rr.Code)
+	}
+	if rr := postForm(admin, "/admin/categories", fmt.Sprintf("action=alias&id=%d&alias=goo", golang)); rr.Code != http.StatusConflict {
+		t.Errorf("adding a taken alias got status %d, want 409", rr.Code)
+	}
+
+	// New posts and searches use the category the aliases stand for
+	if rr := postForm(user, "/add", "title=Four&content=x&categories=go,+goo,+golang"); rr.Code != http.StatusSeeOther {
+		t.Fatalf("adding a thread with aliases got status %d", rr.Code)
+	}
+	if rows, categories := countRows(); rows != 4 || categories != 1 {
+		t.Errorf("after posting with aliases: %d category rows, %d categories; want 4 and 1", rows, categories)
+	}
+	rr := postForm(user, "/", "searchcat=search&usersearch=go,golang&multisearch=all")
+	for _, title := range []string{"One", "Two", "Three", "Four"} {
+		if !strings.Contains(rr.Body.String(), ">"+title+"</a>") {
+			t.Errorf("searching all of two aliases didn't find thread %s", title)
+		}
+	}
+
+	// Merging into a grandchild moves the grandchild up, and the child under it, without a loop
+	postForm(admin, "/admin/categories", "action=create&name=drinks")
+	postForm(admin, "/admin/categories", fmt.Sprintf("action=create&name=hot+drinks&parent=%d", categoryID("drinks")))
+	postForm(admin, "/admin/categories", fmt.Sprintf("action=create&name=tea&parent=%d", categoryID("hot drinks")))
+	drinks, hot, tea := categoryID("drinks"), categoryID("hot drinks"), categoryID("tea")
+	if rr := postForm(admin, "/admin/categories", fmt.Sprintf("action=merge&id=%d&into=%d", drinks, tea)); rr.Code != http.StatusSeeOther {
+		t.Fatalf("merging into a grandchild got status %d", rr.Code)
+	}
+	parentOf := func(id int) (parent sql.NullInt64) {
+		db.DB.QueryRow(`SELECT parent_id FROM categories WHERE id = ?;`, id).Scan(&parent)
+		return parent
+	}
+	if p := parentOf(tea); p.Valid {
+		t.Errorf("tea is under %d after the merge, want the top level", p.Int64)
+	}
+	if p := parentOf(hot); p.Int64 != int64(tea) {
+		t.Errorf("hot drinks is under %d after the merge, want tea (%d)", p.Int64, tea)
+	}
+}
+
+func TestNormaliseCategoriesMigration(t *testing.T) {
+	Testinit()
+	defer db.DB.Close()
+
+	// A category written the old way, with a subcategory, an alias and a subscriber, next to its normalised twin
+	addTestUser(t, "userid", "user")
+	_, err := db.DB.Exec(`INSERT INTO categories (id, name, slug) VALUES (1, 'golang', 'golang'), (2, 'GoLang', 'golang-2');
+		INSERT INTO categories (id, name, slug, parent_id) VALUES (3, 'tips', 'tips', 2);
+		INSERT INTO category_aliases (alias, category_id) VALUES ('gl', 2);
+		INSERT INTO subscriptions (user_id, target_type, target_id, token) VALUES ('userid', 'category', 2, 'tok');
+		DELETE FROM migrations WHERE name = 'normalise-categories';`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.MakeTables()
+
+	var categories, parent, alias, subscription, oldAlias int
+	db.DB.QueryRow(`SELECT COUNT(*) FROM categories WHERE id = 2;`).Scan(&categories)
+	db.DB.QueryRow(`SELECT parent_id FROM categories WHERE id = 3;`).Scan(&parent)
+	db.DB.QueryRow(`SELECT category_id FROM category_aliases WHERE alias = 'gl';`).Scan(&alias)
+	db.DB.QueryRow(`SELECT target_id FROM subscriptions WHERE token = 'tok';`).Scan(&subscription)
+	db.DB.QueryRow(`SELECT COUNT(*) FROM category_aliases WHERE category_id = 1 AND alias != 'gl';`).Scan(&oldAlias)
+	if categories != 0 || parent != 1 || alias != 1 || subscription != 1 || oldAlias != 1 {
+		t.Errorf("after merging: %d old categories, subcategory under %d, alias of %d, subscription to %d, %d aliases for the old name; "+
+			"want 0, 1, 1, 1 and 1", categories, parent, alias, subscription, oldAlias)
+	}
+}
+
+func TestMultiWordCategories(t *testing.T) {
+	Testinit()
+	defer db.DB.Close()
+
+	user := addTestUser(t, "userid", "user")
+	if rr := postForm(user, "/add", "title=Neural+nets&content=x&categories=Machine++Learning,+C%2B%2B,+node.js"); rr.Code != http.StatusSeeOther {
+		t.Fatalf("adding a thread with multi-word categories got status %d", rr.Code)
+	}
+	if rr := postForm(user, "/add", "title=Bad&content=x&categories=%3Cb%3E"); rr.Code != http.StatusBadRequest {
+		t.Errorf("category with invalid characters got status %d, want 400", rr.Code)
+	}
+
+	var names []string
+	rows, _ := db.DB.Query(`SELECT name FROM categories ORDER BY name;`)
+	for rows.Next() {
+		var name string
+		rows.Scan(&name)
+		names = append(names, name)
+	}
+	rows.Close()
+	if strings.Join(names, "|") != "c++|machine learning|node.js" {
+		t.Errorf("stored categories %q; want [c++ machine learning node.js]", names)
+	}
+
+	// Searching normalises the same way storing does
+	rr := postForm(user, "/", "searchcat=search&usersearch=MACHINE+learning,+Node.JS&multisearch=all")
+	if !strings.Contains(rr.Body.String(), ">Neural nets</a>") {
+		t.Error("searching differently written categories didn't find the thread")
+	}
+}
+
+func TestThreadSorting(t *testing.T) {
+	Testinit()
+	defer db.DB.Close()
+
+	alice := addTestUser(t, "aliceid", "alice")
+	bob := addTestUser(t, "bobid", "bob")
+	for _, title := range []string{"Replied", "Liked", "Chatty"} {
+		if rr := postForm(alice, "/add", "title="+title+"&content=x&categories=misc"); rr.Code != http.StatusSeeOther {
+			t.Fatalf("adding thread %s got status %d", title, rr.Code)
+		}
+	}
+	postForm(bob, "/reply", "content=a&parentId=3&baseId=3")
+	postForm(alice, "/reply", "content=b&parentId=3&baseId=3")
+	postForm(bob, "/like", "post_id=2&base_id=2")
+	postForm(alice, "/like", "post_id=2&base_id=2")
+	postForm(bob, "/dislike", "post_id=3&base_id=3")
+	postForm(bob, "/reply", "content=c&parentId=1&baseId=1")
+	db.DB.Exec(`UPDATE posts SET created_at = datetime('now', '+1 minute') WHERE id = 5;`) // Latest replies are the newest posts
+	db.DB.Exec(`UPDATE posts SET created_at = datetime('now', '+2 minutes') WHERE id = 6;`)
+
+	order := func(cookie *http.Cookie, url string) string {
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		rr := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(rr, req)
+		body := rr.Body.String()
+		titles := []string{"Replied", "Liked", "Chatty"}
+		sort.Slice(titles, func(i, j int) bool {
+			return strings.Index(body, ">"+titles[i]+"</a>") < strings.Index(body, ">"+titles[j]+"</a>")
+		})
+		return strings.Join(titles, " ")
+	}
+
+	tests := []struct {
+		sort string
+		want string
+	}{
+		{"activity", "Replied Chatty Liked"},
+		{"new", "Chatty Liked Replied"},
+		{"top", "Liked Replied Chatty"},
+		{"hot", "Liked Replied Chatty"},
+		{"replies", "Chatty Replied Liked"},
+		{"nonsense", "Replied Chatty Liked"},
+	}
+	for _, test := range tests {
+		if got := order(nil, "/?sort="+test.sort); got != test.want {
+			t.Errorf("sort=%s: got %s, want %s", test.sort, got, test.want)
+		}
+	}
+
+	// Logged-in users keep the order they picked, on category pages too
+	order(bob, "/?sort=replies")
+	if got := order(bob, "/"); got != "Chatty Replied Liked" {
+		t.Errorf("remembered order: got %s, want most replies first", got)
+	}
+	if got := order(bob, "/category/misc"); got != "Chatty Replied Liked" {
+		t.Errorf("remembered order on category page: got %s, want most replies first", got)
+	}
+	if got := order(alice, "/"); got != "Replied Chatty Liked" {
+		t.Errorf("another user's order: got %s, want latest activity first", got)
+	}
+
+	// Lists count the replies of each thread
+	for _, url := range []string{"/", "/category/misc"} {
+		rr := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, url, nil))
+		if !strings.Contains(strings.Join(strings.Fields(rr.Body.String()), " "), `<a href="/thread/3"><span class="material-symbols-outlined">comment</span>2</a>`) {
+			t.Errorf("%s doesn't count the two replies of Chatty", url)
+		}
+	}
+
+	// Pinned threads stay on top in every order
+	db.DB.Exec(`UPDATE posts SET pinned = 1 WHERE id = 1;`)
+	if got := order(nil, "/?sort=top"); got != "Replied Liked Chatty" {
+		t.Errorf("pinned thread in top order: got %s, want it first", got)
+	}
+}
+
+func TestReplyTree(t *testing.T) {
+	Testinit()
+	defer db.DB.Close()
+
+	alice := addTestUser(t, "aliceid", "alice")
+	bob := addTestUser(t, "bobid", "bob")
+	postForm(alice, "/add", "title=Tree&content=x&categories=misc")
+	postForm(alice, "/add", "title=Other&content=x&categories=misc")
+	postForm(bob, "/reply", "content=first&parentId=1&baseId=1")  // 3
+	postForm(bob, "/reply", "content=second&parentId=1&baseId=1") // 4
+	for id, parent := 5, 3; id <= 10; id, parent = id+1, id {     // Each under the one before
+		postForm(bob, "/reply", fmt.Sprintf("content=deep&parentId=%d&baseId=1", parent))
+	}
+	postForm(alice, "/like", "post_id=4&base_id=1")
+
+	page := func(url string) (int, string) {
+		rr := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, url, nil))
+		return rr.Code, rr.Body.String()
+	}
+	firstOf := func(body string) string {
+		if strings.Index(body, `id="post-3"`) < strings.Index(body, `id="post-4"`) {
+			return "first"
+		}
+		return "second"
+	}
+
+	for sort, want := range map[string]string{"": "first", "oldest": "first", "newest": "second", "best": "second"} {
+		if _, body := page("/thread/1?sort=" + sort); firstOf(body) != want {
+			t.Errorf("sort=%s: the %s reply came first, want the %s", sort, firstOf(body), want)
+		}
+	}
+
+	// Replies below the maximum depth are behind a link that focuses on their parent
+	_, body := page("/thread/1")
+	if !strings.Contains(body, `id="post-9"`) || strings.Contains(body, `id="post-10"`) || !strings.Contains(body, `href="/thread/1?focus=9"`) {
+		t.Error("the tree wasn't cut at the maximum depth with a link to continue")
+	}
+	code, body := page("/thread/1?focus=9")
+	if code != http.StatusOK || !strings.Contains(body, `id="post-10"`) || strings.Contains(body, `id="post-4"`) {
+		t.Errorf("focused page got status %d, or didn't show just the focused branch", code)
+	}
+	if code, _ := page("/thread/2?focus=9"); code != http.StatusNotFound {
+		t.Errorf("focus on a reply of another thread got status %d, want 404", code)
+	}
+	if code, _ := page("/thread/1?focus=x"); code != http.StatusBadRequest {
+		t.Errorf("invalid focus got status %d, want 400", code)
+	}
+
+	// Heavily disliked replies are folded, but not when asked for
+	for i := 0; i < 5; i++ {
+		db.DB.Exec(`INSERT INTO post_reactions (user_id, post_id, reaction_type) VALUES (?, 3, 'dislike');`, fmt.Sprint("voter", i))
+	}
+	if _, body := page("/thread/1"); !strings.Contains(body, `<details class="collapsed-reply">`) {
+		t.Error("a heavily disliked reply wasn't collapsed")
+	}
+	if _, body := page("/thread/1?focus=3"); strings.Contains(body, `<details class="collapsed-reply">`) {
+		t.Error("the focused reply was collapsed")
+	}
+}
+
+func TestPermalinks(t *testing.T) {
+	Testinit()
+	defer db.DB.Close()
+
+	alice := addTestUser(t, "aliceid", "alice")
+	postForm(alice, "/add", "title=Links&content=x&categories=misc")
+	if rr := postForm(alice, "/reply", "content=sibling&parentId=1&baseId=1"); rr.Header().Get("Location") != "/thread/1#post-2" {
+		t.Errorf("replying redirected to %q, want the new reply", rr.Header().Get("Location"))
+	}
+	postForm(alice, "/reply", "content=deep&parentId=1&baseId=1")
+	for parent := 3; parent <= 8; parent++ { // Replies 4 to 9, each under the one before
+		postForm(alice, "/reply", fmt.Sprintf("content=deep&parentId=%d&baseId=1", parent))
+	}
+	if rr := postForm(alice, "/like", "post_id=2&base_id=1"); rr.Header().Get("Location") != "/thread/1#post-2" {
+		t.Errorf("liking a reply redirected to %q, want the reply", rr.Header().Get("Location"))
+	}
+	if rr := postForm(alice, "/like", "post_id=1&base_id=1"); rr.Header().Get("Location") != "/thread/1" {
+		t.Errorf("liking a thread redirected to %q, want the thread", rr.Header().Get("Location"))
+	}
+
+	get := func(url string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, url, nil))
+		return rr
+	}
+	tests := []struct {
+		url      string
+		code     int
+		location string
+	}{
+		{"/post/1", http.StatusFound, "/thread/1"},
+		{"/post/2", http.StatusFound, "/thread/1#post-2"},
+		{"/post/8", http.StatusFound, "/thread/1#post-8"},
+		{"/post/9", http.StatusFound, "/thread/1?focus=9#post-9"}, // Seventh level
+		{"/post/99", http.StatusNotFound, ""},
+		{"/post/x", http.StatusBadRequest, ""},
+	}
+	for _, test := range tests {
+		rr := get(test.url)
+		if rr.Code != test.code || rr.Header().Get("Location") != test.location {
+			t.Errorf("%s got status %d to %q, want %d to %q", test.url, rr.Code, rr.Header().Get("Location"), test.code, test.location)
+		}
+	}
+
+	// The focused view shows the replies above the focused one, but not their other branches
+	body := get("/thread/1?focus=9").Body.String()
+	if !strings.Contains(body, `id="post-3"`) || !strings.Contains(body, `class="reply-and-form focused" id="post-9"`) || strings.Contains(body, `id="post-2"`) {
+		t.Error("focused view didn't show the reply with just its ancestors")
+	}
+}
+
+func TestPostTampering(t *testing.T) {
+	Testinit()
+	defer db.DB.Close()
+
+	alice := addTestUser(t, "aliceid", "alice")
+	postForm(alice, "/add", "title=One&content=x&categories=misc")
+	postForm(alice, "/add", "title=Two&content=x&categories=misc")
+	postForm(alice, "/reply", "content=reply&parentId=1&baseId=1") // 3, in thread one
+
+	tests := []struct {
+		name string
+		url  string
+		body string
+		code int
+	}{
+		{"reply to a parent that isn't a number", "/reply", "content=x&parentId=x&baseId=1", http.StatusBadRequest},
+		{"reply with a base that isn't a number", "/reply", "content=x&parentId=1&baseId=x", http.StatusBadRequest},
+		{"reply without parent and base", "/reply", "content=x", http.StatusBadRequest},
+		{"reply to a missing post", "/reply", "content=x&parentId=99&baseId=1", http.StatusNotFound},
+		{"reply to a thread with another thread as base", "/reply", "content=x&parentId=2&baseId=1", http.StatusBadRequest},
+		{"reply to a reply in another thread", "/reply", "content=x&parentId=3&baseId=2", http.StatusBadRequest},
+		{"reply with a reply as base", "/reply", "content=x&parentId=3&baseId=3", http.StatusBadRequest},
+		{"reaction to a post that isn't a number", "/like", "post_id=x&base_id=1", http.StatusBadRequest},
+		{"reaction without a thread", "/like", "post_id=3", http.StatusBadRequest},
+		{"reaction to a missing post", "/dislike", "post_id=99&base_id=1", http.StatusNotFound},
+		{"reaction to a reply in another thread", "/like", "post_id=3&base_id=2", http.StatusBadRequest},
+		{"reaction to a thread through another", "/like", "post_id=2&base_id=1", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		if rr := postForm(alice, test.url, test.body); rr.Code != test.code {
+			t.Errorf("%s: got status %d, want %d", test.name, rr.Code, test.code)
+		}
+	}
+
+	var posts, reactions int
+	db.DB.QueryRow(`SELECT COUNT(*) FROM posts;`).Scan(&posts)
+	db.DB.QueryRow(`SELECT COUNT(*) FROM post_reactions;`).Scan(&reactions)
+	if posts != 3 || reactions != 0 {
+		t.Errorf("tampered requests left %d posts and %d reactions, want 3 and 0", posts, reactions)
+	}
+
+	if rr := postForm(alice, "/reply", "content=x&parentId=3&baseId=1"); rr.Code != http.StatusSeeOther {
+		t.Errorf("a valid reply to a reply got status %d", rr.Code)
+	}
+}
+
+func TestEmojiReactions(t *testing.T) {
+	Testinit()
+	defer db.DB.Close()
+
+	alice := addTestUser(t, "aliceid", "alice")
+	bob := addTestUser(t, "bobid", "bob")
+	postForm(alice, "/add", "title=Jokes&content=x&categories=misc")
+	for _, step := range []struct{ url, body string }{
+		{"/like", "post_id=1&base_id=1"},
+		{"/react", "post_id=1&base_id=1&reaction=heart"},
+		{"/react", "post_id=1&base_id=1&reaction=laugh"},
+		{"/dislike", "post_id=1&base_id=1"},              // Replaces the like, leaves the emoji
+		{"/react", "post_id=1&base_id=1&reaction=laugh"}, // Takes it back
+	} {
+		if rr := postForm(bob, step.url, step.body); rr.Code != http.StatusSeeOther {
+			t.Fatalf("%s %s got status %d", step.url, step.body, rr.Code)
+		}
+	}
+	postForm(alice, "/react", "post_id=1&base_id=1&reaction=heart")
+	if rr := postForm(bob, "/react", "post_id=1&base_id=1&reaction=poop"); rr.Code != http.StatusBadRequest {
+		t.Errorf("unknown reaction got status %d, want 400", rr.Code)
+	}
+
+	given := make(map[string]int)
+	rows, _ := db.DB.Query(`SELECT reaction_type, COUNT(*) FROM post_reactions GROUP BY reaction_type;`)
+	for rows.Next() {
+		var kind string
+		var count int
+		rows.Scan(&kind, &count)
+		given[kind] = count
+	}
+	rows.Close()
+	if len(given) != 2 || given["dislike"] != 1 || given["heart"] != 2 {
+		t.Errorf("stored reactions %v, want a dislike and two hearts", given)
+	}
+
+	// Counts and who reacted are shown, and the viewer's own reactions marked
+	req := httptest.NewRequest(http.MethodGet, "/thread/1", nil)
+	req.AddCookie(bob)
+	rr := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(rr, req)
+	body := rr.Body.String()
+	if !strings.Contains(body, `class="emoji-button mine" title="Love: bob, alice"`) || !strings.Contains(body, `data-emoji="1-heart">2<`) {
+		t.Error("thread page didn't show the hearts with who gave them")
+	}
+	if !strings.Contains(body, `title="Dislike: bob"`) {
+		t.Error("thread page didn't show who disliked")
+	}
+}
+
+func TestReputation(t *testing.T) {
+	Testinit()
+	defer db.DB.Close()
+
+	alice := addTestUser(t, "aliceid", "alice")
+	bob := addTestUser(t, "bobid", "bob")
+	newbie := addTestUser(t, "newid", "newbie")
+	db.DB.Exec(`UPDATE users SET created_at = CURRENT_TIMESTAMP WHERE id = 'newid';`)
+	postForm(alice, "/add", "title=Standing&content=x&categories=misc")
+
+	// Each change of a reaction moves the author's score by the difference, own reactions don't count
+	for _, step := range []struct {
+		user  *http.Cookie
+		url   string
+		score int
+	}{
+		{bob, "/like", 10},
+		{bob, "/dislike", -5},
+		{bob, "/dislike", 0},
+		{alice, "/like", 0},
+		{bob, "/like", 10},
+	} {
+		postForm(step.user, step.url, "post_id=1&base_id=1")
+		var score int
+		db.DB.QueryRow(`SELECT reaction_score FROM users WHERE id = 'aliceid';`).Scan(&score)
+		if score != step.score {
+			t.Fatalf("after %s the score is %d, want %d", step.url, score, step.score)
+		}
+	}
+
+	// A new account posts a few times an hour, without images
+	for i := 1; i <= 5; i++ {
+		if rr := postForm(newbie, "/reply", "content=hi&parentId=1&baseId=1"); rr.Code != http.StatusSeeOther {
+			t.Fatalf("reply %d of a new account got status %d", i, rr.Code)
+		}
+	}
+	if rr := postForm(newbie, "/reply", "content=hi&parentId=1&baseId=1"); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("sixth reply of a new account got status %d, want 429", rr.Code)
+	}
+	var body strings.Builder
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("title", "Picture")
+	mw.WriteField("content", "x")
+	mw.WriteField("categories", "misc")
+	fw, _ := mw.CreateFormFile("files", "cat.png")
+	fw.Write([]byte("\x89PNG"))
+	mw.Close()
+	db.DB.Exec(`DELETE FROM posts WHERE authorID = 'newid';`)
+	req := httptest.NewRequest(http.MethodPost, "/add", strings.NewReader(body.String()))
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.AddCookie(newbie)
+	rr := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("image from a new account got status %d, want 403", rr.Code)
+	}
+
+	// The author and trusted users change the categories, others can't
+	categories := func() string {
+		var names string
+		db.DB.QueryRow(`SELECT GROUP_CONCAT(c.name, ',') FROM posts_categories pc JOIN categories c ON c.id = pc.category_id
+						WHERE pc.post_id = 1 ORDER BY c.name;`).Scan(&names)
+		return names
+	}
+	if rr := postForm(bob, "/thread/categories", "thread=1&categories=spam"); rr.Code != http.StatusForbidden {
+		t.Errorf("member retagging got status %d, want 403", rr.Code)
+	}
+	if rr := postForm(alice, "/thread/categories", "thread=1&categories=misc, answers"); rr.Code != http.StatusSeeOther {
+		t.Errorf("author retagging got status %d", rr.Code)
+	}
+	db.DB.Exec(`UPDATE users SET reaction_score = 500 WHERE id = 'bobid';`)
+	if rr := postForm(bob, "/thread/categories", "thread=1&categories=help"); rr.Code != http.StatusSeeOther {
+		t.Errorf("trusted user retagging got status %d", rr.Code)
+	}
+	if got := categories(); got != "help" {
+		t.Errorf("thread is in %q, want help", got)
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	Testinit()
+	defer db.DB.Close()
+
+	alice := addTestUser(t, "aliceid", "alice")
+	bob := addTestUser(t, "bobid", "bob")
+	for i := 1; i <= 5; i++ {
+		if rr := postForm(alice, "/add", fmt.Sprintf("title=Thread%d&content=x&categories=misc", i)); rr.Code != http.StatusSeeOther {
+			t.Fatalf("thread %d got status %d", i, rr.Code)
+		}
+	}
+	rr := postForm(alice, "/add", "title=Thread6&content=x&categories=misc")
+	if rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") == "" {
+		t.Errorf("sixth thread got status %d with Retry-After %q, want 429 with a wait", rr.Code, rr.Header().Get("Retry-After"))
+	}
+
+	// A form sent twice makes one post, and the second time leads to it
+	first := postForm(bob, "/reply", "content=once&parentId=1&baseId=1&post_key=k1")
+	second := postForm(bob, "/reply", "content=once&parentId=1&baseId=1&post_key=k1")
+	var replies int
+	db.DB.QueryRow(`SELECT COUNT(*) FROM posts WHERE content = 'once';`).Scan(&replies)
+	if replies != 1 || second.Header().Get("Location") != first.Header().Get("Location") {
+		t.Errorf("the same form twice made %d replies, redirected to %q and %q", replies,
+			first.Header().Get("Location"), second.Header().Get("Location"))
+	}
+
+	// Users from one address share its limit, trusted users have none
+	if err := handlers.ConfigureLimits("", "reply=2/1m", "trusted"); err != nil {
+		t.Fatal(err)
+	}
+	postForm(alice, "/reply", "content=a&parentId=1&baseId=1")
+	postForm(bob, "/reply", "content=b&parentId=1&baseId=1")
+	if rr := postForm(bob, "/reply", "content=c&parentId=1&baseId=1"); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("third reply from one address got status %d, want 429", rr.Code)
+	}
+	db.DB.Exec(`UPDATE users SET reaction_score = 500 WHERE id = 'bobid';`)
+	if rr := postForm(bob, "/reply", "content=d&parentId=1&baseId=1"); rr.Code != http.StatusSeeOther {
+		t.Errorf("trusted user's reply got status %d", rr.Code)
+	}
+
+	// A refused attempt doesn't count against the user, so the wait it was told is enough
+	carol := addTestUser(t, "carolid", "carol")
+	dave := addTestUser(t, "daveid", "dave")
+	if err := handlers.ConfigureLimits("reply=1/3s", "reply=1/1s", "trusted"); err != nil {
+		t.Fatal(err)
+	}
+	postForm(carol, "/reply", "content=e&parentId=1&baseId=1")
+	rr = postForm(dave, "/reply", "content=f&parentId=1&baseId=1")
+	if rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") != "1" {
+		t.Errorf("reply over the address limit got status %d with Retry-After %q, want 429 and 1", rr.Code, rr.Header().Get("Retry-After"))
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if rr := postForm(dave, "/reply", "content=f&parentId=1&baseId=1"); rr.Code != http.StatusSeeOther {
+		t.Errorf("reply after waiting got status %d with Retry-After %q", rr.Code, rr.Header().Get("Retry-After"))
+	}
+}
+
+func TestContentFilters(t *testing.T) {
+	Testinit()
+	defer db.DB.Close()
+	filter.Use(filter.NewBlocklist("casino, free money"), filter.LinkLimit{Max: 1}, filter.Bayes{Threshold: 0.9, MinTrained: 2})
+	defer filter.Use()
+
+	alice := addTestUser(t, "aliceid", "alice")
+	bob := addTestUser(t, "bobid", "bob")
+	newbie := addTestUser(t, "newid", "newbie")
+	mod := addTestUser(t, "modid", "mod")
+	db.DB.Exec(`UPDATE users SET created_at = CURRENT_TIMESTAMP WHERE id = 'newid';`)
+	db.DB.Exec(`UPDATE users SET role = 'moderator' WHERE id = 'modid';`)
+	postForm(alice, "/add", "title=Plans&content=x&categories=misc")
+	countPosts := func() (posts, held int) {
+		db.DB.QueryRow(`SELECT (SELECT COUNT(*) FROM posts), (SELECT COUNT(*) FROM held_posts);`).Scan(&posts, &held)
+		return posts, held
+	}
+
+	if rr := postForm(alice, "/reply", "content=Get+FREE+money!&parentId=1&baseId=1"); rr.Code != http.StatusBadRequest {
+		t.Errorf("blocked phrase got status %d, want 400", rr.Code)
+	}
+	rr := postForm(newbie, "/reply", "content=see+http://a.example+and+www.b.example&parentId=1&baseId=1&post_key=k1")
+	if posts, held := countPosts(); rr.Header().Get("Location") != "/moderation" || posts != 1 || held != 1 {
+		t.Fatalf("links of a new user went to %q, %d posts and %d held", rr.Header().Get("Location"), posts, held)
+	}
+	// Sending the held form again doesn't queue it twice
+	rr = postForm(newbie, "/reply", "content=see+http://a.example+and+www.b.example&parentId=1&baseId=1&post_key=k1")
+	if posts, held := countPosts(); rr.Header().Get("Location") != "/moderation" || posts != 1 || held != 1 {
+		t.Fatalf("resent held post went to %q, %d posts and %d held", rr.Header().Get("Location"), posts, held)
+	}
+
+	// The author and moderators see the held post, others don't
+	for _, c := range []struct {
+		user  *http.Cookie
+		shown bool
+	}{{newbie, true}, {bob, false}, {mod, true}} {
+		req := httptest.NewRequest(http.MethodGet, "/moderation", nil)
+		req.AddCookie(c.user)
+		rr := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(rr, req)
+		if strings.Contains(rr.Body.String(), "a.example") != c.shown {
+			t.Errorf("%s sees the held post: %v, want %v", c.user.Value, !c.shown, c.shown)
+		}
+	}
+	if rr := postForm(newbie, "/moderation", "id=1&action=approve"); rr.Code != http.StatusForbidden {
+		t.Errorf("author approving got status %d, want 403", rr.Code)
+	}
+	if rr := postForm(mod, "/moderation", "id=1&action=approve"); rr.Code != http.StatusSeeOther {
+		t.Errorf("approving got status %d", rr.Code)
+	}
+	if posts, held := countPosts(); posts != 2 || held != 0 {
+		t.Errorf("after approving there are %d posts and %d held, want 2 and 0", posts, held)
+	}
+
+	// Decisions train the classifier, which then holds posts like the removed ones
+	for i, content := range []string{"cheap pills buy now", "buy pills cheap today", "meeting notes for tuesday", "notes from the meeting"} {
+		db.DB.Exec(`INSERT INTO held_posts (base_id, parent_id, author, authorID, content, filter, reason)
+					VALUES (1, 1, 'bob', 'bobid', ?, 'test', 'test');`, content)
+		action := "reject"
+		if i >= 2 {
+			action = "approve"
+		}
+		postForm(mod, "/moderation", fmt.Sprintf("id=%d&action=%s", i+2, action))
+	}
+	if _, held := countPosts(); held != 0 {
+		t.Fatalf("%d posts left in the queue", held)
+	}
+	if rr := postForm(alice, "/reply", "content=buy+cheap+pills+now&parentId=1&baseId=1"); rr.Header().Get("Location") != "/moderation" {
+		t.Errorf("spam went to %q, want the queue", rr.Header().Get("Location"))
+	}
+	if rr := postForm(alice, "/reply", "content=notes+for+the+meeting&parentId=1&baseId=1"); rr.Header().Get("Location") == "/moderation" {
+		t.Error("a post like the approved ones was held")
+	}
+	if rr := postForm(mod, "/reply", "content=buy+cheap+pills+now&parentId=1&baseId=1"); rr.Header().Get("Location") == "/moderation" {
+		t.Error("a moderator's post was held")
+	}
+}
+
+func TestDrafts(t *testing.T) {
+	Testinit()
+	defer db.DB.Close()
+
+	alice := addTestUser(t, "aliceid", "alice")
+	postForm(alice, "/add", "title=Plans&content=x&categories=misc")
+	drafts := func(cookie *http.Cookie) string {
+		req := httptest.NewRequest(http.MethodGet, "/drafts", nil)
+		req.AddCookie(cookie)
+		rr := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(rr, req)
+		return rr.Body.String()
+	}
+
+	// Drafts are saved while writing and come back, until they are posted
+	if rr := postForm(alice, "/drafts", "target=reply-1&thread=1&content=half+a+thought"); rr.Code != http.StatusNoContent {
+		t.Fatalf("saving a draft got status %d", rr.Code)
+	}
+	if rr := postForm(alice, "/drafts", "target=reply-1&thread=2&content=x"); rr.Code == http.StatusNoContent {
+		t.Error("a draft of a reply outside its thread was saved")
+	}
+	if got := drafts(alice); !strings.Contains(got, "half a thought") {
+		t.Errorf("drafts are %s, want the saved one", got)
+	}
+	postForm(alice, "/reply", "content=a+whole+thought&parentId=1&baseId=1")
+	if got := drafts(alice); got != "[]\n" {
+		t.Errorf("drafts after posting are %s, want none", got)
+	}
+
+	// A thread sent after the session expired waits for the next login from the same browser
+	hashPass, _ := bcrypt.GenerateFromPassword([]byte("testpass"), bcrypt.DefaultCost)
+	db.DB.Exec(`UPDATE users SET password = ? WHERE id = 'aliceid';`, string(hashPass))
+	db.DB.Exec(`DELETE FROM sessions;`)
+	rr := postForm(alice, "/add", "title=Lost&content=long+text&categories=misc")
+	var draftCookie *http.Cookie
+	for _, c := range rr.Result().Cookies() {
+		if c.Name == "draft_token" {
+			draftCookie = c
+		}
+	}
+	if rr.Header().Get("Location") != "/expired" || draftCookie == nil {
+		t.Fatalf("expired session went to %q with draft cookie %v", rr.Header().Get("Location"), draftCookie)
+	}
+	rr = postForm(draftCookie, "/loguserin", "username-or-email=alice&password=testpass&return_url=/")
+	if rr.Header().Get("Location") != "/#draft" {
+		t.Errorf("login went to %q, want the new thread form", rr.Header().Get("Location"))
+	}
+	var session *http.Cookie
+	for _, c := range rr.Result().Cookies() {
+		if c.Name == "session_token" {
+			session = c
+		}
+	}
+	if session == nil {
+		t.Fatal("no session after logging in")
+	}
+	if got := drafts(session); !strings.Contains(got, `"title":"Lost"`) || !strings.Contains(got, "long text") {
+		t.Errorf("drafts after logging in are %s, want the thread", got)
+	}
+}
+
+func TestThreadSchedule(t *testing.T) {
+	Testinit()
+	defer db.DB.Close()
+
+	alice := addTestUser(t, "aliceid", "alice")
+	bob := addTestUser(t, "bobid", "bob")
+	mod := addTestUser(t, "modid", "mod")
+	db.DB.Exec(`UPDATE users SET timezone = 'UTC';`)
+	db.DB.Exec(`UPDATE users SET role = 'moderator' WHERE id = 'modid';`)
+	inputTime := func(d time.Duration) string { return time.Now().UTC().Add(d).Format("2006-01-02T15:04") }
+	get := func(cookie *http.Cookie, url string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		req.AddCookie(cookie)
+		rr := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(rr, req)
+		return rr
+	}
+	liveUpdates := func(cookie *http.Cookie) *httptest.ResponseRecorder {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second) // A stream that opens ends with the test
+		defer cancel()
+		req := httptest.NewRequest(http.MethodGet, "/events/1", nil).WithContext(ctx)
+		req.AddCookie(cookie)
+		rr := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := postForm(alice, "/add", "title=Early&content=x&categories=misc&publish_at="+inputTime(time.Hour)+
+		"&expires_at="+inputTime(time.Minute)); rr.Code != http.StatusBadRequest {
+		t.Errorf("expiry before publishing got status %d, want 400", rr.Code)
+	}
+	postForm(alice, "/add", "title=Launch&content=x&categories=misc&publish_at="+inputTime(2*time.Hour))
+
+	// Until it is published only the author and moderators see the thread, and nobody replies
+	for _, c := range []struct {
+		user  *http.Cookie
+		shown bool
+	}{{alice, true}, {bob, false}, {mod, true}} {
+		listed := strings.Contains(get(c.user, "/").Body.String(), "Launch")
+		page := get(c.user, "/thread/1").Code == http.StatusOK
+		if listed != c.shown || page != c.shown {
+			t.Errorf("%s sees the scheduled thread listed %v and its page %v, want %v", c.user.Value, listed, page, c.shown)
+		}
+	}
+	// To others it isn't there, not for replies, reactions, live updates or links either
+	for _, c := range []struct {
+		name string
+		rr   *httptest.ResponseRecorder
+	}{
+		{"reply", postForm(bob, "/reply", "content=first&parentId=1&baseId=1")},
+		{"reaction", postForm(bob, "/like", "post_id=1&base_id=1")},
+		{"live updates", liveUpdates(bob)},
+		{"post link", get(bob, "/post/1")},
+	} {
+		if c.rr.Code != http.StatusNotFound {
+			t.Errorf("%s of a scheduled thread got status %d, want 404", c.name, c.rr.Code)
+		}
+	}
+	if page := get(alice, "/thread/1").Body.String(); !strings.Contains(page, "Published on") {
+		t.Error("the thread page doesn't tell when the thread is published")
+	}
+
+	// The scheduler publishes it when its time has come
+	db.DB.Exec(`UPDATE posts SET publish_at = datetime('now', '-1 minute'), created_at = datetime('now', '-1 minute') WHERE id = 1;`)
+	handlers.RunScheduler()
+	var scheduled bool
+	db.DB.QueryRow(`SELECT publish_at IS NOT NULL FROM posts WHERE id = 1;`).Scan(&scheduled)
+	if scheduled || !strings.Contains(get(bob, "/").Body.String(), "Launch") {
+		t.Error("the thread wasn't published")
+	}
+
+	// Only the author and moderators schedule its expiry, and then it is hidden
+	if rr := postForm(bob, "/thread/schedule", "thread=1&expire_action=hide&expires_at="+inputTime(time.Hour)); rr.Code != http.StatusForbidden {
+		t.Errorf("others scheduling got status %d, want 403", rr.Code)
+	}
+	if rr := postForm(alice, "/thread/schedule", "thread=1&expire_action=hide&expires_at="+inputTime(time.Hour)); rr.Code != http.StatusSeeOther {
+		t.Fatalf("scheduling the expiry got status %d", rr.Code)
+	}
+	db.DB.Exec(`UPDATE posts SET expires_at = datetime('now', '-1 minute') WHERE id = 1;`)
+	handlers.RunScheduler()
+	var hidden bool
+	db.DB.QueryRow(`SELECT hidden FROM posts WHERE id = 1;`).Scan(&hidden)
+	if !hidden || strings.Contains(get(bob, "/").Body.String(), "Launch") || get(bob, "/thread/1").Code != http.StatusNotFound {
+		t.Error("the expired thread is still shown to others")
+	}
+	if rr := postForm(bob, "/reply", "content=late&parentId=1&baseId=1"); rr.Code != http.StatusNotFound {
+		t.Errorf("reply to a hidden thread got status %d, want 404", rr.Code)
+	}
+	if rr := postForm(bob, "/react", "post_id=1&base_id=1&reaction=heart"); rr.Code != http.StatusNotFound {
+		t.Errorf("reaction to a hidden thread got status %d, want 404", rr.Code)
+	}
+	if rr := liveUpdates(bob); rr.Code != http.StatusNotFound {
+		t.Errorf("live updates of a hidden thread got status %d, want 404", rr.Code)
+	}
+	if get(mod, "/thread/1").Code != http.StatusOK {
+		t.Error("a moderator can't see the hidden thread")
+	}
+}
@@ -0,0 +1,128 @@
+package category
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Longest category name and description, and most categories on one thread
+const (
+	NameMaxLen        = 50
+	DescriptionMaxLen = 300
+	MaxPerThread      = 10
+)
+
+// Separator goes between categories in the category field of a new thread
+const Separator = ","
+
+// symbols are the characters other than letters, digits and spaces allowed in names, like in c++, c# and node.js
+const symbols = "+#.-_&"
+
+// Errors of the validation rules, written as messages for the user
+var (
+	ErrEmpty      = errors.New("Add at least one category")
+	ErrTooLong    = errors.New("Category names can be at most 50 characters long")
+	ErrTooMany    = errors.New("A thread can have at most 10 categories")
+	ErrCharacters = errors.New("Category names can have letters, digits, spaces and the characters + # . - _ &")
+)
+
+var colourPattern = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// slugWords spell out symbols that would otherwise disappear from slugs
+var slugWords = strings.NewReplacer("+", " plus ", "#", " sharp ", "&", " and ")
+
+// Normalize puts a category name in the form it is stored and searched in: NFKC normalised,
+// case folded, and with single spaces between words. Full-width letters, ligatures and case
+// differences all end up the same.
+func Normalize(name string) string {
+	name = cases.Fold().String(norm.NFKC.String(name)) // A Caser isn't safe for concurrent use, so each call makes one
+	return strings.Join(strings.Fields(name), " ")
+}
+
+// Validate checks a normalised name against the rules for category names
+func Validate(name string) error {
+	if name == "" {
+		return ErrEmpty
+	}
+	if utf8.RuneCountInString(name) > NameMaxLen {
+		return ErrTooLong
+	}
+	alphanumeric := false
+	for _, r := range name {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r):
+			alphanumeric = true
+		case r == ' ' || strings.ContainsRune(symbols, r):
+		default:
+			return ErrCharacters
+		}
+	}
+	if !alphanumeric {
+		return ErrCharacters
+	}
+	return nil
+}
+
+// Split normalises each comma separated name in the input, leaving out empty ones and duplicates
+func Split(input string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	// Normalising first turns full-width commas into plain ones
+	for _, part := range strings.Split(norm.NFKC.String(input), Separator) {
+		name := Normalize(part)
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Parse splits the category field of a new thread into normalised names, and validates them
+func Parse(input string) ([]string, error) {
+	names := Split(input)
+	if len(names) == 0 {
+		return nil, ErrEmpty
+	}
+	if len(names) > MaxPerThread {
+		return nil, ErrTooMany
+	}
+	for _, name := range names {
+		if err := Validate(name); err != nil {
+			return nil, err
+		}
+	}
+	return names, nil
+}
+
+// Slug makes the URL name of a category: letters and digits, with dashes between words
+func Slug(name string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range Normalize(slugWords.Replace(name)) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+	if b.Len() == 0 {
+		return "category"
+	}
+	return b.String()
+}
+
+// ValidColour tells if c is empty or a colour like #1a2b3c
+func ValidColour(c string) bool {
+	return c == "" || colourPattern.MatchString(c)
+}
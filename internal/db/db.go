@@ -2,12 +2,31 @@ package db
 
 import (
 	"database/sql"
+	"fmt"
+	"forum/internal/category"
 	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
 	"time"
 )
 
 var DB *sql.DB
 
+// ImageDir is where uploaded post images are stored
+const ImageDir = "internal/static/images"
+
+// imageGracePeriod keeps files that may still be waiting for their row from being collected
+const imageGracePeriod = time.Hour
+
+// ImageReport lists what an image reconciliation found and removed (or would remove in a dry run)
+type ImageReport struct {
+	OrphanFiles  []string // files in ImageDir without a row in images
+	DanglingRows []string // rows in images without a file or without a post
+	Reclaimed    int64    // bytes of orphan files
+}
+
 func OpenDB() error {
 	var err error
 	DB, err = sql.Open("sqlite3", "data/forum.db")
@@ -30,13 +49,265 @@ func RemoveExpiredSessions() {
 	}
 }
 
-// RemoveUnusedCategories deletes unused categories, runs with dataCleanup()
+// RemoveOldPostKeys forgets the keys of forms sent over a day ago, runs with dataCleanup()
+func RemoveOldPostKeys() {
+	_, err := DB.Exec(`DELETE FROM post_keys WHERE created_at < datetime('now', '-1 day');`)
+	if err != nil {
+		log.Printf("Error deleting old post keys: %v\n", err.Error())
+	}
+}
+
+// RemoveOldDrafts deletes drafts kept over an expired session for a day and nobody claimed, and drafts
+// untouched for a month, runs with dataCleanup()
+func RemoveOldDrafts() {
+	_, err := DB.Exec(`DELETE FROM drafts WHERE (user_id IS NULL AND updated_at < datetime('now', '-1 day'))
+						  OR updated_at < datetime('now', '-30 days');`)
+	if err != nil {
+		log.Printf("Error deleting old drafts: %v\n", err.Error())
+	}
+}
+
+// RemoveUnusedCategories deletes unused categories that no admin has curated, runs with dataCleanup()
 func RemoveUnusedCategories() {
-	delUnusedCatsQuery := `DELETE FROM categories WHERE id NOT IN (SELECT DISTINCT category_id	FROM posts_categories);`
+	delUnusedCatsQuery := `DELETE FROM categories WHERE curated = 0 AND id NOT IN (SELECT DISTINCT category_id	FROM posts_categories);`
 	_, err := DB.Exec(delUnusedCatsQuery)
 	if err != nil {
 		log.Printf("Error deleting unused categories: %v\n", err.Error())
 	}
+	_, err = DB.Exec(`DELETE FROM subscriptions WHERE target_type = 'category' AND target_id NOT IN (SELECT id FROM categories);`)
+	if err != nil {
+		log.Printf("Error deleting subscriptions of removed categories: %v\n", err.Error())
+	}
+	_, err = DB.Exec(`DELETE FROM category_aliases WHERE category_id NOT IN (SELECT id FROM categories);`)
+	if err != nil {
+		log.Printf("Error deleting aliases of removed categories: %v\n", err.Error())
+	}
+}
+
+// ArchiveInactiveThreads makes threads read-only when nothing has been posted in them for the given number of days.
+// Pinned threads stay open, and reopened ones get a new quiet period. Runs with dataCleanup().
+func ArchiveInactiveThreads(days int) {
+	cutoff := fmt.Sprintf("-%d days", days)
+	res, err := DB.Exec(`UPDATE posts SET archived = 1
+						 WHERE title != '' AND archived = 0 AND pinned = 0
+						 AND (reopened_at IS NULL OR reopened_at < datetime('now', ?))
+						 AND (SELECT MAX(created_at) FROM posts p WHERE p.id = posts.id OR p.base_id = posts.id) < datetime('now', ?);`,
+		cutoff, cutoff)
+	if err != nil {
+		log.Printf("Error archiving inactive threads: %v\n", err.Error())
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Println("Archived", n, "inactive threads")
+	}
+}
+
+// SetRole gives a user a role, like "moderator", and tells if the user exists
+func SetRole(username, role string) (bool, error) {
+	res, err := DB.Exec(`UPDATE users SET role = ? WHERE username = ?;`, role, username)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// queryRower is a database or a transaction
+type queryRower interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// UniqueSlug makes a slug for a category name that no other category has, adding a number when needed
+func UniqueSlug(q queryRower, name string) (string, error) {
+	base := category.Slug(name)
+	slug := base
+	for n := 2; ; n++ {
+		var taken bool
+		if err := q.QueryRow(`SELECT EXISTS(SELECT 1 FROM categories WHERE slug = ?);`, slug).Scan(&taken); err != nil {
+			return "", err
+		}
+		if !taken {
+			return slug, nil
+		}
+		slug = fmt.Sprintf("%s-%d", base, n)
+	}
+}
+
+// queryExecer is a database or a transaction that can also make changes
+type queryExecer interface {
+	queryRower
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// MergeCategory moves the threads, subscriptions, subcategories and aliases of category from to category to,
+// and deletes it. Its name becomes an alias of the other. It returns sql.ErrNoRows when from doesn't exist.
+func MergeCategory(q queryExecer, from, to int) error {
+	var fromName string
+	var fromParent sql.NullInt64
+	if err := q.QueryRow(`SELECT name, parent_id FROM categories WHERE id = ?;`, from).Scan(&fromName, &fromParent); err != nil {
+		return err
+	}
+	queries := []struct {
+		query string
+		args  []any
+	}{
+		// Posts in both categories already have a row for the target, which is UNIQUE per post
+		{`INSERT OR IGNORE INTO posts_categories (post_id, category_id) SELECT post_id, ? FROM posts_categories WHERE category_id = ?;`, []any{to, from}},
+		{`DELETE FROM posts_categories WHERE category_id = ?;`, []any{from}},
+		{`UPDATE OR IGNORE subscriptions SET target_id = ? WHERE target_type = 'category' AND target_id = ?;`, []any{to, from}},
+		{`DELETE FROM subscriptions WHERE target_type = 'category' AND target_id = ?;`, []any{from}},
+		// A target anywhere under the merged category takes its place in the tree, so that the subcategories
+		// moved under it can't loop back to it
+		{`UPDATE categories SET parent_id = ? WHERE id = ? AND id IN (
+		      WITH RECURSIVE tree(id) AS (SELECT ? UNION SELECT c.id FROM categories c JOIN tree ON c.parent_id = tree.id)
+		      SELECT id FROM tree
+		  );`, []any{fromParent, to, from}},
+		{`UPDATE categories SET parent_id = ? WHERE parent_id = ?;`, []any{to, from}},
+		{`UPDATE category_aliases SET category_id = ? WHERE category_id = ?;`, []any{to, from}},
+		{`DELETE FROM categories WHERE id = ?;`, []any{from}},
+		{`INSERT OR IGNORE INTO category_aliases (alias, category_id) VALUES (?, ?);`, []any{fromName, to}},
+		{`UPDATE categories SET curated = 1 WHERE id = ?;`, []any{to}},
+	}
+	for _, step := range queries {
+		if _, err := q.Exec(step.query, step.args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Hot scores grow by one for every hotPeriod seconds a thread is newer than hotEpoch, and by about one
+// for every tenfold of its net likes. Newer threads rise without the scores of old ones having to decay.
+const (
+	hotEpoch  = 1704067200 // 2024-01-01
+	hotPeriod = 45000      // 12.5 hours
+)
+
+// UpdateHotScore recomputes the score of the hot order for a thread from its net likes and age.
+// Time doesn't change the score, so it is stored and only updated when the reactions change.
+// Replies have no score, and the call does nothing for them.
+func UpdateHotScore(q queryExecer, postID int) error {
+	var net int
+	var created time.Time
+	err := q.QueryRow(`SELECT COALESCE(SUM(CASE pr.reaction_type WHEN 'like' THEN 1 WHEN 'dislike' THEN -1 ELSE 0 END), 0), p.created_at
+					   FROM posts p LEFT JOIN post_reactions pr ON pr.post_id = p.id
+					   WHERE p.id = ? AND p.title != '' GROUP BY p.id;`, postID).Scan(&net, &created)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	likes := math.Log10(math.Abs(float64(net)) + 1)
+	if net < 0 {
+		likes = -likes
+	}
+	score := likes + float64(created.Unix()-hotEpoch)/hotPeriod
+	_, err = q.Exec(`UPDATE posts SET hot = ? WHERE id = ?;`, score, postID)
+	return err
+}
+
+// AddReactionScore changes the reputation of a post's author when someone else changes their reaction on it
+func AddReactionScore(q queryExecer, postID int, reactorID string, points int) error {
+	if points == 0 {
+		return nil
+	}
+	_, err := q.Exec(`UPDATE users SET reaction_score = reaction_score + ?
+					  WHERE id = (SELECT authorID FROM posts WHERE id = ?) AND id != ?;`, points, postID, reactorID)
+	return err
+}
+
+// ReconcileImages finds image files without rows and image rows without files or posts, held ones counting as posts,
+// and removes them unless dryRun is set
+func ReconcileImages(dir string, dryRun bool) (ImageReport, error) {
+	var report ImageReport
+
+	rows, err := DB.Query(`SELECT images.id, posts.id IS NULL AND held_posts.id IS NULL FROM images
+						   LEFT JOIN posts ON posts.id = images.post_id
+						   LEFT JOIN held_posts ON held_posts.id = images.held_id;`)
+	if err != nil {
+		return report, err
+	}
+	known := make(map[string]bool)
+	for rows.Next() {
+		var id string
+		var noPost bool
+		if err := rows.Scan(&id, &noPost); err != nil {
+			rows.Close()
+			return report, err
+		}
+		known[id] = true
+		info, err := os.Stat(filepath.Join(dir, id))
+		if noPost || os.IsNotExist(err) {
+			report.DanglingRows = append(report.DanglingRows, id)
+		}
+		if noPost && err == nil { // File of a row without a post is orphaned too
+			report.OrphanFiles = append(report.OrphanFiles, id)
+			report.Reclaimed += info.Size()
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return report, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return report, err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || known[name] || !isImageFile(name) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < imageGracePeriod {
+			continue // Upload may still be in progress
+		}
+		report.OrphanFiles = append(report.OrphanFiles, name)
+		report.Reclaimed += info.Size()
+	}
+
+	if dryRun {
+		return report, nil
+	}
+
+	for _, id := range report.DanglingRows {
+		if _, err := DB.Exec(`DELETE FROM images WHERE id = ?;`, id); err != nil {
+			return report, err
+		}
+	}
+	for _, name := range report.OrphanFiles {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// RemoveOrphanedImages reconciles the image directory with the images table, runs with dataCleanup()
+func RemoveOrphanedImages(dryRun bool) {
+	report, err := ReconcileImages(ImageDir, dryRun)
+	if err != nil {
+		log.Printf("Error reconciling images: %v\n", err.Error())
+		return
+	}
+	verb := "Removed"
+	if dryRun {
+		verb = "Would remove"
+	}
+	log.Printf("%s %d orphan image files (%d bytes) and %d dangling image rows\n",
+		verb, len(report.OrphanFiles), report.Reclaimed, len(report.DanglingRows))
+}
+
+// isImageFile tells uploaded images apart from other files in the image directory
+func isImageFile(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".jpg", ".jpeg", ".png", ".gif", ".bmp", ".webp", ".svg":
+		return true
+	}
+	return false
 }
 
 // dataCleanup removes expired sessions or unused categories every given time interval
@@ -50,3 +321,15 @@ func DataCleanup(interval time.Duration, f func(), name string) {
 		}
 	}()
 }
+
+// QuietCleanup runs f every given time interval like DataCleanup, without logging each run. It is for jobs that
+// run often and log themselves when they do something.
+func QuietCleanup(interval time.Duration, f func()) {
+	ticker := time.NewTicker(interval)
+	f() // run at the start
+	go func() {
+		for range ticker.C {
+			f()
+		}
+	}()
+}
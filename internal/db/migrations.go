@@ -0,0 +1,384 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"forum/internal/category"
+	"forum/internal/reaction"
+	"html"
+)
+
+// migration is a one-time change to existing data, recorded by name when done
+type migration struct {
+	name string
+	run  func(tx *sql.Tx) error
+}
+
+// migrations run in this order, new ones go to the end
+var migrations = []migration{
+	{"unescape-posts", unescapePosts},
+	{"user-preferences", addUserPreferences},
+	{"notification-settings", addNotificationSettings},
+	{"digest-settings", addDigestSettings},
+	{"thread-states", addThreadStates},
+	{"category-details", addCategoryDetails},
+	{"normalise-categories", normaliseCategories},
+	{"thread-sort", addThreadSort},
+	{"extended-reactions", extendReactions},
+	{"reputation", addReputation},
+	{"held-images", addHeldImages},
+	{"thread-schedule", addThreadSchedule},
+	{"held-post-keys", addHeldPostKeys},
+}
+
+// runMigrations applies each migration that hasn't been applied to this database yet
+func runMigrations() {
+	createMigrationsTableQuery := `
+	CREATE TABLE IF NOT EXISTS migrations (
+		name TEXT PRIMARY KEY,
+		applied_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);`
+	if _, err := DB.Exec(createMigrationsTableQuery); err != nil {
+		fmt.Println("Error creating migrations table:", err)
+		return
+	}
+
+	for _, m := range migrations {
+		var done bool
+		err := DB.QueryRow(`SELECT EXISTS(SELECT 1 FROM migrations WHERE name = ?);`, m.name).Scan(&done)
+		if err != nil {
+			fmt.Println("Error checking migration", m.name+":", err)
+			return
+		}
+		if done {
+			continue
+		}
+
+		tx, err := DB.Begin()
+		if err != nil {
+			fmt.Println("Error starting migration", m.name+":", err)
+			return
+		}
+		if err = m.run(tx); err == nil {
+			_, err = tx.Exec(`INSERT INTO migrations (name) VALUES (?);`, m.name)
+		}
+		if err != nil {
+			tx.Rollback()
+			fmt.Println("Error running migration", m.name+":", err)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			fmt.Println("Error committing migration", m.name+":", err)
+			return
+		}
+		fmt.Println("Applied migration", m.name)
+	}
+}
+
+// unescapePosts turns titles and content stored HTML-escaped back into their source text,
+// now that posts are escaped by the templates and rendered as Markdown
+func unescapePosts(tx *sql.Tx) error {
+	rows, err := tx.Query(`SELECT id, title, content FROM posts;`)
+	if err != nil {
+		return err
+	}
+	type post struct {
+		id             int
+		title, content string
+	}
+	var posts []post
+	for rows.Next() {
+		var p post
+		if err := rows.Scan(&p.id, &p.title, &p.content); err != nil {
+			rows.Close()
+			return err
+		}
+		posts = append(posts, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, p := range posts {
+		title, content := html.UnescapeString(p.title), html.UnescapeString(p.content)
+		if title == p.title && content == p.content {
+			continue
+		}
+		if _, err := tx.Exec(`UPDATE posts SET title = ?, content = ? WHERE id = ?;`, title, content, p.id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addColumn adds a column to a table unless a table made by a newer MakeTables already has it
+func addColumn(tx *sql.Tx, table, column, definition string) error {
+	var exists bool
+	err := tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM pragma_table_info(?) WHERE name = ?);`, table, column).Scan(&exists)
+	if err != nil || exists {
+		return err
+	}
+	_, err = tx.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s;`, table, column, definition))
+	return err
+}
+
+// addUserPreferences adds language, time zone and date format settings to users
+func addUserPreferences(tx *sql.Tx) error {
+	if err := addColumn(tx, "users", "language", "TEXT DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumn(tx, "users", "timezone", "TEXT DEFAULT 'Europe/Helsinki'"); err != nil {
+		return err
+	}
+	return addColumn(tx, "users", "date_format", "TEXT DEFAULT '2.1.2006'")
+}
+
+// addNotificationSettings lets users choose which events notify them, all on by default
+func addNotificationSettings(tx *sql.Tx) error {
+	for _, column := range []string{"notify_replies", "notify_reactions", "notify_mentions"} {
+		if err := addColumn(tx, "users", column, "INTEGER DEFAULT 1"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addDigestSettings adds the email digest choice of users, off by default
+func addDigestSettings(tx *sql.Tx) error {
+	if err := addColumn(tx, "users", "digest", "TEXT DEFAULT 'off'"); err != nil {
+		return err
+	}
+	if err := addColumn(tx, "users", "digest_sent_at", "DATETIME"); err != nil {
+		return err
+	}
+	return addColumn(tx, "users", "digest_token", "TEXT")
+}
+
+// addThreadStates adds pinned, locked and archived flags to posts, and roles to users so that moderators can set them
+func addThreadStates(tx *sql.Tx) error {
+	for _, column := range []string{"pinned", "locked", "archived"} {
+		if err := addColumn(tx, "posts", column, "INTEGER DEFAULT 0"); err != nil {
+			return err
+		}
+	}
+	if err := addColumn(tx, "posts", "reopened_at", "DATETIME"); err != nil {
+		return err
+	}
+	return addColumn(tx, "users", "role", "TEXT DEFAULT 'user'")
+}
+
+// addCategoryDetails adds slugs, descriptions, colours and parents to categories, and gives the existing ones slugs
+func addCategoryDetails(tx *sql.Tx) error {
+	columns := [][2]string{
+		{"slug", "TEXT"},
+		{"description", "TEXT DEFAULT ''"},
+		{"colour", "TEXT DEFAULT ''"},
+		{"parent_id", "INTEGER REFERENCES categories(id) ON DELETE SET NULL"},
+		{"curated", "INTEGER DEFAULT 0"},
+	}
+	for _, c := range columns {
+		if err := addColumn(tx, "categories", c[0], c[1]); err != nil {
+			return err
+		}
+	}
+
+	rows, err := tx.Query(`SELECT id, name FROM categories WHERE slug IS NULL ORDER BY id;`)
+	if err != nil {
+		return err
+	}
+	names := make(map[int]string)
+	var ids []int
+	for rows.Next() {
+		var id int
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			rows.Close()
+			return err
+		}
+		ids, names[id] = append(ids, id), name
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		slug, err := UniqueSlug(tx, names[id])
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`UPDATE categories SET slug = ? WHERE id = ?;`, slug, id); err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS categories_slug ON categories(slug);`)
+	return err
+}
+
+// normaliseCategories puts existing category names and aliases in the normalised form new ones are stored in.
+// A category whose normalised name is taken is merged into the category that has it.
+func normaliseCategories(tx *sql.Tx) error {
+	rows, err := tx.Query(`SELECT id, name FROM categories;`)
+	if err != nil {
+		return err
+	}
+	names := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			rows.Close()
+			return err
+		}
+		names[id] = name
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for id, name := range names {
+		normalised := category.Normalize(name)
+		if normalised == name {
+			continue
+		}
+		var existing int
+		err := tx.QueryRow(`SELECT id FROM categories WHERE name = ?;`, normalised).Scan(&existing)
+		if err == sql.ErrNoRows {
+			_, err = tx.Exec(`UPDATE categories SET name = ? WHERE id = ?;`, normalised, id)
+		} else if err == nil {
+			err = MergeCategory(tx, id, existing)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	aliases, err := tx.Query(`SELECT alias FROM category_aliases;`)
+	if err != nil {
+		return err
+	}
+	var list []string
+	for aliases.Next() {
+		var alias string
+		if err := aliases.Scan(&alias); err != nil {
+			aliases.Close()
+			return err
+		}
+		list = append(list, alias)
+	}
+	aliases.Close()
+	for _, alias := range list {
+		if _, err := tx.Exec(`UPDATE OR IGNORE category_aliases SET alias = ? WHERE alias = ?;`, category.Normalize(alias), alias); err != nil {
+			return err
+		}
+	}
+	return aliases.Err()
+}
+
+// addThreadSort adds the remembered thread order of users and the hot scores of threads,
+// and indexes replies by thread for the orders that look at them
+func addThreadSort(tx *sql.Tx) error {
+	if err := addColumn(tx, "users", "thread_sort", "TEXT DEFAULT 'activity'"); err != nil {
+		return err
+	}
+	if err := addColumn(tx, "posts", "hot", "REAL DEFAULT 0"); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`CREATE INDEX IF NOT EXISTS posts_base_id ON posts(base_id);`); err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(`SELECT id FROM posts WHERE title != '';`)
+	if err != nil {
+		return err
+	}
+	var threads []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		threads = append(threads, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, id := range threads {
+		if err := UpdateHotScore(tx, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extendReactions lets a user give a post several emoji reactions. The table is rebuilt, as SQLite can't change
+// its unique constraint, and a partial index keeps like and dislike exclusive like the old constraint did.
+func extendReactions(tx *sql.Tx) error {
+	queries := []string{
+		`CREATE TABLE post_reactions_new (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id TEXT,
+			post_id INTEGER NOT NULL,
+			reaction_type TEXT NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (post_id) REFERENCES posts(id) ON DELETE CASCADE,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE SET NULL,
+			UNIQUE (user_id, post_id, reaction_type)
+		);`,
+		`INSERT INTO post_reactions_new (id, user_id, post_id, reaction_type, created_at)
+		 SELECT id, user_id, post_id, reaction_type, created_at FROM post_reactions;`,
+		`DROP TABLE post_reactions;`,
+		`ALTER TABLE post_reactions_new RENAME TO post_reactions;`,
+		`CREATE UNIQUE INDEX post_reactions_opinion ON post_reactions(user_id, post_id) WHERE reaction_type IN ('like', 'dislike');`,
+	}
+	for _, query := range queries {
+		if _, err := tx.Exec(query); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addReputation keeps a running total of the points users have got from reactions of others on their posts,
+// counted from the reactions given so far
+func addReputation(tx *sql.Tx) error {
+	if err := addColumn(tx, "users", "reaction_score", "INTEGER DEFAULT 0"); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`UPDATE users SET reaction_score = (
+						   SELECT COALESCE(SUM(CASE r.reaction_type WHEN 'like' THEN ? WHEN 'dislike' THEN ? ELSE 0 END), 0)
+						   FROM post_reactions r JOIN posts p ON p.id = r.post_id
+						   WHERE p.authorID = users.id AND (r.user_id IS NULL OR r.user_id != users.id));`,
+		reaction.Points(reaction.Like), reaction.Points(reaction.Dislike))
+	return err
+}
+
+// addHeldImages lets images belong to posts waiting in the moderation queue
+func addHeldImages(tx *sql.Tx) error {
+	return addColumn(tx, "images", "held_id", "INTEGER DEFAULT NULL")
+}
+
+// addThreadSchedule lets threads be published later and expire, also those waiting in the moderation queue
+func addThreadSchedule(tx *sql.Tx) error {
+	for _, table := range []string{"posts", "held_posts"} {
+		if err := addColumn(tx, table, "publish_at", "DATETIME"); err != nil {
+			return err
+		}
+		if err := addColumn(tx, table, "expires_at", "DATETIME"); err != nil {
+			return err
+		}
+		if err := addColumn(tx, table, "expire_action", "TEXT DEFAULT 'archive'"); err != nil {
+			return err
+		}
+	}
+	return addColumn(tx, "posts", "hidden", "INTEGER DEFAULT 0")
+}
+
+// addHeldPostKeys lets the key of a form remember the post it put in the moderation queue
+func addHeldPostKeys(tx *sql.Tx) error {
+	return addColumn(tx, "post_keys", "held_id", "INTEGER DEFAULT 0")
+}
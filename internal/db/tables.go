@@ -17,6 +17,15 @@ func MakeTables() {
 			content TEXT NOT NULL,
 			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
 			parent_id INTEGER DEFAULT 0,
+			pinned INTEGER DEFAULT 0,    -- Thread states: pinned threads are listed first,
+			locked INTEGER DEFAULT 0,    -- locked ones take no replies or reactions,
+			archived INTEGER DEFAULT 0,  -- and archived ones are read-only after a long quiet
+			reopened_at DATETIME,        -- Unarchived by a moderator, starts the quiet period over
+			hot REAL DEFAULT 0,          -- Score of the hot order, see UpdateHotScore
+			publish_at DATETIME,         -- Scheduled threads are published then, NULL once they are
+			expires_at DATETIME,         -- After which the thread is hidden or archived, NULL once it is
+			expire_action TEXT DEFAULT 'archive',  -- Or 'hide'
+			hidden INTEGER DEFAULT 0,    -- Expired out of sight, only the author and moderators see it
 			FOREIGN KEY (authorID) REFERENCES users(id) ON DELETE SET NULL
 		);`
 	if _, err := DB.Exec(createPostsTableQuery); err != nil {
@@ -31,7 +40,19 @@ func MakeTables() {
 		email TEXT UNIQUE NOT NULL,
 		username TEXT UNIQUE NOT NULL,
 		password TEXT NOT NULL,  -- Hashed passwords
-		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		language TEXT DEFAULT '',  -- Empty to follow the browser
+		timezone TEXT DEFAULT 'Europe/Helsinki',
+		date_format TEXT DEFAULT '2.1.2006',  -- Go time layout
+		notify_replies INTEGER DEFAULT 1,  -- Which events notify the user
+		notify_reactions INTEGER DEFAULT 1,
+		notify_mentions INTEGER DEFAULT 1,
+		digest TEXT DEFAULT 'off',  -- 'off', 'daily' or 'weekly' email of subscribed activity
+		digest_sent_at DATETIME,    -- Activity after this goes to the next digest
+		digest_token TEXT,          -- Turns the digest off from a link in the email
+		role TEXT DEFAULT 'user',   -- 'user', 'moderator' or 'admin'
+		thread_sort TEXT DEFAULT 'activity',  -- Order of thread lists the user picked last
+		reaction_score INTEGER DEFAULT 0      -- Reputation from reactions of others, see AddReactionScore
 	);`
 	if _, err := DB.Exec(createUsersTableQuery); err != nil {
 		fmt.Println("Error creating users table:", err)
@@ -59,11 +80,11 @@ func MakeTables() {
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		user_id TEXT,          -- User who reacted
 		post_id INTEGER NOT NULL,          -- ID of the thread or reply
-		reaction_type TEXT NOT NULL,       -- 'like' or 'dislike'
+		reaction_type TEXT NOT NULL,       -- 'like', 'dislike' or an emoji reaction like 'heart'
 		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
 		FOREIGN KEY (post_id) REFERENCES posts(id) ON DELETE CASCADE,
 		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE SET NULL,
-		UNIQUE (user_id, post_id)  -- Prevents duplicate reactions for the same post type (no simultaneous like and dislike)
+		UNIQUE (user_id, post_id, reaction_type)  -- Each reaction once, and index post_reactions_opinion allows like or dislike, not both
 	);`
 	if _, err := DB.Exec(createReactionsTableQuery); err != nil {
 		fmt.Println("Error creating reactions table:", err)
@@ -76,6 +97,12 @@ func MakeTables() {
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		name TEXT NOT NULL,
 		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		slug TEXT,                 -- Name in the URL of the category page
+		description TEXT DEFAULT '',
+		colour TEXT DEFAULT '',    -- Like '#1a2b3c', empty for the default
+		parent_id INTEGER,         -- Parent category, NULL for top level
+		curated INTEGER DEFAULT 0, -- Made or edited by an admin, kept even when unused
+		FOREIGN KEY (parent_id) REFERENCES categories(id) ON DELETE SET NULL,
 		UNIQUE (name)  -- Prevents duplicate categories
 	);`
 	if _, err := DB.Exec(createCategoriesTableQuery); err != nil {
@@ -108,6 +135,7 @@ CREATE TABLE IF NOT EXISTS images (
 	original_name TEXT,
 	file_size INT,
 	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	held_id INTEGER DEFAULT NULL,  -- Image of a post waiting in the moderation queue
 	FOREIGN KEY (post_id) REFERENCES posts(id) ON DELETE CASCADE,
 	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE SET NULL
 );`
@@ -116,4 +144,222 @@ CREATE TABLE IF NOT EXISTS images (
 		return
 	}
 
+	// Create notifications table if it doesn't exist
+	createNotificationsTableQuery := `
+	CREATE TABLE IF NOT EXISTS notifications (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id TEXT NOT NULL,        -- User who is notified
+		actor TEXT NOT NULL,          -- Username of who replied, reacted or mentioned
+		type TEXT NOT NULL,           -- 'reply', 'reaction' or 'mention'
+		post_id INTEGER NOT NULL,     -- The reply, the post reacted to or the post with the mention
+		thread_id INTEGER NOT NULL,
+		is_read INTEGER DEFAULT 0,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+		FOREIGN KEY (post_id) REFERENCES posts(id) ON DELETE CASCADE
+	);`
+	if _, err := DB.Exec(createNotificationsTableQuery); err != nil {
+		fmt.Println("Error creating notifications table:", err)
+		return
+	}
+
+	// Create mentions table if it doesn't exist
+	createMentionsTableQuery := `
+	CREATE TABLE IF NOT EXISTS mentions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		post_id INTEGER NOT NULL,  -- Post with the @mention
+		user_id TEXT NOT NULL,     -- User mentioned
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (post_id) REFERENCES posts(id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+		UNIQUE (post_id, user_id)
+	);`
+	if _, err := DB.Exec(createMentionsTableQuery); err != nil {
+		fmt.Println("Error creating mentions table:", err)
+		return
+	}
+
+	// Create subscriptions table if it doesn't exist
+	createSubscriptionsTableQuery := `
+	CREATE TABLE IF NOT EXISTS subscriptions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id TEXT NOT NULL,
+		target_type TEXT NOT NULL,     -- 'thread' or 'category'
+		target_id INTEGER NOT NULL,    -- ID of the thread or the category
+		token TEXT UNIQUE NOT NULL,    -- Unsubscribes without logging in, from a digest email
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+		UNIQUE (user_id, target_type, target_id)
+	);`
+	if _, err := DB.Exec(createSubscriptionsTableQuery); err != nil {
+		fmt.Println("Error creating subscriptions table:", err)
+		return
+	}
+
+	// Create category aliases table if it doesn't exist
+	createAliasesTableQuery := `
+	CREATE TABLE IF NOT EXISTS category_aliases (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		alias TEXT NOT NULL,           -- Another name that means the category
+		category_id INTEGER NOT NULL,  -- The canonical category
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (category_id) REFERENCES categories(id) ON DELETE CASCADE,
+		UNIQUE (alias)
+	);`
+	if _, err := DB.Exec(createAliasesTableQuery); err != nil {
+		fmt.Println("Error creating category aliases table:", err)
+		return
+	}
+
+	// Create tables for private conversations if they don't exist
+	createConversationsTableQuery := `
+	CREATE TABLE IF NOT EXISTS conversations (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		subject TEXT NOT NULL,
+		created_by TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (created_by) REFERENCES users(id) ON DELETE SET NULL
+	);`
+	if _, err := DB.Exec(createConversationsTableQuery); err != nil {
+		fmt.Println("Error creating conversations table:", err)
+		return
+	}
+
+	createMembersTableQuery := `
+	CREATE TABLE IF NOT EXISTS conversation_members (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		conversation_id INTEGER NOT NULL,
+		user_id TEXT NOT NULL,
+		last_read_id INTEGER DEFAULT 0,  -- Newest message the member has seen
+		FOREIGN KEY (conversation_id) REFERENCES conversations(id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+		UNIQUE (conversation_id, user_id)
+	);`
+	if _, err := DB.Exec(createMembersTableQuery); err != nil {
+		fmt.Println("Error creating conversation members table:", err)
+		return
+	}
+
+	createMessagesTableQuery := `
+	CREATE TABLE IF NOT EXISTS messages (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		conversation_id INTEGER NOT NULL,
+		sender_id TEXT,
+		content TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (conversation_id) REFERENCES conversations(id) ON DELETE CASCADE,
+		FOREIGN KEY (sender_id) REFERENCES users(id) ON DELETE SET NULL
+	);`
+	if _, err := DB.Exec(createMessagesTableQuery); err != nil {
+		fmt.Println("Error creating messages table:", err)
+		return
+	}
+
+	createBlocksTableQuery := `
+	CREATE TABLE IF NOT EXISTS blocks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		blocker_id TEXT NOT NULL,  -- User who doesn't want messages
+		blocked_id TEXT NOT NULL,  -- from this user
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (blocker_id) REFERENCES users(id) ON DELETE CASCADE,
+		FOREIGN KEY (blocked_id) REFERENCES users(id) ON DELETE CASCADE,
+		UNIQUE (blocker_id, blocked_id)
+	);`
+	if _, err := DB.Exec(createBlocksTableQuery); err != nil {
+		fmt.Println("Error creating blocks table:", err)
+		return
+	}
+
+	// Create reports table if it doesn't exist
+	createReportsTableQuery := `
+	CREATE TABLE IF NOT EXISTS reports (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		reporter_id TEXT,
+		target_type TEXT NOT NULL,  -- What was reported, like 'message'
+		target_id INTEGER NOT NULL,
+		author_id TEXT,             -- Who wrote the reported content
+		content TEXT NOT NULL,      -- Copy of the content, it may be private or change later
+		reason TEXT DEFAULT '',
+		status TEXT DEFAULT 'open', -- 'open' or 'resolved'
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (reporter_id) REFERENCES users(id) ON DELETE SET NULL
+	);`
+	if _, err := DB.Exec(createReportsTableQuery); err != nil {
+		fmt.Println("Error creating reports table:", err)
+		return
+	}
+
+	// Keys of the forms that made posts, so that a form sent twice makes one post
+	createPostKeysTableQuery := `
+	CREATE TABLE IF NOT EXISTS post_keys (
+		user_id TEXT NOT NULL,
+		form_key TEXT NOT NULL,
+		post_id INTEGER DEFAULT 0,  -- Post the form made, 0 while it is being made
+		held_id INTEGER DEFAULT 0,  -- Post the form put in the moderation queue instead
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (user_id, form_key),
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);`
+	if _, err := DB.Exec(createPostKeysTableQuery); err != nil {
+		fmt.Println("Error creating post keys table:", err)
+		return
+	}
+
+	// Posts a filter held, waiting for a moderator to publish or remove them
+	createHeldPostsTableQuery := `
+	CREATE TABLE IF NOT EXISTS held_posts (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		base_id INTEGER DEFAULT 0,    -- Thread of a reply, 0 for a new thread
+		parent_id INTEGER DEFAULT 0,
+		author TEXT NOT NULL,
+		authorID TEXT,
+		title TEXT DEFAULT '',
+		content TEXT NOT NULL,
+		categories TEXT DEFAULT '',   -- Category field of a new thread
+		publish_at DATETIME,          -- Schedule of a new thread, see posts
+		expires_at DATETIME,
+		expire_action TEXT DEFAULT 'archive',
+		filter TEXT NOT NULL,         -- Filter that held the post
+		reason TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (authorID) REFERENCES users(id) ON DELETE CASCADE
+	);`
+	if _, err := DB.Exec(createHeldPostsTableQuery); err != nil {
+		fmt.Println("Error creating held posts table:", err)
+		return
+	}
+
+	// Words of the posts moderators approved (ham) and removed (spam), for the spam classifier
+	createSpamTokensTableQuery := `
+	CREATE TABLE IF NOT EXISTS spam_tokens (
+		token TEXT PRIMARY KEY,  -- The empty token counts the posts themselves
+		spam INTEGER DEFAULT 0,
+		ham INTEGER DEFAULT 0
+	);`
+	if _, err := DB.Exec(createSpamTokensTableQuery); err != nil {
+		fmt.Println("Error creating spam tokens table:", err)
+		return
+	}
+
+	// Unsent new threads and replies, saved while writing and kept when a session expires
+	createDraftsTableQuery := `
+	CREATE TABLE IF NOT EXISTS drafts (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id TEXT,              -- NULL while kept for a browser whose session expired
+		token TEXT UNIQUE,         -- Cookie of that browser
+		target TEXT NOT NULL,      -- "thread", or "reply-" and the ID of the post replied to
+		thread_id INTEGER DEFAULT 0,
+		title TEXT DEFAULT '',
+		categories TEXT DEFAULT '',
+		content TEXT DEFAULT '',
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (user_id, target),
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);`
+	if _, err := DB.Exec(createDraftsTableQuery); err != nil {
+		fmt.Println("Error creating drafts table:", err)
+		return
+	}
+
+	runMigrations()
 }
@@ -0,0 +1,241 @@
+package digest
+
+import (
+	"fmt"
+	"forum/internal/db"
+	"forum/internal/i18n"
+	"forum/internal/mail"
+	"log"
+	"strings"
+
+	"github.com/gofrs/uuid"
+)
+
+// How often users can get a digest
+const (
+	Off    = "off"
+	Daily  = "daily"
+	Weekly = "weekly"
+)
+
+// Frequencies lists the choices in the order they are offered
+var Frequencies = []string{Off, Daily, Weekly}
+
+// periods are SQLite date modifiers for how far back a digest looks
+var periods = map[string]string{
+	Daily:  "-1 day",
+	Weekly: "-7 days",
+}
+
+type recipient struct {
+	id, name, email, lang, frequency string
+	since                            string // Activity after this goes to the digest
+	token                            string
+}
+
+type threadActivity struct {
+	id      int
+	title   string
+	replies int
+	token   string
+}
+
+type categoryActivity struct {
+	name    string
+	token   string
+	threads []newThread
+}
+
+type newThread struct {
+	id    int
+	title string
+}
+
+// ValidFrequency tells if f is one of the digest choices
+func ValidFrequency(f string) bool {
+	for _, frequency := range Frequencies {
+		if f == frequency {
+			return true
+		}
+	}
+	return false
+}
+
+// Send mails each user whose daily or weekly digest is due the new activity in what they follow,
+// and returns how many digests were sent. Links in the mail start with siteURL.
+func Send(mailer mail.Mailer, siteURL string) (int, error) {
+	var cutoff string
+	if err := db.DB.QueryRow(`SELECT CURRENT_TIMESTAMP;`).Scan(&cutoff); err != nil {
+		return 0, err
+	}
+
+	recipients, err := dueRecipients()
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, r := range recipients {
+		threads, err := threadActivities(r, cutoff)
+		if err != nil {
+			return sent, err
+		}
+		categories, err := categoryActivities(r, cutoff)
+		if err != nil {
+			return sent, err
+		}
+
+		if len(threads) > 0 || len(categories) > 0 {
+			if r.token == "" {
+				if r.token, err = newDigestToken(r.id); err != nil {
+					return sent, err
+				}
+			}
+			if err := mailer.Send(compose(r, threads, categories, siteURL)); err != nil {
+				log.Println("Sending digest to", r.name, "failed:", err)
+				continue // Tried again next round
+			}
+			sent++
+		}
+
+		// Quiet periods count as sent too, so the next digest doesn't reach back further
+		if _, err := db.DB.Exec(`UPDATE users SET digest_sent_at = ? WHERE id = ?;`, cutoff, r.id); err != nil {
+			return sent, err
+		}
+	}
+	return sent, nil
+}
+
+// dueRecipients finds the users whose digest period has passed
+func dueRecipients() ([]recipient, error) {
+	rows, err := db.DB.Query(`SELECT id, username, email, language, digest, COALESCE(digest_token, ''),
+							  COALESCE(digest_sent_at, datetime('now', CASE digest WHEN 'daily' THEN ? ELSE ? END))
+							  FROM users
+							  WHERE (digest = 'daily' AND (digest_sent_at IS NULL OR digest_sent_at <= datetime('now', ?)))
+							  OR (digest = 'weekly' AND (digest_sent_at IS NULL OR digest_sent_at <= datetime('now', ?)));`,
+		periods[Daily], periods[Weekly], periods[Daily], periods[Weekly])
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var recipients []recipient
+	for rows.Next() {
+		var r recipient
+		if err := rows.Scan(&r.id, &r.name, &r.email, &r.lang, &r.frequency, &r.token, &r.since); err != nil {
+			return nil, err
+		}
+		r.lang = i18n.Negotiate(r.lang, "")
+		recipients = append(recipients, r)
+	}
+	return recipients, rows.Err()
+}
+
+// threadActivities counts new replies by others in the threads a user follows
+func threadActivities(r recipient, cutoff string) ([]threadActivity, error) {
+	rows, err := db.DB.Query(`SELECT t.id, t.title, COUNT(p.id), s.token
+							  FROM subscriptions s
+							  JOIN posts t ON t.id = s.target_id
+							  JOIN posts p ON p.base_id = t.id
+							  WHERE s.user_id = ? AND s.target_type = 'thread'
+							  AND p.created_at > ? AND p.created_at <= ? AND COALESCE(p.authorID, '') != ?
+							  GROUP BY t.id ORDER BY t.title;`, r.id, r.since, cutoff, r.id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var threads []threadActivity
+	for rows.Next() {
+		var t threadActivity
+		if err := rows.Scan(&t.id, &t.title, &t.replies, &t.token); err != nil {
+			return nil, err
+		}
+		threads = append(threads, t)
+	}
+	return threads, rows.Err()
+}
+
+// categoryActivities finds new threads by others in the categories a user follows
+func categoryActivities(r recipient, cutoff string) ([]categoryActivity, error) {
+	rows, err := db.DB.Query(`SELECT c.name, s.token, p.id, p.title
+							  FROM subscriptions s
+							  JOIN categories c ON c.id = s.target_id
+							  JOIN posts_categories pc ON pc.category_id = c.id
+							  JOIN posts p ON p.id = pc.post_id
+							  WHERE s.user_id = ? AND s.target_type = 'category' AND p.title != '' AND p.hidden = 0
+							  AND p.created_at > ? AND p.created_at <= ? AND COALESCE(p.authorID, '') != ?
+							  ORDER BY c.name, p.id;`, r.id, r.since, cutoff, r.id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var categories []categoryActivity
+	for rows.Next() {
+		var name, token string
+		var t newThread
+		if err := rows.Scan(&name, &token, &t.id, &t.title); err != nil {
+			return nil, err
+		}
+		if len(categories) == 0 || categories[len(categories)-1].name != name {
+			categories = append(categories, categoryActivity{name: name, token: token})
+		}
+		last := &categories[len(categories)-1]
+		last.threads = append(last.threads, t)
+	}
+	return categories, rows.Err()
+}
+
+// newDigestToken gives a user the token that turns their digest off
+func newDigestToken(userID string) (string, error) {
+	token, err := uuid.NewV4()
+	if err != nil {
+		return "", err
+	}
+	_, err = db.DB.Exec(`UPDATE users SET digest_token = ? WHERE id = ?;`, token.String(), userID)
+	return token.String(), err
+}
+
+// compose writes the digest email in the user's language
+func compose(r recipient, threads []threadActivity, categories []categoryActivity, siteURL string) mail.Message {
+	t := func(msg string, args ...any) string { return i18n.T(r.lang, msg, args...) }
+	unsubscribeURL := func(token string) string { return siteURL + "/unsubscribe?token=" + token }
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n\n", t("Hi %s,", r.name))
+
+	if len(threads) > 0 {
+		fmt.Fprintf(&b, "%s\n\n", t("New replies in threads you follow:"))
+		for _, th := range threads {
+			fmt.Fprintf(&b, "- %s (%s)\n  %s/thread/%d\n  %s %s\n", th.title, t("%d new", th.replies),
+				siteURL, th.id, t("Unsubscribe:"), unsubscribeURL(th.token))
+		}
+		b.WriteString("\n")
+	}
+
+	for _, c := range categories {
+		fmt.Fprintf(&b, "%s\n\n", t("New threads in %s:", c.name))
+		for _, th := range c.threads {
+			fmt.Fprintf(&b, "- %s\n  %s/thread/%d\n", th.title, siteURL, th.id)
+		}
+		fmt.Fprintf(&b, "%s %s\n\n", t("Unsubscribe:"), unsubscribeURL(c.token))
+	}
+
+	fmt.Fprintf(&b, "-- \n%s %s\n", t("Stop these emails:"), unsubscribeURL(r.token))
+
+	subject := t("Your daily digest")
+	if r.frequency == Weekly {
+		subject = t("Your weekly digest")
+	}
+	return mail.Message{
+		To:      r.email,
+		Subject: "grit:lab fika café: " + subject,
+		Body:    b.String(),
+		Headers: map[string]string{
+			// Lets mail clients offer one-click unsubscribing (RFC 8058)
+			"List-Unsubscribe":      "<" + unsubscribeURL(r.token) + ">",
+			"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+		},
+	}
+}
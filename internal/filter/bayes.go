@@ -0,0 +1,104 @@
+package filter
+
+import (
+	"fmt"
+	"forum/internal/db"
+	"math"
+	"strings"
+)
+
+// maxWords is how many words of a post the classifier looks at
+const maxWords = 200
+
+// postsToken counts the trained posts themselves in spam_tokens, words never being empty
+const postsToken = ""
+
+// Bayes holds posts that a naive Bayes classifier, trained with what moderators approved and removed,
+// finds likely spam. It lets everything through until it has seen MinTrained posts of both kinds.
+type Bayes struct {
+	Threshold  float64 // Spam probability from which posts are held
+	MinTrained int
+}
+
+func (b Bayes) Name() string { return "classifier" }
+
+func (b Bayes) Check(p Post) (Verdict, string) {
+	spamProb, err := SpamProbability(p.Text(), b.MinTrained)
+	if err != nil {
+		fmt.Println("Classifying post:", err.Error())
+		return Pass, ""
+	}
+	if spamProb >= b.Threshold {
+		return Hold, fmt.Sprintf("Looks like spam (%.0f%%)", spamProb*100)
+	}
+	return Pass, ""
+}
+
+// SpamProbability tells how likely text is spam, from the words of the posts moderators approved and removed.
+// It is 0 until at least minTrained posts of both kinds have been seen.
+func SpamProbability(text string, minTrained int) (float64, error) {
+	words := Words(text)
+	if len(words) > maxWords {
+		words = words[:maxWords]
+	}
+	tokens := append([]string{postsToken}, words...)
+	rows, err := db.DB.Query(`SELECT token, spam, ham FROM spam_tokens WHERE token IN (?`+
+		strings.Repeat(", ?", len(tokens)-1)+`);`, anySlice(tokens)...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	counts := make(map[string][2]float64)
+	for rows.Next() {
+		var token string
+		var spam, ham float64
+		if err := rows.Scan(&token, &spam, &ham); err != nil {
+			return 0, err
+		}
+		counts[token] = [2]float64{spam, ham}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	posts := counts[postsToken]
+	if least := float64(max(minTrained, 1)); posts[0] < least || posts[1] < least {
+		return 0, nil
+	}
+	// Log odds of spam, each word's share of posts smoothed so that unseen words count a little both ways
+	odds := math.Log(posts[0] / posts[1])
+	for _, word := range words {
+		c := counts[word]
+		odds += math.Log((c[0]+1)/(posts[0]+2)) - math.Log((c[1]+1)/(posts[1]+2))
+	}
+	return 1 / (1 + math.Exp(-odds)), nil
+}
+
+// Train counts the words of a post a moderator removed as spam or approved
+func Train(text string, spam bool) error {
+	column := "ham"
+	if spam {
+		column = "spam"
+	}
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, token := range append([]string{postsToken}, Words(text)...) {
+		_, err := tx.Exec(`INSERT INTO spam_tokens (token, `+column+`) VALUES (?, 1)
+						   ON CONFLICT (token) DO UPDATE SET `+column+` = `+column+` + 1;`, token)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func anySlice(values []string) []any {
+	args := make([]any, len(values))
+	for i, v := range values {
+		args[i] = v
+	}
+	return args
+}
@@ -0,0 +1,135 @@
+// Package filter checks new posts before they are published. The filters run in a chain, and the first one
+// that doesn't let a post through decides what happens to it: it is held for a moderator, or rejected.
+package filter
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Verdict is what a filter decides about a post
+type Verdict int
+
+const (
+	Pass   Verdict = iota // On to the next filter, and published after the last
+	Hold                  // Waits in the moderation queue
+	Reject                // Isn't posted, and the author is told why
+)
+
+// Post is a new thread or reply as the filters see it
+type Post struct {
+	AuthorID string
+	NewUser  bool   // The author's account is new, see the trust levels
+	Title    string // Empty for replies
+	Content  string // Markdown source
+}
+
+// Text is the title and content of a post together
+func (p Post) Text() string {
+	return p.Title + "\n" + p.Content
+}
+
+// Filter is one check of the chain. The reason is a message for the author of a rejected post,
+// or for the moderators of a held one.
+type Filter interface {
+	Name() string
+	Check(p Post) (Verdict, string)
+}
+
+// Result is the verdict of the chain, with the filter that gave it and why
+type Result struct {
+	Verdict Verdict
+	Filter  string
+	Reason  string
+}
+
+var (
+	chain   []Filter
+	chainMu sync.RWMutex
+)
+
+// Use sets the filters new posts go through, in order
+func Use(filters ...Filter) {
+	chainMu.Lock()
+	defer chainMu.Unlock()
+	chain = filters
+}
+
+// Check runs a post through the chain. A filter that holds or rejects it ends the chain.
+func Check(p Post) Result {
+	chainMu.RLock()
+	defer chainMu.RUnlock()
+	for _, f := range chain {
+		if verdict, reason := f.Check(p); verdict != Pass {
+			return Result{verdict, f.Name(), reason}
+		}
+	}
+	return Result{Verdict: Pass}
+}
+
+// Words splits text into lower case words of letters and digits, each once
+func Words(text string) []string {
+	var words []string
+	seen := make(map[string]bool)
+	for _, word := range strings.Fields(plain(text)) {
+		if !seen[word] {
+			seen[word] = true
+			words = append(words, word)
+		}
+	}
+	return words
+}
+
+// plain turns text into lower case words of letters and digits with single spaces between them
+func plain(text string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}), " ")
+}
+
+// Blocklist rejects posts with any of its words or phrases, whatever their case and punctuation
+type Blocklist struct {
+	phrases []string
+}
+
+// NewBlocklist makes a blocklist of comma separated words and phrases
+func NewBlocklist(list string) *Blocklist {
+	b := &Blocklist{}
+	for _, entry := range strings.Split(list, ",") {
+		if phrase := plain(entry); phrase != "" {
+			b.phrases = append(b.phrases, phrase)
+		}
+	}
+	return b
+}
+
+func (b *Blocklist) Name() string { return "blocklist" }
+
+func (b *Blocklist) Check(p Post) (Verdict, string) {
+	text := " " + plain(p.Text()) + " " // Spaces around every word, so that phrases match whole words only
+	for _, phrase := range b.phrases {
+		if strings.Contains(text, " "+phrase+" ") {
+			return Reject, "Your post has words that aren't allowed here"
+		}
+	}
+	return Pass, ""
+}
+
+var linkPattern = regexp.MustCompile(`(?i)\bhttps?://|\bwww\.`)
+
+// LinkLimit holds posts of new users with more than Max links for a moderator to look at
+type LinkLimit struct {
+	Max int
+}
+
+func (l LinkLimit) Name() string { return "links" }
+
+func (l LinkLimit) Check(p Post) (Verdict, string) {
+	if links := len(linkPattern.FindAllStringIndex(p.Text(), -1)); p.NewUser && links > l.Max {
+		return Hold, fmt.Sprintf("%d links from a new user", links)
+	}
+	return Pass, ""
+}
@@ -0,0 +1,544 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"forum/internal/category"
+	"forum/internal/db"
+	"forum/internal/i18n"
+	"forum/internal/templates"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ClosedCategories makes the categories a closed set: only admins create them, and new threads pick from the list
+var ClosedCategories bool
+
+var errUnknownCategory = errors.New("unknown category")
+
+// Category is a category with its details, as shown on its page and in the admin tools
+type Category struct {
+	ID          int
+	Name        string
+	Slug        string
+	Description string
+	Colour      string
+	ParentID    int
+	Parent      string   // Name of the parent category
+	Threads     int      // Threads directly in the category
+	Aliases     []string // Other names that mean this category
+}
+
+type categoryPageData struct {
+	ValidSes bool
+	UsrId    string
+	UsrNm    string
+	LoginURL string
+	Lang     string
+	headerCounts
+	Category   Category
+	Children   []Category
+	Threads    []Thread
+	Following  bool
+	Sort       string // Order of the threads
+	SortOrders []sortOrder
+	SortLink   string // Start of the links that change the order
+}
+
+type categoryAdminData struct {
+	ValidSes bool
+	UsrId    string
+	UsrNm    string
+	LoginURL string
+	Lang     string
+	headerCounts
+	Message           string
+	Categories        []Category
+	Closed            bool
+	NameMaxLen        int
+	DescriptionMaxLen int
+}
+
+// queryCategories lists the categories matching a condition, by name
+func queryCategories(condition string, args ...any) ([]Category, error) {
+	rows, err := db.DB.Query(`SELECT c.id, c.name, COALESCE(c.slug, ''), c.description, c.colour, COALESCE(c.parent_id, 0), COALESCE(p.name, ''),
+							  (SELECT COUNT(*) FROM posts_categories pc WHERE pc.category_id = c.id),
+							  COALESCE((SELECT GROUP_CONCAT(alias, ',') FROM category_aliases a WHERE a.category_id = c.id), '')
+							  FROM categories c LEFT JOIN categories p ON p.id = c.parent_id
+							  WHERE `+condition+` ORDER BY c.name;`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var categories []Category
+	for rows.Next() {
+		var c Category
+		var aliases string
+		if err := rows.Scan(&c.ID, &c.Name, &c.Slug, &c.Description, &c.Colour, &c.ParentID, &c.Parent, &c.Threads, &aliases); err != nil {
+			return nil, err
+		}
+		if aliases != "" {
+			c.Aliases = strings.Split(aliases, ",")
+		}
+		categories = append(categories, c)
+	}
+	return categories, rows.Err()
+}
+
+// canonicalCategories replaces aliases with the names of their categories
+func canonicalCategories(names []string) []string {
+	canonical := make([]string, len(names))
+	for i, name := range names {
+		err := db.DB.QueryRow(`SELECT c.name FROM category_aliases a JOIN categories c ON c.id = a.category_id
+							   WHERE a.alias = ?;`, name).Scan(&canonical[i])
+		if err != nil {
+			if err != sql.ErrNoRows {
+				fmt.Println("Looking up category alias:", err.Error())
+			}
+			canonical[i] = name
+		}
+	}
+	return canonical
+}
+
+// resolveCategories finds the IDs of categories by name or alias. Missing ones are created,
+// unless the categories are a closed set.
+func resolveCategories(names []string) ([]int64, error) {
+	var ids []int64
+	for _, name := range removeDuplicates(canonicalCategories(names)) {
+		var id int64
+		err := db.DB.QueryRow(`SELECT id FROM categories WHERE name = ?;`, name).Scan(&id)
+		if err == sql.ErrNoRows {
+			if ClosedCategories {
+				return nil, errUnknownCategory
+			}
+			id, err = createCategory(name, "", "", 0, false)
+		}
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// parseCategories finds the IDs of the categories named in the category field of a thread form.
+// It returns what went wrong with a status code if anything.
+func parseCategories(rawCats string) ([]int64, string, int) {
+	names, err := category.Parse(rawCats)
+	if err != nil {
+		return nil, err.Error(), http.StatusBadRequest
+	}
+	ids, err := resolveCategories(names)
+	if err == errUnknownCategory {
+		return nil, "Choose categories from the list", http.StatusBadRequest
+	}
+	if err != nil {
+		fmt.Println("Adding:", err.Error())
+		return nil, "Error adding categories", http.StatusInternalServerError
+	}
+	return ids, "", 0
+}
+
+// ThreadCategoriesHandler replaces the categories of a thread (thread=ID) with those in the categories field.
+// The author may retag their own thread, trusted users and moderators any thread.
+func ThreadCategoriesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/thread/categories" {
+		goToErrorPage("Page does not exist", http.StatusNotFound, w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		goToErrorPage("Method not allowed", http.StatusMethodNotAllowed, w, r)
+		return
+	}
+
+	usId, _, validSes := ValidateSession(r)
+	if !validSes {
+		http.Redirect(w, r, "/expired", http.StatusSeeOther)
+		return
+	}
+
+	threadID, err := strconv.Atoi(r.FormValue("thread"))
+	if err != nil {
+		goToErrorPage("Invalid thread ID", http.StatusBadRequest, w, r)
+		return
+	}
+	var authorID string
+	err = db.DB.QueryRow(`SELECT COALESCE(authorID, '') FROM posts WHERE id = ? AND title != '';`, threadID).Scan(&authorID)
+	if err == sql.ErrNoRows {
+		goToErrorPage("Thread not found", http.StatusNotFound, w, r)
+		return
+	}
+	if err != nil {
+		fmt.Println("Finding thread:", err.Error())
+		goToErrorPage("Error updating categories", http.StatusInternalServerError, w, r)
+		return
+	}
+	if !canEditCategories(usId, authorID) {
+		goToErrorPage("Only trusted users can change the categories of others' threads", http.StatusForbidden, w, r)
+		return
+	}
+	if msg := closedThreadMessage(strconv.Itoa(threadID)); msg != "" && !isModerator(usId) {
+		goToErrorPage(msg, http.StatusForbidden, w, r)
+		return
+	}
+
+	rawCats := r.FormValue("categories")
+	if ClosedCategories {
+		rawCats = strings.Join(r.Form["categories"], category.Separator)
+	}
+	if len(rawCats) > categoriesMaxLen {
+		goToErrorPage("Bad request, input length not supported", http.StatusBadRequest, w, r)
+		return
+	}
+	catIDs, msg, code := parseCategories(rawCats)
+	if msg != "" {
+		goToErrorPage(msg, code, w, r)
+		return
+	}
+
+	if err := setThreadCategories(threadID, catIDs); err != nil {
+		fmt.Println("Changing categories:", err.Error())
+		goToErrorPage("Error updating categories", http.StatusInternalServerError, w, r)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/thread/%d", threadID), http.StatusSeeOther)
+}
+
+// setThreadCategories replaces the categories of a thread. Categories left without threads are removed by the cleanup.
+func setThreadCategories(threadID int, catIDs []int64) error {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM posts_categories WHERE post_id = ?;`, threadID); err != nil {
+		return err
+	}
+	for _, catID := range catIDs {
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO posts_categories (post_id, category_id) VALUES (?, ?);`, threadID, catID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// createCategory adds a category with a slug of its own
+func createCategory(name, description, colour string, parentID int, curated bool) (int64, error) {
+	slug, err := db.UniqueSlug(db.DB, name)
+	if err != nil {
+		return 0, err
+	}
+	var parent any
+	if parentID != 0 {
+		parent = parentID
+	}
+	res, err := db.DB.Exec(`INSERT INTO categories (name, slug, description, colour, parent_id, curated) VALUES (?, ?, ?, ?, ?, ?);`,
+		name, slug, description, colour, parent, curated)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// CategoryPageHandler lists the threads of a category and its subcategories at /category/{slug}
+func CategoryPageHandler(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, "/category/") {
+		goToErrorPage("Page does not exist", http.StatusNotFound, w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		goToErrorPage("Method not allowed", http.StatusMethodNotAllowed, w, r)
+		return
+	}
+
+	usId, usName, validSes := ValidateSession(r)
+	prefs := getUserPrefs(r, usId)
+	order := threadSort(r, usId)
+
+	found, err := queryCategories(`c.slug = ?`, r.URL.Path[len("/category/"):])
+	if err == nil && len(found) == 0 {
+		goToErrorPage("Category not found", http.StatusNotFound, w, r)
+		return
+	}
+	var children []Category
+	var threads []Thread
+	if err == nil {
+		children, err = queryCategories(`c.parent_id = ?`, found[0].ID)
+	}
+	if err == nil {
+		threads, err = categoryThreads(found[0].ID, usId, prefs, order)
+	}
+	if err != nil {
+		fmt.Println("Fetching category:", err.Error())
+		goToErrorPage("Error fetching threads", http.StatusInternalServerError, w, r)
+		return
+	}
+
+	data := categoryPageData{
+		ValidSes:     validSes,
+		UsrId:        usId,
+		UsrNm:        usName,
+		LoginURL:     "/login?return_url=" + r.URL.Path,
+		Lang:         prefs.Lang,
+		headerCounts: countHeader(usId),
+		Category:     found[0],
+		Children:     children,
+		Threads:      threads,
+		Following:    isSubscribed(usId, subscribeCategory, found[0].ID),
+		Sort:         order,
+		SortOrders:   sortOrders,
+		SortLink:     r.URL.Path + "?",
+	}
+	templates.Execute(w, templates.Category, data)
+}
+
+// categoryThreads finds the threads in a category or in any of its subcategories that a user can see, in the given order
+func categoryThreads(categoryID int, userID string, prefs userPrefs, order string) ([]Thread, error) {
+	rows, err := db.DB.Query(sortedThreads(`WITH RECURSIVE tree(id) AS (
+								SELECT ? UNION SELECT c.id FROM categories c JOIN tree ON c.parent_id = tree.id
+							  )
+							  SELECT DISTINCT p.id, p.author, p.title, p.content, p.created_at FROM posts p
+							  JOIN posts_categories pc ON pc.post_id = p.id
+							  WHERE p.title != '' AND pc.category_id IN (SELECT id FROM tree)`, order), append([]any{categoryID}, visibleTo(userID)...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return fetchThreads(rows, prefs)
+}
+
+// AdminCategoriesHandler lets admins create categories and edit their details at /admin/categories
+func AdminCategoriesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/admin/categories" {
+		goToErrorPage("Page does not exist", http.StatusNotFound, w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		goToErrorPage("Method not allowed", http.StatusMethodNotAllowed, w, r)
+		return
+	}
+
+	usId, usName, validSes := ValidateSession(r)
+	if !validSes {
+		http.Redirect(w, r, "/login?return_url=/admin/categories", http.StatusSeeOther)
+		return
+	}
+	if !isAdmin(usId) {
+		goToErrorPage("Only admins can do that", http.StatusForbidden, w, r)
+		return
+	}
+	prefs := getUserPrefs(r, usId)
+
+	data := categoryAdminData{
+		ValidSes:          validSes,
+		UsrId:             usId,
+		UsrNm:             usName,
+		LoginURL:          "/login",
+		Lang:              prefs.Lang,
+		Closed:            ClosedCategories,
+		NameMaxLen:        category.NameMaxLen,
+		DescriptionMaxLen: category.DescriptionMaxLen,
+	}
+
+	if r.Method == http.MethodPost {
+		msg, code := editCategory(r)
+		if code == http.StatusSeeOther {
+			http.Redirect(w, r, "/admin/categories", http.StatusSeeOther)
+			return
+		}
+		data.Message = i18n.T(prefs.Lang, msg)
+		w.WriteHeader(code)
+	}
+
+	categories, err := queryCategories(`1`)
+	if err != nil {
+		fmt.Println("Fetching categories:", err.Error())
+		goToErrorPage("Error fetching categories", http.StatusInternalServerError, w, r)
+		return
+	}
+	data.Categories = categories
+	data.headerCounts = countHeader(usId)
+	templates.Execute(w, templates.CategoryAdmin, data)
+}
+
+// editCategory creates (action=create) or updates (action=update, id=ID) a category from the admin form.
+// It returns what went wrong with a status code, or 303 when it all went fine.
+func editCategory(r *http.Request) (string, int) {
+	description := strings.TrimSpace(r.FormValue("description"))
+	colour := strings.TrimSpace(r.FormValue("colour"))
+	if len(description) > category.DescriptionMaxLen {
+		return "Bad request, input length not supported", http.StatusBadRequest
+	}
+	if !category.ValidColour(colour) {
+		return "Colours are written like #1a2b3c", http.StatusBadRequest
+	}
+	parentID := 0
+	if p := r.FormValue("parent"); p != "" {
+		var err error
+		if parentID, err = strconv.Atoi(p); err != nil {
+			return "Category not found", http.StatusBadRequest
+		}
+	}
+
+	var err error
+	switch r.FormValue("action") {
+	case "create":
+		name, msg, code := newCategoryName(r.FormValue("name"))
+		if msg != "" {
+			return msg, code
+		}
+		if msg, code := checkParent(0, parentID); msg != "" {
+			return msg, code
+		}
+		_, err = createCategory(name, description, colour, parentID, true)
+	case "update":
+		id, _ := strconv.Atoi(r.FormValue("id"))
+		if msg, code := checkParent(id, parentID); msg != "" {
+			return msg, code
+		}
+		var parent any
+		if parentID != 0 {
+			parent = parentID
+		}
+		var res sql.Result
+		res, err = db.DB.Exec(`UPDATE categories SET description = ?, colour = ?, parent_id = ?, curated = 1 WHERE id = ?;`,
+			description, colour, parent, id)
+		if err == nil {
+			if n, _ := res.RowsAffected(); n == 0 {
+				return "Category not found", http.StatusNotFound
+			}
+		}
+	case "rename":
+		id, _ := strconv.Atoi(r.FormValue("id"))
+		name, msg, code := newCategoryName(r.FormValue("name"))
+		if msg != "" {
+			return msg, code
+		}
+		err = renameCategory(id, name)
+	case "alias":
+		id, _ := strconv.Atoi(r.FormValue("id"))
+		alias, msg, code := newCategoryName(r.FormValue("alias"))
+		if msg != "" {
+			return msg, code
+		}
+		_, err = db.DB.Exec(`INSERT INTO category_aliases (alias, category_id) SELECT ?, id FROM categories WHERE id = ?;`, alias, id)
+		if err == nil {
+			_, err = db.DB.Exec(`UPDATE categories SET curated = 1 WHERE id = ?;`, id)
+		}
+	case "unalias":
+		_, err = db.DB.Exec(`DELETE FROM category_aliases WHERE alias = ?;`, r.FormValue("alias"))
+	case "merge":
+		from, _ := strconv.Atoi(r.FormValue("id"))
+		to, _ := strconv.Atoi(r.FormValue("into"))
+		if from == to {
+			return "A category can't be merged into itself", http.StatusBadRequest
+		}
+		err = mergeCategories(from, to)
+	default:
+		return "Unknown category action", http.StatusBadRequest
+	}
+	if err == errUnknownCategory {
+		return "Category not found", http.StatusNotFound
+	}
+	if err != nil {
+		fmt.Println("Editing category:", err.Error())
+		return "Error updating category", http.StatusInternalServerError
+	}
+	return "", http.StatusSeeOther
+}
+
+// newCategoryName normalises a name for a new category, alias or rename, and tells what is wrong with it if anything.
+// The name can't be taken by a category or an alias already.
+func newCategoryName(input string) (string, string, int) {
+	name := category.Normalize(input)
+	if err := category.Validate(name); err != nil {
+		return "", err.Error(), http.StatusBadRequest
+	}
+	var taken bool
+	err := db.DB.QueryRow(`SELECT EXISTS(SELECT 1 FROM categories WHERE name = ?) OR EXISTS(SELECT 1 FROM category_aliases WHERE alias = ?);`,
+		name, name).Scan(&taken)
+	if err != nil {
+		fmt.Println("Checking category name:", err.Error())
+		return "", "Error updating category", http.StatusInternalServerError
+	}
+	if taken {
+		return "", "That name is already a category or an alias", http.StatusConflict
+	}
+	return name, "", 0
+}
+
+// renameCategory gives a category a new name and slug. The old name becomes an alias, so it keeps finding the category.
+func renameCategory(id int, name string) error {
+	var oldName string
+	if err := db.DB.QueryRow(`SELECT name FROM categories WHERE id = ?;`, id).Scan(&oldName); err != nil {
+		if err == sql.ErrNoRows {
+			return errUnknownCategory
+		}
+		return err
+	}
+	slug, err := db.UniqueSlug(db.DB, name)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`UPDATE categories SET name = ?, slug = ?, curated = 1 WHERE id = ?;`, name, slug, id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO category_aliases (alias, category_id) VALUES (?, ?);`, oldName, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// mergeCategories moves the threads, subscriptions, subcategories and aliases of one category to another,
+// and deletes it. Its name becomes an alias of the other.
+func mergeCategories(from, to int) error {
+	err := db.DB.QueryRow(`SELECT id FROM categories WHERE id = ?;`, to).Scan(&to)
+	if err == nil {
+		var tx *sql.Tx
+		if tx, err = db.DB.Begin(); err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if err = db.MergeCategory(tx, from, to); err == nil {
+			err = tx.Commit()
+		}
+	}
+	if err == sql.ErrNoRows {
+		return errUnknownCategory
+	}
+	return err
+}
+
+// checkParent tells what is wrong with making parentID the parent of category id, if anything.
+// A category can't be under itself or its own subcategories.
+func checkParent(id, parentID int) (string, int) {
+	if parentID == 0 {
+		return "", 0
+	}
+	var exists, loop bool
+	err := db.DB.QueryRow(`WITH RECURSIVE tree(id) AS (
+							 SELECT ? UNION SELECT c.id FROM categories c JOIN tree ON c.parent_id = tree.id
+						   )
+						   SELECT EXISTS(SELECT 1 FROM categories WHERE id = ?), EXISTS(SELECT 1 FROM tree WHERE id = ?);`,
+		id, parentID, parentID).Scan(&exists, &loop)
+	switch {
+	case err != nil:
+		fmt.Println("Checking parent category:", err.Error())
+		return "Error updating category", http.StatusInternalServerError
+	case !exists:
+		return "Category not found", http.StatusBadRequest
+	case loop:
+		return "A category can't be under itself", http.StatusBadRequest
+	}
+	return "", 0
+}
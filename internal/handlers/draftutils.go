@@ -0,0 +1,253 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"forum/internal/category"
+	"forum/internal/db"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	draftThread = "thread"      // Target of a new thread draft, replies have "reply-" and the post replied to
+	draftCookie = "draft_token" // Browser whose session expired while writing, see keepExpiredDraft
+	draftKeep   = 24 * time.Hour
+)
+
+// Draft is an unsent new thread or reply, saved while it is written
+type Draft struct {
+	Target     string `json:"target"`
+	Thread     int    `json:"thread"` // Thread of a reply, 0 for a new thread
+	Title      string `json:"title"`
+	Categories string `json:"categories"`
+	Content    string `json:"content"`
+}
+
+// empty tells if there is nothing in the draft worth keeping
+func (d Draft) empty() bool {
+	return strings.TrimSpace(d.Title+d.Categories+d.Content) == ""
+}
+
+// replyTarget is the draft target of a reply to a post
+func replyTarget(parentID string) string {
+	return "reply-" + parentID
+}
+
+// checkDraft checks that a draft of a user is of a new thread or of a reply to a post in a thread they see, and fits
+// in a post. It returns an error message and status for the first check that fails.
+func checkDraft(d Draft, userID string) (string, int) {
+	if len(d.Title) > titleMaxLen || len(d.Content) > contentMaxLen || len(d.Categories) > categoriesMaxLen {
+		return "Bad request, input length not supported", http.StatusBadRequest
+	}
+	if d.Target == draftThread {
+		return "", 0
+	}
+	parentID, isReply := strings.CutPrefix(d.Target, replyTarget(""))
+	if !isReply {
+		return "Unknown draft target", http.StatusBadRequest
+	}
+	return checkPostTarget(parentID, strconv.Itoa(d.Thread), userID)
+}
+
+// draftFromForm reads a new thread or reply form into a draft
+func draftFromForm(r *http.Request) Draft {
+	d := Draft{
+		Target:     draftThread,
+		Title:      strings.TrimSpace(r.FormValue("title")),
+		Categories: r.FormValue("categories"),
+		Content:    strings.TrimSpace(r.FormValue("content")),
+	}
+	if ClosedCategories {
+		d.Categories = strings.Join(r.Form["categories"], category.Separator)
+	}
+	if r.URL.Path == "/reply" {
+		d.Target = replyTarget(r.FormValue("parentId"))
+		d.Thread, _ = strconv.Atoi(r.FormValue("baseId"))
+		d.Title, d.Categories = "", ""
+	}
+	return d
+}
+
+// DraftsHandler saves and lists the drafts of the logged-in user at /drafts. GET lists them as JSON, of one thread
+// with thread=ID. POST saves the draft of a target (target=thread or target=reply-ID with thread=ID) with its title,
+// categories and content, and forgets it when they are empty.
+func DraftsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/drafts" {
+		http.Error(w, "Page does not exist", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	usId, _, validSes := ValidateSession(r)
+	if !validSes {
+		http.Error(w, "Not logged in", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		drafts, err := fetchDrafts(usId, r.URL.Query().Get("thread"))
+		if err != nil {
+			fmt.Println("Fetching drafts:", err.Error())
+			http.Error(w, "Error fetching drafts", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(drafts)
+		return
+	}
+
+	thread, _ := strconv.Atoi(r.FormValue("thread"))
+	d := Draft{
+		Target:     r.FormValue("target"),
+		Thread:     thread,
+		Title:      r.FormValue("title"),
+		Categories: r.FormValue("categories"),
+		Content:    r.FormValue("content"),
+	}
+	if d.Target == draftThread {
+		d.Thread = 0
+	}
+	if msg, code := checkDraft(d, usId); msg != "" {
+		http.Error(w, msg, code)
+		return
+	}
+	if d.empty() {
+		deleteDraft(usId, d.Target)
+	} else if err := saveDraft(usId, d); err != nil {
+		fmt.Println("Saving draft:", err.Error())
+		http.Error(w, "Error saving draft", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// fetchDrafts lists the drafts of a user, latest first, of one thread unless threadID is empty
+func fetchDrafts(userID, threadID string) ([]Draft, error) {
+	rows, err := db.DB.Query(`SELECT target, thread_id, title, categories, content FROM drafts
+							  WHERE user_id = ? AND (? = '' OR thread_id = ?) ORDER BY updated_at DESC, id DESC;`,
+		userID, threadID, threadID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	drafts := []Draft{}
+	for rows.Next() {
+		var d Draft
+		if err := rows.Scan(&d.Target, &d.Thread, &d.Title, &d.Categories, &d.Content); err != nil {
+			return nil, err
+		}
+		drafts = append(drafts, d)
+	}
+	return drafts, rows.Err()
+}
+
+// saveDraft stores a user's draft, replacing what they had for the same target
+func saveDraft(userID string, d Draft) error {
+	_, err := db.DB.Exec(`INSERT INTO drafts (user_id, target, thread_id, title, categories, content) VALUES (?, ?, ?, ?, ?, ?)
+						  ON CONFLICT (user_id, target) DO UPDATE SET thread_id = excluded.thread_id, title = excluded.title,
+						  categories = excluded.categories, content = excluded.content, updated_at = CURRENT_TIMESTAMP;`,
+		userID, d.Target, d.Thread, d.Title, d.Categories, d.Content)
+	return err
+}
+
+// deleteDraft forgets a user's draft once it has been posted or emptied
+func deleteDraft(userID, target string) {
+	if _, err := db.DB.Exec(`DELETE FROM drafts WHERE user_id = ? AND target = ?;`, userID, target); err != nil {
+		fmt.Println("Deleting draft:", err.Error())
+	}
+}
+
+// keepExpiredDraft saves a new thread or reply sent after the session expired, for whoever logs in next from
+// the same browser. The browser gets a cookie to claim it with.
+func keepExpiredDraft(w http.ResponseWriter, r *http.Request) {
+	if !checkRequestSize(r) {
+		io.Copy(io.Discard, r.Body) // Discard body, so client doesn't try to resend
+		return
+	}
+	d := draftFromForm(r)
+	if d.empty() {
+		return
+	}
+	if msg, _ := checkDraft(d, ""); msg != "" { // Whoever logs in next may only see what guests see
+		fmt.Println("Not keeping draft:", msg)
+		return
+	}
+
+	token, err := CreateSession()
+	if err != nil {
+		fmt.Println("Creating draft token:", err.Error())
+		return
+	}
+	if cookie, err := r.Cookie(draftCookie); err == nil && len(cookie.Value) <= 64 {
+		token = cookie.Value // Another post sent while logged out replaces the first
+	}
+	_, err = db.DB.Exec(`INSERT INTO drafts (token, target, thread_id, title, categories, content) VALUES (?, ?, ?, ?, ?, ?)
+						 ON CONFLICT (token) DO UPDATE SET target = excluded.target, thread_id = excluded.thread_id,
+						 title = excluded.title, categories = excluded.categories, content = excluded.content,
+						 updated_at = CURRENT_TIMESTAMP;`, token, d.Target, d.Thread, d.Title, d.Categories, d.Content)
+	if err != nil {
+		fmt.Println("Keeping draft:", err.Error())
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     draftCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  time.Now().Add(draftKeep),
+		HttpOnly: true,
+	})
+}
+
+// claimExpiredDraft gives the draft kept over an expired session to the user who logged in, replacing their own
+// draft of the same post. It returns the page where the draft can be posted, or "" when there was none.
+func claimExpiredDraft(w http.ResponseWriter, r *http.Request, userID string) string {
+	cookie, err := r.Cookie(draftCookie)
+	if err != nil {
+		return ""
+	}
+	http.SetCookie(w, &http.Cookie{Name: draftCookie, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+
+	var d Draft
+	err = db.DB.QueryRow(`SELECT target, thread_id FROM drafts WHERE token = ? AND user_id IS NULL;`, cookie.Value).
+		Scan(&d.Target, &d.Thread)
+	if err != nil {
+		return "" // Cleaned up already, or never kept
+	}
+	tx, err := db.DB.Begin()
+	if err != nil {
+		fmt.Println("Claiming draft:", err.Error())
+		return ""
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`DELETE FROM drafts WHERE user_id = ? AND target = ?;`, userID, d.Target)
+	if err == nil {
+		_, err = tx.Exec(`UPDATE drafts SET user_id = ?, token = NULL, updated_at = CURRENT_TIMESTAMP WHERE token = ?;`,
+			userID, cookie.Value)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		fmt.Println("Claiming draft:", err.Error())
+		return ""
+	}
+	if d.Target == draftThread {
+		return "/#draft" // Opens the new thread form
+	}
+	return fmt.Sprintf("/thread/%d#draft", d.Thread)
+}
+
+// ExpiredHandler tells at /expired that the session expired, and that a post sent meanwhile waits as a draft
+func ExpiredHandler(w http.ResponseWriter, r *http.Request) {
+	if _, err := r.Cookie(draftCookie); err == nil {
+		IndexHandler(w, r, "Session expired. Log in again and what you wrote is waiting as a draft.")
+		return
+	}
+	IndexHandler(w, r, "Session expired")
+}
@@ -2,12 +2,19 @@ package handlers
 
 import (
 	"fmt"
+	"forum/internal/category"
 	"forum/internal/db"
+	"forum/internal/i18n"
+	"forum/internal/live"
+	"forum/internal/reaction"
 	"forum/internal/templates"
 	"html"
+	"html/template"
 	"io"
 	"net/http"
 	"net/mail"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
@@ -16,23 +23,33 @@ import (
 )
 
 type Thread struct {
-	ID            int
-	Author        string
-	Title         string
-	Content       string
-	Created       string
-	CreatedDay    string
-	CreatedTime   string
-	Categories    string
-	CatsSlice     []string
-	Likes         int
-	Dislikes      int
+	ID          int
+	Author      string
+	Title       string
+	Content     string
+	ContentHTML template.HTML
+	Created     string
+	CreatedDay  string
+	CreatedTime string
+	Categories  string
+	CatsSlice   []string
+	reactionCounts
 	RepliesN      int
 	Replies       []Reply
 	BaseID        int
 	LikedNow      bool
 	DislikedNow   bool
 	ContentMaxLen int
+	AuthorID      string
+	Pinned        bool
+	Locked        bool
+	Archived      bool
+	threadSchedule
+}
+
+// Closed tells if a thread takes no new replies or reactions
+func (th Thread) Closed() bool {
+	return th.Locked || th.Archived || th.Scheduled || th.Hidden
 }
 
 type PageData struct {
@@ -50,6 +67,16 @@ type PageData struct {
 	LoginURL         string
 	CategoriesList   []string
 	TopTenCategories []string
+	Following        map[string]bool // Categories the user follows
+	Author           string          // Threads are filtered by this author
+	ClosedCategories bool            // New threads pick from CategoryChoices
+	CategoryChoices  []Category
+	Browse           []Category // Curated top level categories
+	Sort             string     // Order of the threads
+	SortOrders       []sortOrder
+	SortLink         string // Start of the links that change the order
+	headerCounts
+	Lang string
 }
 
 type errorData struct {
@@ -58,6 +85,8 @@ type errorData struct {
 	ValidSes  bool
 	UsrNm     string
 	LoginURL  string
+	Lang      string
+	headerCounts
 }
 
 const (
@@ -67,14 +96,14 @@ const (
 )
 
 type Reply struct {
-	ID            int
-	Author        string
-	Content       string
-	Created       string
-	CreatedDay    string
-	CreatedTime   string
-	Likes         int
-	Dislikes      int
+	ID          int
+	Author      string
+	Content     string
+	ContentHTML template.HTML
+	Created     string
+	CreatedDay  string
+	CreatedTime string
+	reactionCounts
 	ParentID      int
 	Replies       []Reply
 	BaseID        int
@@ -82,11 +111,28 @@ type Reply struct {
 	LikedNow      bool
 	DislikedNow   bool
 	ContentMaxLen int
+	Images        map[string]string
+	Lang          string
+	Collapsed     bool // Heavily disliked, shown folded
+	Focused       bool // The reply a focused view is about
+	MoreReplies   int  // Replies below the shown depth
+}
+
+// reactionCounts are the reactions on a post, and who gave them
+type reactionCounts struct {
+	Likes      int
+	Dislikes   int
+	LikedBy    string
+	DislikedBy string
+	Emoji      []Reaction // The enabled emoji reactions, in their order
 }
 
-type reaction struct {
-	userID  string
-	opinion string
+// Reaction is an emoji reaction on a post
+type Reaction struct {
+	reaction.Kind
+	Count int
+	Who   string // Names of those who gave it
+	Mine  bool   // Given by the viewer
 }
 
 type threadPageData struct {
@@ -96,6 +142,14 @@ type threadPageData struct {
 	UsrNm    string
 	LoginURL string
 	Images   map[string]string
+	Lang     string
+	headerCounts
+	Subscribed bool
+	Moderator  bool
+	ReplySort  string // Order of sibling replies
+	ReplySorts []sortOrder
+	Focus      int // Reply the tree starts from, 0 for the whole thread
+	EditCats   bool
 }
 
 type loginData struct {
@@ -106,6 +160,8 @@ type loginData struct {
 	UsrNm     string
 	ReturnURL string
 	LoginURL  string
+	Lang      string
+	headerCounts
 }
 
 func IndexHandler(w http.ResponseWriter, r *http.Request, msg string) {
@@ -115,33 +171,22 @@ func IndexHandler(w http.ResponseWriter, r *http.Request, msg string) {
 		return
 	}
 	usId, usName, validSes := ValidateSession(r)
+	prefs := getUserPrefs(r, usId)
 
 	if r.Method != http.MethodGet && r.Method != http.MethodPost {
 		goToErrorPage("Method not allowed", http.StatusMethodNotAllowed, w, r)
 		return
 	}
 
-	threads, selection, search, multisearch, err := findThreads(r)
+	order := threadSort(r, usId)
+	threads, selection, search, multisearch, err := findThreads(r, prefs, order)
 
 	if err != nil {
 		goToErrorPage("Error fetching threads", http.StatusInternalServerError, w, r)
 		return
 	}
 
-	for i, th := range threads {
-		replies, err := fetchReplies(th.ID)
-		if err != nil {
-			fmt.Println("Error fetching replies:", err.Error())
-			goToErrorPage("Error fetching replies", http.StatusInternalServerError, w, r)
-			return
-		}
-		threads[i].Replies = replies
-		threads[i].RepliesN = len(replies)
-	}
-
-	sortByRecentInteraction(&threads, w, r)
-
-	categories := strings.Fields(fetchCategories(-1))
+	categories := fetchCategories(-1)
 	var topTen []string
 	if len(categories) < 10 {
 		topTen = categories
@@ -149,12 +194,23 @@ func IndexHandler(w http.ResponseWriter, r *http.Request, msg string) {
 		topTen = categories[:10]
 	}
 
+	browse, err := queryCategories(`c.curated = 1 AND c.parent_id IS NULL`)
+	var choices []Category
+	if err == nil && ClosedCategories {
+		choices, err = queryCategories(`1`)
+	}
+	if err != nil {
+		fmt.Println("Fetching categories:", err.Error())
+		goToErrorPage("Error fetching categories", http.StatusInternalServerError, w, r)
+		return
+	}
+
 	data := PageData{
 		Threads:          threads,
 		ValidSes:         validSes,
 		UsrId:            usId,
 		UsrNm:            usName,
-		Message:          msg,
+		Message:          i18n.T(prefs.Lang, msg),
 		Selection:        selection,
 		Search:           search,
 		Multisearch:      multisearch,
@@ -164,8 +220,21 @@ func IndexHandler(w http.ResponseWriter, r *http.Request, msg string) {
 		LoginURL:         "/login",
 		CategoriesList:   categories,
 		TopTenCategories: topTen,
-	}
-	templates.IndexTmpl.Execute(w, data)
+		Lang:             prefs.Lang,
+		Following:        followedCategories(usId),
+		Author:           r.URL.Query().Get("author"),
+		ClosedCategories: ClosedCategories,
+		CategoryChoices:  choices,
+		Browse:           browse,
+		Sort:             order,
+		SortOrders:       sortOrders,
+		SortLink:         "/?",
+		headerCounts:     countHeader(usId),
+	}
+	if data.Author != "" {
+		data.SortLink = "/?author=" + url.QueryEscape(data.Author) + "&"
+	}
+	templates.Execute(w, templates.Index, data)
 }
 
 func AddThreadHandler(w http.ResponseWriter, r *http.Request) {
@@ -181,9 +250,12 @@ func AddThreadHandler(w http.ResponseWriter, r *http.Request) {
 	authID, author, valid := ValidateSession(r)
 
 	if valid && r.Method == http.MethodPost {
-		title := html.EscapeString(strings.TrimSpace(r.FormValue("title")))
-		content := html.EscapeString(strings.TrimSpace(r.FormValue("content")))
-		rawCats := html.EscapeString(strings.ToLower(r.FormValue("categories")))
+		title := strings.TrimSpace(r.FormValue("title"))
+		content := strings.TrimSpace(r.FormValue("content")) // Markdown source, rendered when shown
+		rawCats := r.FormValue("categories")                 // Names separated by commas
+		if ClosedCategories {                                // Picked from a list, one value each
+			rawCats = strings.Join(r.Form["categories"], category.Separator)
+		}
 		if !checkRequestSize(r) {
 			io.Copy(io.Discard, r.Body) // Discard body, so client doesn't try to resend
 			goToErrorPage("Request size too large", http.StatusRequestEntityTooLarge, w, r)
@@ -199,34 +271,66 @@ func AddThreadHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		catsList := removeDuplicates(strings.Fields(cleanString(rawCats)))
+		if msg, code := newAccountMessage(r, authID); msg != "" {
+			goToErrorPage(msg, code, w, r)
+			return
+		}
+
+		key := r.FormValue("post_key")
+		if postID, heldID, isNew := claimPostKey(authID, key); !isNew { // The same form again, like after a double click
+			if heldID != 0 {
+				http.Redirect(w, r, "/moderation", http.StatusSeeOther)
+			} else if postID == 0 {
+				http.Redirect(w, r, "/", http.StatusSeeOther)
+			} else {
+				http.Redirect(w, r, fmt.Sprintf("/thread/%d", postID), http.StatusSeeOther)
+			}
+			return
+		}
+		var threadID, heldID int64
+		defer func() { finishPostKey(authID, key, threadID, heldID) }()
+		if rateLimited(w, r, authID, limitThread) {
+			return
+		}
+
+		catIDs, msg, code := parseCategories(rawCats)
+		if msg != "" {
+			goToErrorPage(msg, code, w, r)
+			return
+		}
+		sched, msg := parseSchedule(r, getUserPrefs(r, authID)) // Published later, or expiring, if asked
+		if msg != "" {
+			goToErrorPage(msg, http.StatusBadRequest, w, r)
+			return
+		}
+		var done bool
+		if heldID, done = filterPost(w, r, HeldPost{Author: author, AuthorID: authID, Title: title, Content: content, Categories: rawCats, schedule: sched}); done {
+			return
+		}
 		threadUrl := "/"
 
-		threadResult, err := db.DB.Exec(`INSERT INTO posts (author, authorID, title, content) 
-										 VALUES (?, ?, ?, ?);`, author, authID, title, content)
+		// A scheduled thread is created at its publish time, so that it sorts like it was posted then
+		threadResult, err := db.DB.Exec(`INSERT INTO posts (author, authorID, title, content, created_at, publish_at, expires_at, expire_action) 
+										 VALUES (?, ?, ?, ?, COALESCE(NULLIF(?, ''), CURRENT_TIMESTAMP), NULLIF(?, ''), NULLIF(?, ''), ?);`,
+			author, authID, title, content, sched.PublishAt, sched.PublishAt, sched.ExpiresAt, sched.ExpireAction)
 		if err != nil {
 			fmt.Println("Adding:", err.Error())
 			goToErrorPage("Error adding thread", http.StatusInternalServerError, w, r)
 			return
 		}
-		threadID, err := threadResult.LastInsertId()
+		threadID, err = threadResult.LastInsertId()
 		if err != nil {
 			fmt.Println("Failed to get last insert ID:", err.Error())
 		} else {
 			threadUrl = fmt.Sprintf("/thread/%d", threadID)
-		}
-
-		for _, category := range catsList {
-
-			_, err := db.DB.Exec(`INSERT OR IGNORE INTO categories (name) VALUES (?);`, category)
-			if err != nil {
-				fmt.Println("Adding:", err.Error())
-				goToErrorPage("Error adding categories", http.StatusInternalServerError, w, r)
-				return
+			if err := db.UpdateHotScore(db.DB, int(threadID)); err != nil {
+				fmt.Println("Scoring thread:", err.Error())
 			}
+		}
 
+		for _, catID := range catIDs {
 			_, err = db.DB.Exec(`INSERT OR IGNORE INTO posts_categories (post_id, category_id) 
-								 VALUES (?, (SELECT id FROM categories WHERE name=?));`, threadID, category)
+								 VALUES (?, ?);`, threadID, catID)
 			if err != nil {
 				fmt.Println("Adding:", err.Error())
 				goToErrorPage("Error adding posts-categories relations", http.StatusInternalServerError, w, r)
@@ -234,18 +338,20 @@ func AddThreadHandler(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
-		errMsg, err := ImageUploadHandler(r, threadID, authID)
+		errMsg, err := ImageUploadHandler(r, threadID, 0, authID)
 		if err != nil {
 			fmt.Println(errMsg, err.Error())
 			goToErrorPage(errMsg, http.StatusInternalServerError, w, r)
 			return
 		}
+		if sched.PublishAt == "" { // Otherwise mentions notify when it is published
+			saveMentions(threadID, content, authID, author)
+		}
+		deleteDraft(authID, draftThread)
 
 		//easteregg error 418 teapot
 		if title == "tea" && content == "tea" && rawCats == "tea" {
-			errMsg := `<a href="https://developer.mozilla.org/en-US/docs/Web/HTTP/Status/418">
-			I'm a teapot. I refuse to brew coffee!</a>`
-			goToErrorPage(errMsg, http.StatusTeapot, w, r)
+			goToErrorPage("I'm a teapot. I refuse to brew coffee!", http.StatusTeapot, w, r)
 			return
 		}
 
@@ -253,8 +359,8 @@ func AddThreadHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if !valid {
-		// Session perhaps expired during writing
-		io.Copy(io.Discard, r.Body) // Discard body, so client doesn't try to resend
+		// Session perhaps expired during writing, what was written is kept for after logging in
+		keepExpiredDraft(w, r)
 		http.Redirect(w, r, "/expired", http.StatusSeeOther)
 	}
 }
@@ -272,36 +378,97 @@ func AddReplyHandler(w http.ResponseWriter, r *http.Request) {
 	authID, author, valid := ValidateSession(r)
 
 	if valid && r.Method == http.MethodPost {
-		content := html.EscapeString(strings.TrimSpace(r.FormValue("content")))
-		parId := r.FormValue("parentId") // No int conversion necessary
-		baseId := r.FormValue("baseId")  // No int conversion necessary
+		if !checkRequestSize(r) {
+			io.Copy(io.Discard, r.Body) // Discard body, so client doesn't try to resend
+			goToErrorPage("Request size too large", http.StatusRequestEntityTooLarge, w, r)
+			return
+		}
+		content := strings.TrimSpace(r.FormValue("content")) // Markdown source, rendered when shown
+		parId := r.FormValue("parentId")                     // No int conversion necessary
+		baseId := r.FormValue("baseId")                      // No int conversion necessary
 
 		if len(content) > contentMaxLen || content == "" { // User may try to force a bad input
 			goToErrorPage("Bad request, input length not supported", http.StatusBadRequest, w, r)
 			return
 		}
+		if msg, code := checkPostTarget(parId, baseId, authID); msg != "" { // Or to reply outside the thread
+			goToErrorPage(msg, code, w, r)
+			return
+		}
+		if msg := closedThreadMessage(parId); msg != "" {
+			goToErrorPage(msg, http.StatusForbidden, w, r)
+			return
+		}
+		if msg, code := newAccountMessage(r, authID); msg != "" {
+			goToErrorPage(msg, code, w, r)
+			return
+		}
+
+		key := r.FormValue("post_key")
+		if postID, heldID, isNew := claimPostKey(authID, key); !isNew { // The same form again, like after a double click
+			if heldID != 0 {
+				http.Redirect(w, r, "/moderation", http.StatusSeeOther)
+			} else if postID == 0 {
+				http.Redirect(w, r, "/thread/"+baseId, http.StatusSeeOther)
+			} else {
+				redirectToPost(w, r, postID, baseId)
+			}
+			return
+		}
+		var replyID, heldID int64
+		defer func() { finishPostKey(authID, key, replyID, heldID) }()
+		if rateLimited(w, r, authID, limitReply) {
+			return
+		}
+		parentID, _ := strconv.Atoi(parId) // Checked to be a post in the thread above
+		threadID, _ := strconv.Atoi(baseId)
+		var done bool
+		if heldID, done = filterPost(w, r, HeldPost{BaseID: threadID, ParentID: parentID, Author: author, AuthorID: authID, Content: content}); done {
+			return
+		}
 
 		if content != "" {
-			_, err := db.DB.Exec(`INSERT INTO posts (base_id, author, authorID, content, parent_id) 
+			replyResult, err := db.DB.Exec(`INSERT INTO posts (base_id, author, authorID, content, parent_id) 
 								  VALUES (?, ?, ?, ?, ?);`, baseId, author, authID, content, parId)
 			if err != nil {
 				fmt.Println("Replying:", err.Error())
 				goToErrorPage("Error adding reply", http.StatusInternalServerError, w, r)
 				return
 			}
+			replyID, err = replyResult.LastInsertId()
+			if err != nil {
+				fmt.Println("Failed to get last insert ID:", err.Error())
+				goToErrorPage("Error adding reply", http.StatusInternalServerError, w, r)
+				return
+			}
+
+			errMsg, err := ImageUploadHandler(r, replyID, 0, authID)
+			if err != nil {
+				fmt.Println(errMsg, err.Error())
+				goToErrorPage(errMsg, http.StatusInternalServerError, w, r)
+				return
+			}
+			publishPost(baseId, live.NewReply, replyID)
+			notifyAuthorOf(parId, authID, author, notifyReply, replyID)
+			saveMentions(replyID, content, authID, author)
+			deleteDraft(authID, replyTarget(parId))
+			redirectToPost(w, r, int(replyID), baseId)
+			return
 		}
 		http.Redirect(w, r, "/thread/"+baseId, http.StatusSeeOther)
 	}
 
 	if !valid {
-		// Session maybe expired during writing
-		io.Copy(io.Discard, r.Body) // Discard body, so client doesn't try to resend
+		// Session maybe expired during writing, what was written is kept for after logging in
+		keepExpiredDraft(w, r)
 		http.Redirect(w, r, "/expired", http.StatusSeeOther)
 	}
 }
 
-func likeOrDislike(w http.ResponseWriter, r *http.Request, opinion string) {
-	if r.URL.Path != "/like" && r.URL.Path != "/dislike" {
+// react gives or takes back a reaction of the logged-in user on a post. A like replaces a dislike and the other way round,
+// emoji reactions are given side by side.
+func react(w http.ResponseWriter, r *http.Request, kind string) {
+	if r.URL.Path != "/like" && r.URL.Path != "/dislike" && r.URL.Path != "/react" {
 		goToErrorPage("Page does not exist", http.StatusNotFound, w, r)
 		return
 	}
@@ -309,19 +476,42 @@ func likeOrDislike(w http.ResponseWriter, r *http.Request, opinion string) {
 		goToErrorPage("Method not allowed", http.StatusMethodNotAllowed, w, r)
 		return
 	}
+	if _, ok := reaction.Lookup(kind); !ok && !reaction.Opinion(kind) {
+		goToErrorPage("Unknown reaction", http.StatusBadRequest, w, r)
+		return
+	}
 
 	threadId := r.FormValue("base_id")
 	postId := r.FormValue("post_id")
-	userID, _, valid := ValidateSession(r)
+	userID, usName, valid := ValidateSession(r)
 
 	if !valid {
 		http.Redirect(w, r, "/thread/"+threadId, http.StatusSeeOther)
 		return
 	}
+	if msg, code := checkPostTarget(postId, threadId, userID); msg != "" {
+		goToErrorPage(msg, code, w, r)
+		return
+	}
+	if msg := closedThreadMessage(postId); msg != "" {
+		goToErrorPage(msg, http.StatusForbidden, w, r)
+		return
+	}
+	if rateLimited(w, r, userID, limitReaction) {
+		return
+	}
 
-	// Try to delete the exact same row from the table (when already liked/disliked)
+	// The like or dislike given before, as the author's reputation changes by the difference
+	before := ""
+	if reaction.Opinion(kind) {
+		db.DB.QueryRow(`SELECT reaction_type FROM post_reactions
+						WHERE user_id = ? AND post_id = ? AND reaction_type IN ('like', 'dislike');`, userID, postId).Scan(&before)
+	}
+	after := ""
+
+	// Try to delete the exact same row from the table (when already given)
 	res, _ := db.DB.Exec(`DELETE FROM post_reactions 
-						  WHERE user_id = ? AND post_id = ? AND reaction_type = ?;`, userID, postId, opinion)
+						  WHERE user_id = ? AND post_id = ? AND reaction_type = ?;`, userID, postId, kind)
 
 	// Check if any row was deleted
 	rowsAffected, err := res.RowsAffected()
@@ -329,34 +519,65 @@ func likeOrDislike(w http.ResponseWriter, r *http.Request, opinion string) {
 		fmt.Println("Affected rows checking failed:", err.Error())
 	}
 
-	// Add like/dislike: Update with current value on conflict
+	// Add the reaction. Like or dislike updates the other one on conflict with index post_reactions_opinion.
 	if rowsAffected == 0 {
-		_, err2 := db.DB.Exec(`INSERT INTO post_reactions (user_id, post_id, reaction_type) 
-							   VALUES (?, ?, ?) 
-							   ON CONFLICT (user_id, post_id) 
-							   DO UPDATE SET reaction_type = excluded.reaction_type;`, userID, postId, opinion)
+		var err2 error
+		if reaction.Opinion(kind) {
+			_, err2 = db.DB.Exec(`INSERT INTO post_reactions (user_id, post_id, reaction_type) 
+								  VALUES (?, ?, ?) 
+								  ON CONFLICT (user_id, post_id) WHERE reaction_type IN ('like', 'dislike')
+								  DO UPDATE SET reaction_type = excluded.reaction_type;`, userID, postId, kind)
+		} else {
+			_, err2 = db.DB.Exec(`INSERT INTO post_reactions (user_id, post_id, reaction_type) VALUES (?, ?, ?);`,
+				userID, postId, kind)
+		}
 		if err2 != nil {
-			fmt.Println("Adding like or dislike:", err2.Error())
-			goToErrorPage("Error adding like or dislike", http.StatusInternalServerError, w, r)
+			fmt.Println("Adding reaction:", err2.Error())
+			goToErrorPage("Error adding reaction", http.StatusInternalServerError, w, r)
 			return
 		}
+		after = kind
+		if id, err := strconv.ParseInt(postId, 10, 64); err == nil {
+			notifyAuthorOf(postId, userID, usName, notifyReaction, id)
+		}
+	}
+
+	if id, err := strconv.ParseInt(postId, 10, 64); err == nil {
+		if err := db.UpdateHotScore(db.DB, int(id)); err != nil {
+			fmt.Println("Scoring thread:", err.Error())
+		}
+		if err := db.AddReactionScore(db.DB, int(id), userID, reaction.Points(after)-reaction.Points(before)); err != nil {
+			fmt.Println("Updating reputation:", err.Error())
+		}
+		publishPost(threadId, live.Reactions, id)
+		redirectToPost(w, r, int(id), threadId)
+		return
 	}
 
 	http.Redirect(w, r, "/thread/"+threadId, http.StatusSeeOther)
 }
 
 func LikeHandler(w http.ResponseWriter, r *http.Request) {
-	likeOrDislike(w, r, "like")
+	react(w, r, reaction.Like)
 }
 
 func DislikeHandler(w http.ResponseWriter, r *http.Request) {
-	likeOrDislike(w, r, "dislike")
+	react(w, r, reaction.Dislike)
+}
+
+// ReactHandler gives or takes back an emoji reaction (reaction=name) on a post
+func ReactHandler(w http.ResponseWriter, r *http.Request) {
+	react(w, r, r.FormValue("reaction"))
 }
 
-func ImageUploadHandler(r *http.Request, postID int64, userID string) (string, error) {
+// ImageUploadHandler saves the images of a post form, for a published post or one held for review (heldID)
+func ImageUploadHandler(r *http.Request, postID, heldID int64, userID string) (string, error) {
 	errMsg := ""
 	maxTotalSize := int(20 * 1024 * 1024)            // 20 MB
 	err := r.ParseMultipartForm(int64(maxTotalSize)) // required to run for MultipartForm
+	if err == http.ErrNotMultipart {
+		return "", nil // Plain form without files
+	}
 	if err != nil {
 		return "Files size is too big", err
 	}
@@ -372,7 +593,7 @@ func ImageUploadHandler(r *http.Request, postID int64, userID string) (string, e
 			errMsg = "Invalid file type."
 			return errMsg, err
 		}
-		saveImageData(postID, userID, fileHeader, file)
+		saveImageData(postID, heldID, userID, fileHeader, file)
 		defer file.Close()
 	}
 	return "", nil
@@ -385,19 +606,21 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	var loginData loginData
 	loginData.UsrId, loginData.UsrNm, loginData.ValidSes = ValidateSession(r)
+	loginData.Lang = getUserPrefs(r, loginData.UsrId).Lang
 	loginData.LoginURL = "/login"
+	loginData.headerCounts = countHeader(loginData.UsrId)
 
 	if loginData.ValidSes {
 		fmt.Println(loginData.UsrNm + " trying to create a new user while logged-in")
-		loginData.Message1 = "Logged in as " + loginData.UsrNm + ". Log out first."
-		templates.LogTmpl.Execute(w, loginData)
+		loginData.Message1 = i18n.T(loginData.Lang, "Logged in as %s. Log out first.", loginData.UsrNm)
+		templates.Execute(w, templates.Login, loginData)
 		return
 	}
 
 	switch r.Method {
 	case http.MethodGet:
 		// Handle GET request - show registration form
-		templates.RegisterTmpl.Execute(w, loginData)
+		templates.Execute(w, templates.Register, loginData)
 		return
 
 	case http.MethodPost:
@@ -411,29 +634,29 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 
 		if !nameOk || !passOk {
 			fmt.Println("Minimum 5 chars, limited chars")
-			loginData.Message2 = "5-25 characters in username and password. Only letters, numbers and symbols allowed."
-			templates.RegisterTmpl.Execute(w, loginData)
+			loginData.Message2 = i18n.T(loginData.Lang, "5-25 characters in username and password. Only letters, numbers and symbols allowed.")
+			templates.Execute(w, templates.Register, loginData)
 			return
 		}
 
 		if emailErr != nil {
 			fmt.Println("Invalid email address")
-			loginData.Message2 = "Invalid email address"
-			templates.RegisterTmpl.Execute(w, loginData)
+			loginData.Message2 = i18n.T(loginData.Lang, "Invalid email address")
+			templates.Execute(w, templates.Register, loginData)
 			return
 		}
 
 		if NameOremailExists(name) {
 			fmt.Println("Name already taken")
-			loginData.Message2 = "Name already taken"
-			templates.RegisterTmpl.Execute(w, loginData)
+			loginData.Message2 = i18n.T(loginData.Lang, "Name already taken")
+			templates.Execute(w, templates.Register, loginData)
 			return
 		}
 
 		if NameOremailExists(email) {
 			fmt.Println("Email already taken")
-			loginData.Message2 = "Email already taken"
-			templates.RegisterTmpl.Execute(w, loginData)
+			loginData.Message2 = i18n.T(loginData.Lang, "Email already taken")
+			templates.Execute(w, templates.Register, loginData)
 			return
 		}
 
@@ -481,20 +704,22 @@ func LogUserInHandler(w http.ResponseWriter, r *http.Request) {
 
 	var loginData loginData
 	loginData.UsrId, loginData.UsrNm, loginData.ValidSes = ValidateSession(r)
+	loginData.Lang = getUserPrefs(r, loginData.UsrId).Lang
+	loginData.headerCounts = countHeader(loginData.UsrId)
 	loginData.ReturnURL, loginData.LoginURL = returnUrl, "/login?return_url="+returnUrl
 
 	if loginData.ValidSes {
 		fmt.Println(loginData.UsrNm + " trying to log in while already logged-in")
-		loginData.Message1 = "Already logged in as " + loginData.UsrNm + ". Log out first."
-		templates.LogTmpl.Execute(w, loginData)
+		loginData.Message1 = i18n.T(loginData.Lang, "Already logged in as %s. Log out first.", loginData.UsrNm)
+		templates.Execute(w, templates.Login, loginData)
 		return
 	}
 
 	// Checking if user or email exists
 	if !NameOremailExists(nameOrEmail) {
 		fmt.Println("User not found")
-		loginData.Message1 = "Invalid username/email or password"
-		templates.LogTmpl.Execute(w, loginData)
+		loginData.Message1 = i18n.T(loginData.Lang, "Invalid username/email or password")
+		templates.Execute(w, templates.Login, loginData)
 		return
 	}
 
@@ -503,16 +728,16 @@ func LogUserInHandler(w http.ResponseWriter, r *http.Request) {
 	query := `SELECT password, id, username FROM users WHERE username = ? OR email = ?`
 	err := db.DB.QueryRow(query, nameOrEmail, nameOrEmail).Scan(&storedHashedPass, &userID, &username)
 	if err != nil {
-		loginData.Message1 = "Invalid username/email or password"
-		templates.LogTmpl.Execute(w, loginData)
+		loginData.Message1 = i18n.T(loginData.Lang, "Invalid username/email or password")
+		templates.Execute(w, templates.Login, loginData)
 		return
 	}
 
 	err = bcrypt.CompareHashAndPassword([]byte(storedHashedPass), []byte(pass))
 	if err != nil {
 		fmt.Println("Password incorrect")
-		loginData.Message1 = "Invalid username/email or password"
-		templates.LogTmpl.Execute(w, loginData)
+		loginData.Message1 = i18n.T(loginData.Lang, "Invalid username/email or password")
+		templates.Execute(w, templates.Login, loginData)
 		return
 	}
 
@@ -520,6 +745,10 @@ func LogUserInHandler(w http.ResponseWriter, r *http.Request) {
 	deleteSession(w, r, userID)
 	// Create new session and token
 	sessionAndToken(&w, r, userID, username)
+	// Back to a post written while the session had expired
+	if draftURL := claimExpiredDraft(w, r, userID); draftURL != "" {
+		returnUrl = draftURL
+	}
 
 	http.Redirect(w, r, returnUrl, http.StatusSeeOther)
 }
@@ -586,10 +815,12 @@ func LogInHandler(w http.ResponseWriter, r *http.Request) {
 
 	var loginData loginData
 	loginData.UsrId, loginData.UsrNm, loginData.ValidSes = ValidateSession(r)
+	loginData.Lang = getUserPrefs(r, loginData.UsrId).Lang
+	loginData.headerCounts = countHeader(loginData.UsrId)
 	loginData.ReturnURL, loginData.LoginURL = r.URL.Query().Get("return_url"), "/login"
 	if loginData.ReturnURL == "" {
 		loginData.ReturnURL = "/"
 	}
 
-	templates.LogTmpl.Execute(w, loginData)
+	templates.Execute(w, templates.Login, loginData)
 }
@@ -3,38 +3,37 @@ package handlers
 import (
 	"database/sql"
 	"fmt"
+	"forum/internal/category"
 	"forum/internal/db"
+	"forum/internal/i18n"
+	"forum/internal/reaction"
 	"forum/internal/templates"
-	"html"
 	"net/http"
 	"strings"
-	"time"
 )
 
-func countReactions(id int) (int, int) {
-
-	reactionsQuery := `SELECT reaction_type, COUNT(*) AS count FROM post_reactions WHERE post_id = ? GROUP BY reaction_type;`
-	rows, err := db.DB.Query(reactionsQuery, id)
+// countReactions counts each reaction on a post and lists who gave it
+func countReactions(id int) reactionCounts {
+	var counts reactionCounts
+	rows, err := db.DB.Query(`SELECT pr.reaction_type, COALESCE(u.username, '') FROM post_reactions pr
+							  LEFT JOIN users u ON u.id = pr.user_id WHERE pr.post_id = ? ORDER BY pr.id;`, id)
 	if err != nil {
 		fmt.Println("Fetching reactions query failed", err.Error())
-		return 0, 0
+		return counts
 	}
 	defer rows.Close()
 
-	var likes, dislikes int
+	given := make(map[string]int)
+	who := make(map[string][]string)
 	for rows.Next() {
-		var reactionType string
-		var count int
-		if err := rows.Scan(&reactionType, &count); err != nil {
+		var kind, name string
+		if err := rows.Scan(&kind, &name); err != nil {
 			fmt.Printf("Failed to scan row: %v\n", err)
+			continue
 		}
-
-		// Assign counts based on reaction type
-		switch reactionType {
-		case "like":
-			likes = count
-		case "dislike":
-			dislikes = count
+		given[kind]++
+		if name != "" { // Reactions of removed users still count
+			who[kind] = append(who[kind], name)
 		}
 	}
 
@@ -43,10 +42,16 @@ func countReactions(id int) (int, int) {
 		fmt.Printf("Error iterating rows: %v\n", err)
 	}
 
-	return likes, dislikes
+	counts.Likes, counts.Dislikes = given[reaction.Like], given[reaction.Dislike]
+	counts.LikedBy, counts.DislikedBy = strings.Join(who[reaction.Like], ", "), strings.Join(who[reaction.Dislike], ", ")
+	for _, kind := range reaction.Enabled() {
+		counts.Emoji = append(counts.Emoji, Reaction{kind, given[kind.Name], strings.Join(who[kind.Name], ", "), false})
+	}
+	return counts
 }
 
-func fetchCategories(postId int) string {
+// fetchCategories lists the categories of a post, or all used categories by popularity when postId is -1
+func fetchCategories(postId int) []string {
 	var selectQuery string
 	if postId == -1 {
 		selectQuery = `SELECT categories.name FROM posts_categories JOIN categories ON posts_categories.category_id = categories.id GROUP BY posts_categories.category_id ORDER BY COUNT(posts_categories.post_id) DESC;`
@@ -57,40 +62,37 @@ func fetchCategories(postId int) string {
 	rowsCategories, err := db.DB.Query(selectQuery, postId)
 	if err != nil {
 		fmt.Println("fetchCategories selectQuery failed", err.Error())
-		return ""
+		return nil
 	}
 	defer rowsCategories.Close()
 
-	var category, categories string
+	var category string
+	var categories []string // Names can have spaces, so they aren't joined to one string
 	for rowsCategories.Next() {
 		err = rowsCategories.Scan(&category)
 		if err != nil {
 			fmt.Println("Error reading category:", err.Error())
 			return categories
 		}
-		categories += category + " "
+		categories = append(categories, category)
 	}
 	if err := rowsCategories.Err(); err != nil {
 		fmt.Println("Error iterating through rows:", err.Error())
 	}
-	if len(categories) > 0 {
-		categories = categories[:len(categories)-1]
-	}
 	return categories
 }
 
 // fetchThreads
-func fetchThreads(rowsThreads *sql.Rows) ([]Thread, error) {
+func fetchThreads(rowsThreads *sql.Rows, prefs userPrefs) ([]Thread, error) {
 	var threads []Thread
 	for rowsThreads.Next() {
 		var th Thread
-		err := rowsThreads.Scan(&th.ID, &th.Author, &th.Title, &th.Content, &th.Created)
+		err := rowsThreads.Scan(&th.ID, &th.Author, &th.Title, &th.Content, &th.Created, &th.RepliesN)
 		if err != nil {
 			fmt.Println("fetchThreads rows scanning:", err.Error())
 			return nil, err
 		}
-		th.Categories = fetchCategories(th.ID)
-		th, err = dataToThread(th)
+		th, err = dataToThread(th, prefs)
 		if err != nil {
 			return nil, err
 		}
@@ -100,25 +102,27 @@ func fetchThreads(rowsThreads *sql.Rows) ([]Thread, error) {
 	return threads, nil
 }
 
-// getMultipleSearch returns a search query that looks for either any or all matches to the search terms
-func getMultipleSearch(multisearch string, searches []string) string {
+// getMultipleSearch returns a search query and its arguments that look for either any or all matches to the search terms,
+// aliases standing for their categories
+func getMultipleSearch(multisearch string, searches []string) (string, []any) {
 	query := ""
+	searches = removeDuplicates(canonicalCategories(searches)) // Synonyms search their category
 	searchesCount := len(searches)
-	for i := range searches {
-		searches[i] = "'" + searches[i] + "'"
-		// Should we add escaping here ^^^ or somewhere else?
+	var args []any
+	for _, search := range searches {
+		args = append(args, search)
 	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", searchesCount), ", ")
 
 	if multisearch == "any" {
-		query = fmt.Sprintf(`SELECT DISTINCT p.id, p.author, p.title, p.content, p.created_at FROM posts p JOIN posts_categories pc ON pc.post_id = p.id JOIN categories cats ON cats.id = pc.category_id WHERE cats.name IN (%s);`, strings.Join(searches, ", "))
+		query = fmt.Sprintf(`SELECT DISTINCT p.id, p.author, p.title, p.content, p.created_at FROM posts p JOIN posts_categories pc ON pc.post_id = p.id JOIN categories cats ON cats.id = pc.category_id WHERE cats.name IN (%s);`, placeholders)
 	} else {
-		query = fmt.Sprintf(`SELECT DISTINCT p.id, p.author, p.title, p.content, p.created_at FROM posts p JOIN posts_categories pc ON pc.post_id = p.id JOIN categories cats ON cats.id = pc.category_id WHERE cats.name IN (%s) GROUP BY p.id, p.author, p.title, p.content, p.created_at HAVING COUNT(DISTINCT cats.name) = %v;`, strings.Join(searches, ", "), searchesCount)
+		query = fmt.Sprintf(`SELECT DISTINCT p.id, p.author, p.title, p.content, p.created_at FROM posts p JOIN posts_categories pc ON pc.post_id = p.id JOIN categories cats ON cats.id = pc.category_id WHERE cats.name IN (%s) GROUP BY p.id, p.author, p.title, p.content, p.created_at HAVING COUNT(DISTINCT cats.name) = %v;`, placeholders, searchesCount)
 		// HAVING COUNT to have equal number of matching categories to search terms
 	}
 
-	// json_each expands the JSON array in p.categories into rows, allowing filtering by category strings
 	// DISTINCT to avoid duplicates in case of repeated category in post
-	return query
+	return query, args
 }
 
 // removeDuplicates returns a slice of strings without duplicates
@@ -138,16 +142,22 @@ func removeDuplicates(searches []string) []string {
 	return result
 }
 
-func findThreads(r *http.Request) ([]Thread, string, string, string, error) {
+// findThreads finds the threads the filters and search of the index page select, in the given order
+func findThreads(r *http.Request, prefs userPrefs, order string) ([]Thread, string, string, string, error) {
 
 	usId, _, validSes := ValidateSession(r)
 	selection := r.FormValue("todisplay")
 	search := r.FormValue("usersearch")
 	multisearch := r.FormValue("multisearch")
 
-	// Find all threads by default
+	// Find all threads by default, or the threads of an author linked from a mention
 	selectQuery := `SELECT id, author, title, content, created_at FROM posts WHERE title != "";`
-	rowsThreads, err := db.DB.Query(selectQuery)
+	var args []any
+	if author := r.URL.Query().Get("author"); author != "" {
+		selectQuery = `SELECT id, author, title, content, created_at FROM posts WHERE title != "" AND author = ?;`
+		args = append(args, author)
+	}
+	rowsThreads, err := db.DB.Query(sortedThreads(selectQuery, order), append(args, visibleTo(usId)...)...)
 	if err != nil {
 		fmt.Println("findThreads selectQuery failed", err.Error())
 		return nil, selection, search, multisearch, err
@@ -166,7 +176,7 @@ func findThreads(r *http.Request) ([]Thread, string, string, string, error) {
 				selectQuery = `SELECT p.id, p.author, p.title, p.content, p.created_at FROM posts p JOIN post_reactions pr ON p.id = pr.post_id WHERE p.title != "" AND pr.reaction_type = 'dislike' AND pr.user_id = ?`
 			}
 
-			rowsThreads, err = db.DB.Query(selectQuery, usId)
+			rowsThreads, err = db.DB.Query(sortedThreads(selectQuery, order), append([]any{usId}, visibleTo(usId)...)...)
 			if err != nil {
 				fmt.Println("findThreads selectQuery to filter selected failed", err.Error())
 				return nil, selection, search, multisearch, err
@@ -177,12 +187,12 @@ func findThreads(r *http.Request) ([]Thread, string, string, string, error) {
 		}
 
 		if r.FormValue("searchcat") == "search" {
-			searches := strings.Fields(cleanString(html.EscapeString(strings.ToLower(search))))
+			searches := category.Split(search) // Normalised like stored names, so they match
 
-			selectQuery := getMultipleSearch(multisearch, searches)
+			selectQuery, searchArgs := getMultipleSearch(multisearch, searches)
 
 			if len(searches) > 0 {
-				rowsThreads, err = db.DB.Query(selectQuery)
+				rowsThreads, err = db.DB.Query(sortedThreads(selectQuery, order), append(searchArgs, visibleTo(usId)...)...)
 
 				if err != nil {
 					fmt.Println("findThreads selectQuery to search categories failed", err.Error())
@@ -201,13 +211,13 @@ func findThreads(r *http.Request) ([]Thread, string, string, string, error) {
 	}
 
 	var threads []Thread
-	threads, err = fetchThreads(rowsThreads)
+	threads, err = fetchThreads(rowsThreads, prefs)
 
 	return threads, selection, search, multisearch, err
 }
 
 // fetchReplies returns replies based on post ID
-func fetchReplies(thisID int) ([]Reply, error) {
+func fetchReplies(thisID int, prefs userPrefs) ([]Reply, error) {
 	selectQueryReplies := `SELECT id, base_id, author, content, created_at FROM posts WHERE base_id = ? AND title = '';` // All replies
 	rows, err := db.DB.Query(selectQueryReplies, thisID)
 	if err != nil {
@@ -215,68 +225,14 @@ func fetchReplies(thisID int) ([]Reply, error) {
 	}
 	defer rows.Close()
 
-	replies := createReplies(rows, thisID)
+	replies := createReplies(rows, thisID, prefs)
 	return replies, nil
 }
 
-// newestReply finds time of the  newest reply in the tree
-func newestReply(this *Reply, w http.ResponseWriter, r *http.Request) time.Time {
-	thisTime, err := time.Parse(time.RFC3339, this.Created)
-	if err != nil {
-		fmt.Println("Error parsing date:", err.Error())
-		goToErrorPage("Error parsing date", http.StatusInternalServerError, w, r)
-		return thisTime
-	}
-
-	if len(this.Replies) == 0 {
-		return thisTime
-	} else {
-		newest := thisTime
-		for _, rep := range this.Replies {
-			repTime := newestReply(&rep, w, r)
-			if repTime.After(newest) {
-				newest = repTime
-			}
-		}
-		return newest
-	}
-}
-
-// getThreadTime finds the time the thread got its most recent post
-func getThreadTime(th *Thread, w http.ResponseWriter, r *http.Request) time.Time {
-	threadTime, err := time.Parse(time.RFC3339, th.Created) // "created" looks something like this: 2024-12-02T15:44:52Z
-	if err != nil {
-		fmt.Println("Error parsing date:", err.Error())
-		goToErrorPage("Error parsing date", http.StatusInternalServerError, w, r)
-		return threadTime
-	}
-
-	for _, rep := range th.Replies {
-		replyTime := newestReply(&rep, w, r)
-		if replyTime.After(threadTime) {
-			threadTime = replyTime
-		}
-	}
-
-	return threadTime
-}
-
-// sortByRecentInteraction sorts the threads by most recent post within the thread
-func sortByRecentInteraction(threads *[]Thread, w http.ResponseWriter, r *http.Request) {
-	for i := 0; i < len(*threads)-1; i++ {
-		for j := i + 1; j < len(*threads); j++ {
-			time1 := getThreadTime(&(*threads)[i], w, r)
-			time2 := getThreadTime(&(*threads)[j], w, r)
-			if time1.Before(time2) {
-				(*threads)[i], (*threads)[j] = (*threads)[j], (*threads)[i]
-			}
-		}
-	}
-}
-
 func goToErrorPage(msg string, code int, w http.ResponseWriter, r *http.Request) {
-	_, usName, validSes := ValidateSession(r)
-	errData := errorData{msg, code, validSes, usName, "/login"}
+	usId, usName, validSes := ValidateSession(r)
+	lang := getUserPrefs(r, usId).Lang
+	errData := errorData{i18n.T(lang, msg), code, validSes, usName, "/login", lang, countHeader(usId)}
 	w.WriteHeader(code)
-	templates.ErrorTmpl.Execute(w, errData)
+	templates.Execute(w, templates.Error, errData)
 }
@@ -33,14 +33,12 @@ func uniqueFileName(file string) (string, error) {
 	return fileID, nil
 }
 
-func saveImageData(postID int64, userID string,
+func saveImageData(postID, heldID int64, userID string,
 	fileHeader *multipart.FileHeader, uploadedFile multipart.File) (string, error) {
 
 	originalName := fileHeader.Filename
 	fileSize := int(fileHeader.Size)
-	imageUploadDir := "internal/static/images"
-
-	err := os.MkdirAll(imageUploadDir, 0777)
+	err := os.MkdirAll(db.ImageDir, 0777)
 	if err != nil {
 		log.Println("Error creating directory:", err)
 		errMsg := "Internal error"
@@ -53,7 +51,7 @@ func saveImageData(postID int64, userID string,
 		return errMsg, err
 	}
 
-	filePath := filepath.Join(imageUploadDir, fileID)
+	filePath := filepath.Join(db.ImageDir, fileID)
 	os.Chmod(filePath, 0644)
 	savedFile, err := os.Create(filePath)
 	if err != nil {
@@ -78,8 +76,8 @@ func saveImageData(postID int64, userID string,
 		return errMsg, err
 	}
 
-	_, err = db.DB.Exec(`INSERT INTO images (id, post_id, user_id, original_name, file_size) VALUES (?, ?, ?, ?, ?)`,
-		fileID, postID, userID, originalName, fileSize)
+	_, err = db.DB.Exec(`INSERT INTO images (id, post_id, held_id, user_id, original_name, file_size)
+						 VALUES (?, NULLIF(?, 0), NULLIF(?, 0), ?, ?, ?)`, fileID, postID, heldID, userID, originalName, fileSize)
 	if err != nil {
 		log.Println("Error inserting into DB:", err)
 		errMsg := "Internal error"
@@ -87,23 +85,31 @@ func saveImageData(postID int64, userID string,
 	}
 	return "", nil
 }
-func getThreadImageURL(threadID int) (map[string]string, error) {
-	rows, err := db.DB.Query(`SELECT id, original_name FROM images WHERE post_id = ?`, threadID)
+
+// getThreadImageURLs returns the images of a thread and its replies, keyed by post ID
+func getThreadImageURLs(threadID int) (map[int]map[string]string, error) {
+	rows, err := db.DB.Query(`SELECT images.id, images.original_name, images.post_id FROM images 
+							  JOIN posts ON posts.id = images.post_id 
+							  WHERE posts.id = ? OR posts.base_id = ?`, threadID, threadID)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	images := make(map[string]string)
+	images := make(map[int]map[string]string)
 
 	for rows.Next() {
 		var imageID, originalName string
-		err := rows.Scan(&imageID, &originalName)
+		var postID int
+		err := rows.Scan(&imageID, &originalName, &postID)
 		if err != nil {
 			log.Println("Error scanning image ID:", err)
 			return nil, err
 		}
+		if images[postID] == nil {
+			images[postID] = make(map[string]string)
+		}
 		imageURL := "/internal/static/images/" + imageID
-		images[imageURL] = originalName
+		images[postID][imageURL] = originalName
 	}
 	return images, nil
 }
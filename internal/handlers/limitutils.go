@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"forum/internal/db"
+	"forum/internal/ratelimit"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Limited actions
+const (
+	limitThread   = "thread"
+	limitReply    = "reply"
+	limitReaction = "reaction"
+)
+
+// Default limits on what one user, and everyone from one address together, can do in a while
+const (
+	DefaultUserLimits    = "thread=5/10m,reply=20/10m,reaction=60/1m"
+	DefaultAddressLimits = "thread=10/10m,reply=40/10m,reaction=120/1m"
+)
+
+// The limiters of users and addresses, and the trust level from which users are not limited
+var (
+	userLimits    *ratelimit.Limiter
+	addressLimits *ratelimit.Limiter
+	limitExempt   string
+)
+
+// trustRanks orders the trust levels, "none" exempting nobody
+var trustRanks = map[string]int{trustNew: 1, trustMember: 2, trustTrusted: 3, "none": 4}
+
+func init() {
+	if err := ConfigureLimits(DefaultUserLimits, DefaultAddressLimits, trustTrusted); err != nil {
+		panic(err)
+	}
+}
+
+// ConfigureLimits sets the limits of users and addresses, and the trust level from which users are exempt.
+// Counts done so far are forgotten.
+func ConfigureLimits(users, addresses, exempt string) error {
+	userRules, err := ratelimit.Parse(users)
+	if err != nil {
+		return err
+	}
+	addressRules, err := ratelimit.Parse(addresses)
+	if err != nil {
+		return err
+	}
+	if _, ok := trustRanks[exempt]; !ok {
+		return fmt.Errorf("unknown trust level %q", exempt)
+	}
+	userLimits, addressLimits, limitExempt = ratelimit.New(userRules), ratelimit.New(addressRules), exempt
+	return nil
+}
+
+// PruneLimits forgets actions that no longer count towards the limits
+func PruneLimits() {
+	now := time.Now()
+	userLimits.Prune(now)
+	addressLimits.Prune(now)
+}
+
+// rateLimited tells if a user has done an action too often lately, from their account or from their address,
+// and if so answers 429 with the seconds to wait in Retry-After. New accounts also make only a few posts an hour.
+func rateLimited(w http.ResponseWriter, r *http.Request, userID, action string) bool {
+	trust := trustLevel(userID)
+	if trustRanks[trust] >= trustRanks[limitExempt] {
+		return false
+	}
+
+	now := time.Now()
+	var wait time.Duration
+	if trust == trustNew && action != limitReaction {
+		wait = newAccountWait(userID, now)
+	}
+	address := clientAddress(r)
+	if wait <= 0 {
+		wait = max(addressLimits.Wait(action, address, now), userLimits.Wait(action, userID, now))
+	}
+	if wait <= 0 {
+		// Only allowed actions count, so that retrying doesn't push the wait further
+		addressLimits.Record(action, address, now)
+		userLimits.Record(action, userID, now)
+		return false
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	if trust == trustNew {
+		goToErrorPage("New accounts can post a few times an hour, try again later", http.StatusTooManyRequests, w, r)
+	} else {
+		goToErrorPage("You're doing that too often, try again in a moment", http.StatusTooManyRequests, w, r)
+	}
+	return true
+}
+
+// newAccountWait tells how long a new account waits until it can post again, zero if it can now
+func newAccountWait(userID string, now time.Time) time.Duration {
+	var recent int
+	var oldest sql.NullInt64
+	err := db.DB.QueryRow(`SELECT COUNT(*), CAST(strftime('%s', MIN(created_at)) AS INTEGER) FROM posts
+						   WHERE authorID = ? AND created_at > datetime('now', '-1 hour');`, userID).Scan(&recent, &oldest)
+	if err != nil {
+		fmt.Println("Counting recent posts:", err.Error())
+		return 0
+	}
+	if recent < newPostsPerHour || !oldest.Valid {
+		return 0
+	}
+	return time.Unix(oldest.Int64, 0).Add(time.Hour).Sub(now)
+}
+
+// claimPostKey records the key of a form making a new post. When the form has been sent before, it returns false
+// and the post it made, or 0 while that is still being made, and the post it put in the moderation queue if any.
+// Forms without a key are always new.
+func claimPostKey(userID, key string) (int, int, bool) {
+	if key == "" || len(key) > 64 {
+		return 0, 0, true
+	}
+	res, err := db.DB.Exec(`INSERT OR IGNORE INTO post_keys (user_id, form_key) VALUES (?, ?);`, userID, key)
+	if err != nil {
+		fmt.Println("Recording form key:", err.Error())
+		return 0, 0, true
+	}
+	if n, _ := res.RowsAffected(); n == 1 {
+		return 0, 0, true
+	}
+	var postID, heldID int
+	err = db.DB.QueryRow(`SELECT post_id, held_id FROM post_keys WHERE user_id = ? AND form_key = ?;`, userID, key).
+		Scan(&postID, &heldID)
+	if err != nil {
+		fmt.Println("Reading form key:", err.Error())
+	}
+	return postID, heldID, false
+}
+
+// finishPostKey records the post a form made or put in the moderation queue, or forgets the key when neither
+// happened so that the form can be sent again
+func finishPostKey(userID, key string, postID, heldID int64) {
+	if key == "" || len(key) > 64 {
+		return
+	}
+	var err error
+	if postID == 0 && heldID == 0 {
+		_, err = db.DB.Exec(`DELETE FROM post_keys WHERE user_id = ? AND form_key = ?;`, userID, key)
+	} else {
+		_, err = db.DB.Exec(`UPDATE post_keys SET post_id = ?, held_id = ? WHERE user_id = ? AND form_key = ?;`,
+			postID, heldID, userID, key)
+	}
+	if err != nil {
+		fmt.Println("Updating form key:", err.Error())
+	}
+}
@@ -0,0 +1,190 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"forum/internal/db"
+	"forum/internal/live"
+	"forum/internal/templates"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	liveMaxPerClient = 5    // Open thread tabs per client
+	liveMaxTotal     = 1000 // Live connections to the whole server
+	liveKeepAlive    = 30 * time.Second
+)
+
+// LiveHub carries new replies and reaction counts to open thread pages
+var LiveHub = live.NewHub(liveMaxPerClient, liveMaxTotal)
+
+type replyEvent struct {
+	ID       int    `json:"id"`
+	ParentID int    `json:"parentId"`
+	HTML     string `json:"html"`
+}
+
+type reactionsEvent struct {
+	ID       int            `json:"id"`
+	Likes    int            `json:"likes"`
+	Dislikes int            `json:"dislikes"`
+	Emoji    map[string]int `json:"emoji"` // Count of each enabled emoji reaction
+}
+
+// ThreadEventsHandler streams updates of a thread as Server-Sent Events, from /events/{threadId}
+func ThreadEventsHandler(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, "/events/") {
+		http.Error(w, "Page does not exist", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	threadID, err := strconv.Atoi(r.URL.Path[len("/events/"):])
+	if err != nil {
+		http.Error(w, "Invalid thread ID", http.StatusBadRequest)
+		return
+	}
+	usId, _, validSes := ValidateSession(r)
+	visible, err := threadVisible(threadID, usId)
+	if err != nil {
+		fmt.Println("Finding thread:", err.Error())
+		http.Error(w, "Error finding thread", http.StatusInternalServerError)
+		return
+	}
+	if !visible { // Unknown, or scheduled or hidden from this viewer
+		http.Error(w, "Thread not found", http.StatusNotFound)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	events, cancel, err := LiveHub.Subscribe(threadID, clientAddress(r))
+	if err == live.ErrTooManyConnections {
+		http.Error(w, "Too many live connections", http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Live updates unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	defer cancel()
+
+	// Render new replies the way this viewer would see them on a reload
+	prefs := getUserPrefs(r, usId)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(liveKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case ev, open := <-events:
+			if !open {
+				return // Server shutting down
+			}
+			data, err := eventData(ev, threadID, validSes, prefs)
+			if err != nil {
+				fmt.Println("Live event for post", ev.PostID, "failed:", err.Error())
+				continue
+			}
+			writeEvent(w, ev.Type, data)
+			flusher.Flush()
+		}
+	}
+}
+
+// eventData builds the JSON payload of an event for one viewer
+func eventData(ev live.Event, threadID int, validSes bool, prefs userPrefs) ([]byte, error) {
+	switch ev.Type {
+	case live.NewReply:
+		reply, err := findReply(ev.PostID, prefs)
+		if err != nil {
+			return nil, err
+		}
+		reply.ValidSes, reply.Lang = validSes, prefs.Lang
+		if images, err := getThreadImageURLs(threadID); err == nil {
+			reply.Images = images[reply.ID]
+		}
+		var buf bytes.Buffer
+		if err := templates.ExecutePart(&buf, templates.Thread, "reply", reply); err != nil {
+			return nil, err
+		}
+		return json.Marshal(replyEvent{reply.ID, reply.ParentID, buf.String()})
+
+	case live.Reactions:
+		counts := countReactions(ev.PostID)
+		emoji := make(map[string]int)
+		for _, e := range counts.Emoji {
+			emoji[e.Name] = e.Count
+		}
+		return json.Marshal(reactionsEvent{ev.PostID, counts.Likes, counts.Dislikes, emoji})
+	}
+	return nil, fmt.Errorf("unknown event type %q", ev.Type)
+}
+
+// writeEvent writes one Server-Sent Event, a data line per line of data
+func writeEvent(w http.ResponseWriter, event string, data []byte) {
+	fmt.Fprintf(w, "event: %s\n", event)
+	for _, line := range strings.Split(string(data), "\n") {
+		fmt.Fprintf(w, "data: %s\n", line)
+	}
+	fmt.Fprint(w, "\n")
+}
+
+// findReply reads a single reply without its children
+func findReply(id int, prefs userPrefs) (Reply, error) {
+	var parentID int
+	if err := db.DB.QueryRow(`SELECT parent_id FROM posts WHERE id = ? AND title = '';`, id).Scan(&parentID); err != nil {
+		return Reply{}, err
+	}
+	rows, err := db.DB.Query(`SELECT id, base_id, author, content, created_at FROM posts WHERE id = ?;`, id)
+	if err != nil {
+		return Reply{}, err
+	}
+	defer rows.Close()
+
+	replies := createReplies(rows, parentID, prefs)
+	if len(replies) == 0 {
+		return Reply{}, fmt.Errorf("reply %d not found", id)
+	}
+	return replies[0], nil
+}
+
+// publishPost tells live thread pages about a new reply or changed reactions
+func publishPost(threadID string, eventType string, postID int64) {
+	id, err := strconv.Atoi(threadID)
+	if err != nil {
+		return
+	}
+	LiveHub.Publish(id, live.Event{Type: eventType, PostID: int(postID)})
+}
+
+// clientAddress identifies a client for connection limits
+func clientAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"forum/internal/db"
+	"forum/internal/markdown"
+	"net/http"
+	"strings"
+)
+
+const (
+	maxMentions    = 10 // Mentions that notify per post, so a post can't page everyone
+	maxSuggestions = 8
+)
+
+// saveMentions stores the @mentions of existing users in a new post and notifies them
+func saveMentions(postID int64, content, authorID, author string) {
+	names := markdown.Mentions(content)
+	if len(names) > maxMentions {
+		names = names[:maxMentions]
+	}
+
+	for _, name := range names {
+		var userID string
+		if err := db.DB.QueryRow(`SELECT id FROM users WHERE username = ?;`, name).Scan(&userID); err != nil {
+			continue // Not a user, left as plain text
+		}
+		_, err := db.DB.Exec(`INSERT OR IGNORE INTO mentions (post_id, user_id) VALUES (?, ?);`, postID, userID)
+		if err != nil {
+			fmt.Println("Adding mention:", err.Error())
+			continue
+		}
+		notify(userID, authorID, author, notifyMention, postID)
+	}
+}
+
+// fetchMentions returns the usernames mentioned in a post, for linking them
+func fetchMentions(postID int) []string {
+	rows, err := db.DB.Query(`SELECT u.username FROM mentions m JOIN users u ON u.id = m.user_id WHERE m.post_id = ?;`, postID)
+	if err != nil {
+		fmt.Println("Fetching mentions failed:", err.Error())
+		return nil
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			fmt.Println("Error reading mention:", err.Error())
+			return names
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// UserSuggestHandler returns usernames starting with ?q= as JSON, for @mention autocomplete
+func UserSuggestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/users/suggest" {
+		http.Error(w, "Page does not exist", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// Only people who can write posts need suggestions, guests can't list users
+	if _, _, validSes := ValidateSession(r); !validSes {
+		http.Error(w, "Not logged in", http.StatusUnauthorized)
+		return
+	}
+
+	prefix := r.URL.Query().Get("q")
+	names := []string{}
+	if prefix != "" && len(prefix) <= 25 {
+		// Escape LIKE wildcards, usernames may contain underscores
+		escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(prefix)
+		rows, err := db.DB.Query(`SELECT username FROM users WHERE username LIKE ? ESCAPE '\' ORDER BY username LIMIT ?;`,
+			escaped+"%", maxSuggestions)
+		if err != nil {
+			fmt.Println("Suggesting users failed:", err.Error())
+			http.Error(w, "Error fetching users", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				fmt.Println("Error reading username:", err.Error())
+				break
+			}
+			names = append(names, name)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(names)
+}
@@ -0,0 +1,574 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"forum/internal/db"
+	"forum/internal/i18n"
+	"forum/internal/markdown"
+	"forum/internal/moderation"
+	"forum/internal/templates"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxConversationSize = 8 // Members of a group conversation, the sender included
+	reportReasonMaxLen  = 500
+)
+
+// headerCounts are the unread counts shown in the header of every page
+type headerCounts struct {
+	Unread         int // Notifications
+	UnreadMessages int
+	Held           int // Posts and reports in the moderation queue, for moderators
+}
+
+// countHeader counts what a user hasn't read yet, and what waits for them as a moderator
+func countHeader(userID string) headerCounts {
+	return headerCounts{unreadNotifications(userID), unreadMessages(userID, 0), heldCount(userID)}
+}
+
+// Conversation is a private conversation as listed in the inbox
+type Conversation struct {
+	ID          int
+	Subject     string
+	Members     string // Other members
+	LastDay     string
+	LastTime    string
+	Unread      int
+	LastMessage int
+}
+
+// Message is one private message
+type Message struct {
+	ID          int
+	Sender      string
+	ContentHTML template.HTML
+	CreatedDay  string
+	CreatedTime string
+	Mine        bool
+}
+
+// Member is someone in a conversation, with whether the viewer has blocked them
+type Member struct {
+	Name    string
+	Blocked bool
+}
+
+type inboxData struct {
+	ValidSes bool
+	UsrId    string
+	UsrNm    string
+	LoginURL string
+	Lang     string
+	headerCounts
+	Message       string
+	Conversations []Conversation
+	Blocked       []string
+	SubjectMaxLen int
+	ContentMaxLen int
+	To            string // Prefilled recipients
+}
+
+type conversationData struct {
+	ValidSes bool
+	UsrId    string
+	UsrNm    string
+	LoginURL string
+	Lang     string
+	headerCounts
+	Message       string
+	ID            int
+	Subject       string
+	Members       []Member
+	Messages      []Message
+	ContentMaxLen int
+	ReportMaxLen  int
+}
+
+// unreadMessages counts messages from others a user hasn't seen, in one conversation or in all when conversationID is 0
+func unreadMessages(userID string, conversationID int) int {
+	if userID == "" {
+		return 0
+	}
+	var count int
+	err := db.DB.QueryRow(`SELECT COUNT(*) FROM messages m
+						   JOIN conversation_members cm ON cm.conversation_id = m.conversation_id
+						   WHERE cm.user_id = ? AND m.id > cm.last_read_id AND COALESCE(m.sender_id, '') != ?
+						   AND (? = 0 OR m.conversation_id = ?);`, userID, userID, conversationID, conversationID).Scan(&count)
+	if err != nil {
+		fmt.Println("Counting unread messages:", err.Error())
+	}
+	return count
+}
+
+// isMember tells if a user is in a conversation. Every read and write of a conversation checks it.
+func isMember(conversationID int, userID string) bool {
+	var member bool
+	err := db.DB.QueryRow(`SELECT EXISTS(SELECT 1 FROM conversation_members WHERE conversation_id = ? AND user_id = ?);`,
+		conversationID, userID).Scan(&member)
+	if err != nil {
+		fmt.Println("Checking conversation member:", err.Error())
+	}
+	return member
+}
+
+// blockedBetween tells if either user has blocked the other
+func blockedBetween(userA, userB string) bool {
+	var blocked bool
+	err := db.DB.QueryRow(`SELECT EXISTS(SELECT 1 FROM blocks WHERE (blocker_id = ? AND blocked_id = ?) OR (blocker_id = ? AND blocked_id = ?));`,
+		userA, userB, userB, userA).Scan(&blocked)
+	if err != nil {
+		fmt.Println("Checking blocks:", err.Error())
+		return true // Rather not deliver than deliver to someone who blocked the sender
+	}
+	return blocked
+}
+
+// blockedInConversation returns the name of a member who has blocked or been blocked by the user, if any
+func blockedInConversation(conversationID int, userID string) string {
+	rows, err := db.DB.Query(`SELECT u.id, u.username FROM conversation_members cm JOIN users u ON u.id = cm.user_id
+							  WHERE cm.conversation_id = ? AND cm.user_id != ?;`, conversationID, userID)
+	if err != nil {
+		fmt.Println("Fetching conversation members:", err.Error())
+		return ""
+	}
+	var ids, names []string
+	for rows.Next() {
+		var id, name string
+		if err := rows.Scan(&id, &name); err == nil {
+			ids, names = append(ids, id), append(names, name)
+		}
+	}
+	rows.Close()
+
+	for i, id := range ids {
+		if blockedBetween(userID, id) {
+			return names[i]
+		}
+	}
+	return ""
+}
+
+// fetchConversations lists a user's conversations, latest activity first
+func fetchConversations(userID string, prefs userPrefs) ([]Conversation, error) {
+	rows, err := db.DB.Query(`SELECT c.id, c.subject,
+							  COALESCE((SELECT GROUP_CONCAT(u.username, ', ') FROM conversation_members o
+							  JOIN users u ON u.id = o.user_id WHERE o.conversation_id = c.id AND o.user_id != ?), ''),
+							  COALESCE(MAX(m.id), 0), COALESCE(MAX(m.created_at), c.created_at)
+							  FROM conversations c
+							  JOIN conversation_members cm ON cm.conversation_id = c.id
+							  LEFT JOIN messages m ON m.conversation_id = c.id
+							  WHERE cm.user_id = ?
+							  GROUP BY c.id ORDER BY MAX(m.id) DESC;`, userID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var conversations []Conversation
+	for rows.Next() {
+		var c Conversation
+		var last string
+		if err := rows.Scan(&c.ID, &c.Subject, &c.Members, &c.LastMessage, &last); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		c.LastDay, c.LastTime, _ = timeStrings(last, prefs)
+		conversations = append(conversations, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range conversations {
+		conversations[i].Unread = unreadMessages(userID, conversations[i].ID)
+	}
+	return conversations, nil
+}
+
+// fetchBlocked lists the usernames a user has blocked
+func fetchBlocked(userID string) []string {
+	rows, err := db.DB.Query(`SELECT u.username FROM blocks b JOIN users u ON u.id = b.blocked_id
+							  WHERE b.blocker_id = ? ORDER BY u.username;`, userID)
+	if err != nil {
+		fmt.Println("Fetching blocked users:", err.Error())
+		return nil
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err == nil {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// InboxHandler lists the conversations of the logged-in user at /messages, and starts new ones on POST
+func InboxHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/messages" {
+		goToErrorPage("Page does not exist", http.StatusNotFound, w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		goToErrorPage("Method not allowed", http.StatusMethodNotAllowed, w, r)
+		return
+	}
+
+	usId, usName, validSes := ValidateSession(r)
+	if !validSes {
+		http.Redirect(w, r, "/login?return_url=/messages", http.StatusSeeOther)
+		return
+	}
+	prefs := getUserPrefs(r, usId)
+
+	data := inboxData{
+		ValidSes:      validSes,
+		UsrId:         usId,
+		UsrNm:         usName,
+		LoginURL:      "/login",
+		Lang:          prefs.Lang,
+		SubjectMaxLen: titleMaxLen,
+		ContentMaxLen: contentMaxLen,
+		To:            r.URL.Query().Get("to"),
+	}
+
+	if r.Method == http.MethodPost {
+		id, msg := startConversation(r, usId)
+		if msg == "" {
+			http.Redirect(w, r, fmt.Sprintf("/messages/%d", id), http.StatusSeeOther)
+			return
+		}
+		data.Message, data.To = i18n.T(prefs.Lang, msg), r.FormValue("to")
+		w.WriteHeader(http.StatusBadRequest)
+	}
+
+	conversations, err := fetchConversations(usId, prefs)
+	if err != nil {
+		fmt.Println("Fetching conversations:", err.Error())
+		goToErrorPage("Error fetching messages", http.StatusInternalServerError, w, r)
+		return
+	}
+	data.Conversations = conversations
+	data.Blocked = fetchBlocked(usId)
+	data.headerCounts = countHeader(usId)
+	templates.Execute(w, templates.Inbox, data)
+}
+
+// startConversation creates a conversation from the new message form, and returns its ID
+// or a message telling what was wrong
+func startConversation(r *http.Request, userID string) (int64, string) {
+	subject := strings.TrimSpace(r.FormValue("subject"))
+	content := strings.TrimSpace(r.FormValue("content"))
+	if subject == "" || content == "" || len(subject) > titleMaxLen || len(content) > contentMaxLen {
+		return 0, "Bad request, input length not supported"
+	}
+
+	// Recipients are separated by commas or spaces
+	names := removeDuplicates(strings.FieldsFunc(r.FormValue("to"), func(c rune) bool { return c == ',' || c == ' ' }))
+	if len(names) == 0 {
+		return 0, "Add at least one recipient"
+	}
+	if len(names) > maxConversationSize-1 {
+		return 0, "Too many recipients"
+	}
+
+	var memberIDs []string
+	for _, name := range names {
+		var id string
+		err := db.DB.QueryRow(`SELECT id FROM users WHERE username = ?;`, strings.TrimPrefix(name, "@")).Scan(&id)
+		if err != nil {
+			return 0, "Unknown recipient"
+		}
+		if id == userID {
+			continue
+		}
+		if blockedBetween(userID, id) {
+			return 0, "You can't send messages to a user who has blocked you or whom you have blocked"
+		}
+		memberIDs = append(memberIDs, id)
+	}
+	if len(memberIDs) == 0 {
+		return 0, "Add at least one recipient"
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		fmt.Println("Starting conversation:", err.Error())
+		return 0, "Error sending message"
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`INSERT INTO conversations (subject, created_by) VALUES (?, ?);`, subject, userID)
+	if err != nil {
+		fmt.Println("Adding conversation:", err.Error())
+		return 0, "Error sending message"
+	}
+	id, _ := res.LastInsertId()
+	for _, memberID := range append(memberIDs, userID) {
+		if _, err := tx.Exec(`INSERT INTO conversation_members (conversation_id, user_id) VALUES (?, ?);`, id, memberID); err != nil {
+			fmt.Println("Adding conversation member:", err.Error())
+			return 0, "Error sending message"
+		}
+	}
+	res, err = tx.Exec(`INSERT INTO messages (conversation_id, sender_id, content) VALUES (?, ?, ?);`, id, userID, content)
+	if err != nil {
+		fmt.Println("Adding message:", err.Error())
+		return 0, "Error sending message"
+	}
+	// The sender has seen their own message
+	messageID, _ := res.LastInsertId()
+	if _, err := tx.Exec(`UPDATE conversation_members SET last_read_id = ? WHERE conversation_id = ? AND user_id = ?;`,
+		messageID, id, userID); err != nil {
+		fmt.Println("Marking message read:", err.Error())
+	}
+	if err := tx.Commit(); err != nil {
+		fmt.Println("Committing conversation:", err.Error())
+		return 0, "Error sending message"
+	}
+	return id, ""
+}
+
+// ConversationHandler shows a conversation at /messages/{id} to its members, and adds a message on POST
+func ConversationHandler(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, "/messages/") {
+		goToErrorPage("Page does not exist", http.StatusNotFound, w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		goToErrorPage("Method not allowed", http.StatusMethodNotAllowed, w, r)
+		return
+	}
+
+	id, err := strconv.Atoi(r.URL.Path[len("/messages/"):])
+	if err != nil {
+		goToErrorPage("Invalid conversation ID", http.StatusBadRequest, w, r)
+		return
+	}
+
+	usId, usName, validSes := ValidateSession(r)
+	if !validSes {
+		if r.Method == http.MethodPost {
+			http.Redirect(w, r, "/expired", http.StatusSeeOther)
+			return
+		}
+		http.Redirect(w, r, "/login?return_url="+r.URL.Path, http.StatusSeeOther)
+		return
+	}
+	// Conversations of others look the same as ones that don't exist
+	if !isMember(id, usId) {
+		goToErrorPage("Conversation not found", http.StatusNotFound, w, r)
+		return
+	}
+	prefs := getUserPrefs(r, usId)
+
+	data := conversationData{
+		ValidSes:      validSes,
+		UsrId:         usId,
+		UsrNm:         usName,
+		LoginURL:      "/login",
+		Lang:          prefs.Lang,
+		ID:            id,
+		ContentMaxLen: contentMaxLen,
+		ReportMaxLen:  reportReasonMaxLen,
+	}
+
+	if r.Method == http.MethodPost {
+		content := strings.TrimSpace(r.FormValue("content"))
+		switch {
+		case content == "" || len(content) > contentMaxLen:
+			data.Message = "Bad request, input length not supported"
+		case blockedInConversation(id, usId) != "":
+			data.Message = "You can't send messages to a user who has blocked you or whom you have blocked"
+		default:
+			res, err := db.DB.Exec(`INSERT INTO messages (conversation_id, sender_id, content) VALUES (?, ?, ?);`, id, usId, content)
+			if err != nil {
+				fmt.Println("Adding message:", err.Error())
+				goToErrorPage("Error sending message", http.StatusInternalServerError, w, r)
+				return
+			}
+			messageID, _ := res.LastInsertId()
+			http.Redirect(w, r, fmt.Sprintf("/messages/%d#message-%d", id, messageID), http.StatusSeeOther)
+			return
+		}
+		data.Message = i18n.T(prefs.Lang, data.Message)
+		w.WriteHeader(http.StatusBadRequest)
+	} else if r.URL.Query().Get("reported") != "" {
+		data.Message = i18n.T(prefs.Lang, "Thank you, moderators will look into the report")
+	}
+
+	err = db.DB.QueryRow(`SELECT subject FROM conversations WHERE id = ?;`, id).Scan(&data.Subject)
+	if err != nil {
+		fmt.Println("Fetching conversation:", err.Error())
+		goToErrorPage("Error fetching messages", http.StatusInternalServerError, w, r)
+		return
+	}
+	if data.Members, err = fetchMembers(id, usId); err == nil {
+		data.Messages, err = fetchMessages(id, usId, prefs)
+	}
+	if err != nil {
+		fmt.Println("Fetching conversation:", err.Error())
+		goToErrorPage("Error fetching messages", http.StatusInternalServerError, w, r)
+		return
+	}
+
+	// Everything shown is now read
+	if len(data.Messages) > 0 {
+		_, err := db.DB.Exec(`UPDATE conversation_members SET last_read_id = ? WHERE conversation_id = ? AND user_id = ?;`,
+			data.Messages[len(data.Messages)-1].ID, id, usId)
+		if err != nil {
+			fmt.Println("Marking messages read:", err.Error())
+		}
+	}
+	data.headerCounts = countHeader(usId)
+	templates.Execute(w, templates.Conversation, data)
+}
+
+// fetchMembers lists the other members of a conversation
+func fetchMembers(conversationID int, userID string) ([]Member, error) {
+	rows, err := db.DB.Query(`SELECT u.username, EXISTS(SELECT 1 FROM blocks WHERE blocker_id = ? AND blocked_id = u.id)
+							  FROM conversation_members cm JOIN users u ON u.id = cm.user_id
+							  WHERE cm.conversation_id = ? AND cm.user_id != ? ORDER BY u.username;`, userID, conversationID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var members []Member
+	for rows.Next() {
+		var m Member
+		if err := rows.Scan(&m.Name, &m.Blocked); err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+// fetchMessages reads the messages of a conversation, oldest first
+func fetchMessages(conversationID int, userID string, prefs userPrefs) ([]Message, error) {
+	rows, err := db.DB.Query(`SELECT m.id, COALESCE(u.username, ''), COALESCE(m.sender_id, ''), m.content, m.created_at
+							  FROM messages m LEFT JOIN users u ON u.id = m.sender_id
+							  WHERE m.conversation_id = ? ORDER BY m.id;`, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []Message
+	for rows.Next() {
+		var m Message
+		var senderID, content, created string
+		if err := rows.Scan(&m.ID, &m.Sender, &senderID, &content, &created); err != nil {
+			return nil, err
+		}
+		m.Mine = senderID == userID
+		m.ContentHTML = markdown.Render(content)
+		m.CreatedDay, m.CreatedTime, _ = timeStrings(created, prefs)
+		messages = append(messages, m)
+	}
+	return messages, rows.Err()
+}
+
+// BlockHandler blocks or unblocks messages from a user (username=name, action=block/unblock)
+func BlockHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/block" {
+		goToErrorPage("Page does not exist", http.StatusNotFound, w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		goToErrorPage("Method not allowed", http.StatusMethodNotAllowed, w, r)
+		return
+	}
+	usId, _, validSes := ValidateSession(r)
+	if !validSes {
+		http.Redirect(w, r, "/login?return_url=/messages", http.StatusSeeOther)
+		return
+	}
+
+	var blockedID string
+	err := db.DB.QueryRow(`SELECT id FROM users WHERE username = ?;`, r.FormValue("username")).Scan(&blockedID)
+	if err == sql.ErrNoRows || blockedID == usId {
+		goToErrorPage("User not found", http.StatusNotFound, w, r)
+		return
+	}
+	if err == nil {
+		if r.FormValue("action") == "unblock" {
+			_, err = db.DB.Exec(`DELETE FROM blocks WHERE blocker_id = ? AND blocked_id = ?;`, usId, blockedID)
+		} else {
+			_, err = db.DB.Exec(`INSERT OR IGNORE INTO blocks (blocker_id, blocked_id) VALUES (?, ?);`, usId, blockedID)
+		}
+	}
+	if err != nil {
+		fmt.Println("Updating block:", err.Error())
+		goToErrorPage("Error updating block", http.StatusInternalServerError, w, r)
+		return
+	}
+
+	returnURL := r.FormValue("return_url")
+	if !strings.HasPrefix(returnURL, "/") || strings.HasPrefix(returnURL, "//") {
+		returnURL = "/messages"
+	}
+	http.Redirect(w, r, returnURL, http.StatusSeeOther)
+}
+
+// ReportMessageHandler files an abuse report on a message for moderators.
+// Only members of the conversation can report, and not their own messages.
+func ReportMessageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/messages/report" {
+		goToErrorPage("Page does not exist", http.StatusNotFound, w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		goToErrorPage("Method not allowed", http.StatusMethodNotAllowed, w, r)
+		return
+	}
+	usId, _, validSes := ValidateSession(r)
+	if !validSes {
+		http.Redirect(w, r, "/expired", http.StatusSeeOther)
+		return
+	}
+
+	messageID, err := strconv.ParseInt(r.FormValue("message_id"), 10, 64)
+	if err != nil {
+		goToErrorPage("Invalid message ID", http.StatusBadRequest, w, r)
+		return
+	}
+	reason := strings.TrimSpace(r.FormValue("reason"))
+	if len(reason) > reportReasonMaxLen {
+		goToErrorPage("Bad request, input length not supported", http.StatusBadRequest, w, r)
+		return
+	}
+
+	var conversationID int
+	var senderID, content string
+	err = db.DB.QueryRow(`SELECT conversation_id, COALESCE(sender_id, ''), content FROM messages WHERE id = ?;`, messageID).
+		Scan(&conversationID, &senderID, &content)
+	if err == sql.ErrNoRows || (err == nil && (!isMember(conversationID, usId) || senderID == usId)) {
+		goToErrorPage("Message not found", http.StatusNotFound, w, r)
+		return
+	}
+	if err == nil {
+		_, err = moderation.File(moderation.Report{
+			ReporterID: usId,
+			TargetType: "message",
+			TargetID:   messageID,
+			AuthorID:   senderID,
+			Content:    content,
+			Reason:     reason,
+		})
+	}
+	if err != nil {
+		fmt.Println("Reporting message:", err.Error())
+		goToErrorPage("Error reporting message", http.StatusInternalServerError, w, r)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/messages/%d?reported=%d#message-%d", conversationID, messageID, messageID), http.StatusSeeOther)
+}
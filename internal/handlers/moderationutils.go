@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"forum/internal/db"
+	"net/http"
+	"strconv"
+)
+
+// User roles, admins can do everything moderators can
+const (
+	moderatorRole = "moderator"
+	adminRole     = "admin"
+)
+
+// threadStateQueries change a thread's state, the key being the action of the form
+var threadStateQueries = map[string]string{
+	"pin":       `UPDATE posts SET pinned = 1 WHERE id = ?;`,
+	"unpin":     `UPDATE posts SET pinned = 0 WHERE id = ?;`,
+	"lock":      `UPDATE posts SET locked = 1 WHERE id = ?;`,
+	"unlock":    `UPDATE posts SET locked = 0 WHERE id = ?;`,
+	"archive":   `UPDATE posts SET archived = 1 WHERE id = ?;`,
+	"unarchive": `UPDATE posts SET archived = 0, reopened_at = CURRENT_TIMESTAMP WHERE id = ?;`,
+}
+
+// userRole reads the role of a user, empty for guests
+func userRole(userID string) string {
+	if userID == "" {
+		return ""
+	}
+	var role string
+	err := db.DB.QueryRow(`SELECT role FROM users WHERE id = ?;`, userID).Scan(&role)
+	if err != nil && err != sql.ErrNoRows {
+		fmt.Println("Reading user role:", err.Error())
+	}
+	return role
+}
+
+// isModerator tells if a user is a moderator or an admin
+func isModerator(userID string) bool {
+	role := userRole(userID)
+	return role == moderatorRole || role == adminRole
+}
+
+// isAdmin tells if a user has the admin role
+func isAdmin(userID string) bool {
+	return userRole(userID) == adminRole
+}
+
+// loadThreadState reads who started a thread and whether it is pinned, locked or archived
+func loadThreadState(th *Thread) {
+	err := db.DB.QueryRow(`SELECT COALESCE(authorID, ''), pinned, locked, archived FROM posts WHERE id = ?;`, th.ID).
+		Scan(&th.AuthorID, &th.Pinned, &th.Locked, &th.Archived)
+	if err != nil {
+		fmt.Println("Reading thread state:", err.Error())
+	}
+}
+
+// closedThreadMessage tells why the thread of a post takes no new replies or reactions,
+// or returns an empty string when it is open
+func closedThreadMessage(postID string) string {
+	var locked, archived, scheduled, hidden bool
+	err := db.DB.QueryRow(`SELECT t.locked, t.archived, COALESCE(t.publish_at > CURRENT_TIMESTAMP, 0),
+							   t.hidden OR COALESCE(t.expire_action = 'hide' AND t.expires_at <= CURRENT_TIMESTAMP, 0)
+						   FROM posts p JOIN posts t ON t.id = CASE WHEN p.base_id = 0 THEN p.id ELSE p.base_id END
+						   WHERE p.id = ?;`, postID).Scan(&locked, &archived, &scheduled, &hidden)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			fmt.Println("Reading thread state:", err.Error())
+		}
+		return ""
+	}
+	switch {
+	case scheduled:
+		return "This thread isn't published yet. It takes replies and reactions once it is."
+	case hidden:
+		return "This thread has expired. It takes no new replies or reactions."
+	case archived:
+		return "This thread is archived. It can be read, but no longer replied or reacted to."
+	case locked:
+		return "This thread is locked. It takes no new replies or reactions."
+	}
+	return ""
+}
+
+// ThreadStateHandler pins, locks or archives a thread (thread=ID, action=pin/unpin/lock/unlock/archive/unarchive).
+// Moderators can do all of it, thread authors can only lock their own threads, so that a moderator's lock holds.
+func ThreadStateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/thread/state" {
+		goToErrorPage("Page does not exist", http.StatusNotFound, w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		goToErrorPage("Method not allowed", http.StatusMethodNotAllowed, w, r)
+		return
+	}
+
+	usId, _, validSes := ValidateSession(r)
+	if !validSes {
+		http.Redirect(w, r, "/expired", http.StatusSeeOther)
+		return
+	}
+
+	threadID, err := strconv.Atoi(r.FormValue("thread"))
+	if err != nil {
+		goToErrorPage("Invalid thread ID", http.StatusBadRequest, w, r)
+		return
+	}
+	action := r.FormValue("action")
+	query, ok := threadStateQueries[action]
+	if !ok {
+		goToErrorPage("Unknown thread action", http.StatusBadRequest, w, r)
+		return
+	}
+
+	var authorID string
+	err = db.DB.QueryRow(`SELECT COALESCE(authorID, '') FROM posts WHERE id = ? AND title != '';`, threadID).Scan(&authorID)
+	if err == sql.ErrNoRows {
+		goToErrorPage("Thread not found", http.StatusNotFound, w, r)
+		return
+	}
+	if err != nil {
+		fmt.Println("Finding thread:", err.Error())
+		goToErrorPage("Error updating thread", http.StatusInternalServerError, w, r)
+		return
+	}
+
+	authorLocking := authorID == usId && action == "lock"
+	if !authorLocking && !isModerator(usId) {
+		goToErrorPage("Only moderators can do that", http.StatusForbidden, w, r)
+		return
+	}
+
+	if _, err := db.DB.Exec(query, threadID); err != nil {
+		fmt.Println("Updating thread state:", err.Error())
+		goToErrorPage("Error updating thread", http.StatusInternalServerError, w, r)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/thread/%d", threadID), http.StatusSeeOther)
+}
@@ -0,0 +1,219 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"forum/internal/db"
+	"forum/internal/templates"
+	"net/http"
+	"strconv"
+)
+
+// Notification types
+const (
+	notifyReply    = "reply"
+	notifyReaction = "reaction"
+	notifyMention  = "mention"
+)
+
+// notifyColumns are the user settings that switch each notification type on or off
+var notifyColumns = map[string]string{
+	notifyReply:    "notify_replies",
+	notifyReaction: "notify_reactions",
+	notifyMention:  "notify_mentions",
+}
+
+const notificationsShown = 100
+
+type Notification struct {
+	ID          int
+	Actor       string
+	Type        string
+	PostID      int
+	ThreadID    int
+	ThreadTitle string
+	Read        bool
+	CreatedDay  string
+	CreatedTime string
+}
+
+type notificationsData struct {
+	ValidSes bool
+	UsrId    string
+	UsrNm    string
+	LoginURL string
+	Lang     string
+	headerCounts
+	Notifications []Notification
+}
+
+// notify stores a notification for a user about a post, unless they caused it themselves
+// or have turned that type of notification off
+func notify(userID, actorID, actor, kind string, postID int64) {
+	if userID == "" || userID == actorID {
+		return
+	}
+
+	var wanted bool
+	query := fmt.Sprintf(`SELECT %s FROM users WHERE id = ?;`, notifyColumns[kind])
+	if err := db.DB.QueryRow(query, userID).Scan(&wanted); err != nil {
+		if err != sql.ErrNoRows {
+			fmt.Println("Reading notification settings:", err.Error())
+		}
+		return
+	}
+	if !wanted {
+		return
+	}
+
+	// Toggling a reaction back and forth shouldn't pile up notifications
+	var exists bool
+	err := db.DB.QueryRow(`SELECT EXISTS(SELECT 1 FROM notifications
+						   WHERE user_id = ? AND actor = ? AND type = ? AND post_id = ? AND is_read = 0);`,
+		userID, actor, kind, postID).Scan(&exists)
+	if err != nil || exists {
+		return
+	}
+
+	_, err = db.DB.Exec(`INSERT INTO notifications (user_id, actor, type, post_id, thread_id)
+						 SELECT ?, ?, ?, id, CASE WHEN base_id = 0 THEN id ELSE base_id END
+						 FROM posts WHERE id = ?;`, userID, actor, kind, postID)
+	if err != nil {
+		fmt.Println("Adding notification:", err.Error())
+	}
+}
+
+// notifyAuthorOf notifies the author of a post that someone replied to or reacted on it
+func notifyAuthorOf(targetID, actorID, actor, kind string, postID int64) {
+	var authorID sql.NullString
+	err := db.DB.QueryRow(`SELECT authorID FROM posts WHERE id = ?;`, targetID).Scan(&authorID)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			fmt.Println("Finding post author:", err.Error())
+		}
+		return
+	}
+	notify(authorID.String, actorID, actor, kind, postID)
+}
+
+// unreadNotifications counts the notifications a user hasn't read, for the bell in the header
+func unreadNotifications(userID string) int {
+	if userID == "" {
+		return 0
+	}
+	var count int
+	err := db.DB.QueryRow(`SELECT COUNT(*) FROM notifications WHERE user_id = ? AND is_read = 0;`, userID).Scan(&count)
+	if err != nil {
+		fmt.Println("Counting notifications:", err.Error())
+	}
+	return count
+}
+
+// fetchNotifications reads the latest notifications of a user
+func fetchNotifications(userID string, prefs userPrefs) ([]Notification, error) {
+	rows, err := db.DB.Query(`SELECT n.id, n.actor, n.type, n.post_id, n.thread_id, n.is_read, n.created_at, t.title
+							  FROM notifications n JOIN posts t ON t.id = n.thread_id
+							  WHERE n.user_id = ? ORDER BY n.id DESC LIMIT ?;`, userID, notificationsShown)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var notifications []Notification
+	for rows.Next() {
+		var n Notification
+		var created string
+		err := rows.Scan(&n.ID, &n.Actor, &n.Type, &n.PostID, &n.ThreadID, &n.Read, &created, &n.ThreadTitle)
+		if err != nil {
+			return nil, err
+		}
+		n.CreatedDay, n.CreatedTime, err = timeStrings(created, prefs)
+		if err != nil {
+			fmt.Println("Error parsing notification time:", err.Error())
+		}
+		notifications = append(notifications, n)
+	}
+	return notifications, rows.Err()
+}
+
+// NotificationsHandler lists notifications of the logged-in user, and marks them read on POST.
+// Posting "open" marks one read and goes to the post it is about.
+func NotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/notifications" {
+		goToErrorPage("Page does not exist", http.StatusNotFound, w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		goToErrorPage("Method not allowed", http.StatusMethodNotAllowed, w, r)
+		return
+	}
+
+	usId, usName, validSes := ValidateSession(r)
+	if !validSes {
+		http.Redirect(w, r, "/login?return_url=/notifications", http.StatusSeeOther)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		markNotificationsRead(w, r, usId)
+		return
+	}
+
+	prefs := getUserPrefs(r, usId)
+	notifications, err := fetchNotifications(usId, prefs)
+	if err != nil {
+		fmt.Println("Fetching notifications:", err.Error())
+		goToErrorPage("Error fetching notifications", http.StatusInternalServerError, w, r)
+		return
+	}
+
+	data := notificationsData{
+		ValidSes:      validSes,
+		UsrId:         usId,
+		UsrNm:         usName,
+		LoginURL:      "/login",
+		Lang:          prefs.Lang,
+		headerCounts:  countHeader(usId),
+		Notifications: notifications,
+	}
+	templates.Execute(w, templates.Notifications, data)
+}
+
+// markNotificationsRead marks one or all notifications of a user read
+func markNotificationsRead(w http.ResponseWriter, r *http.Request, userID string) {
+	if r.FormValue("all") != "" {
+		if _, err := db.DB.Exec(`UPDATE notifications SET is_read = 1 WHERE user_id = ?;`, userID); err != nil {
+			fmt.Println("Marking notifications read:", err.Error())
+			goToErrorPage("Error updating notifications", http.StatusInternalServerError, w, r)
+			return
+		}
+		http.Redirect(w, r, "/notifications", http.StatusSeeOther)
+		return
+	}
+
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		goToErrorPage("Invalid notification ID", http.StatusBadRequest, w, r)
+		return
+	}
+
+	// The user ID in the condition keeps users from touching each other's notifications
+	var postID, threadID int
+	err = db.DB.QueryRow(`UPDATE notifications SET is_read = 1 WHERE id = ? AND user_id = ?
+						  RETURNING post_id, thread_id;`, id, userID).Scan(&postID, &threadID)
+	if err == sql.ErrNoRows {
+		goToErrorPage("Notification not found", http.StatusNotFound, w, r)
+		return
+	}
+	if err != nil {
+		fmt.Println("Marking notification read:", err.Error())
+		goToErrorPage("Error updating notifications", http.StatusInternalServerError, w, r)
+		return
+	}
+
+	if r.FormValue("open") != "" {
+		redirectToPost(w, r, postID, strconv.Itoa(threadID))
+		return
+	}
+	http.Redirect(w, r, "/notifications", http.StatusSeeOther)
+}
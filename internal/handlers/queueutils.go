@@ -0,0 +1,377 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"forum/internal/db"
+	"forum/internal/filter"
+	"forum/internal/live"
+	"forum/internal/markdown"
+	"forum/internal/moderation"
+	"forum/internal/templates"
+	"html/template"
+	"net/http"
+	"strconv"
+)
+
+// HeldPost is a new thread or reply a content filter put in the moderation queue
+type HeldPost struct {
+	ID          int
+	BaseID      int // Thread of a reply, 0 for a new thread
+	ParentID    int
+	Author      string
+	AuthorID    string
+	Title       string
+	Content     string
+	ContentHTML template.HTML
+	Categories  string // Category field of a new thread
+	Filter      string
+	Reason      string
+	ThreadTitle string // Of a reply
+	CreatedDay  string
+	CreatedTime string
+	Images      map[string]string
+	schedule    // Of a new thread
+}
+
+type moderationData struct {
+	ValidSes bool
+	UsrId    string
+	UsrNm    string
+	LoginURL string
+	Lang     string
+	headerCounts
+	Moderator bool
+	Held      []HeldPost
+	Reports   []reportView // Open abuse reports, for moderators
+}
+
+// reportView is an open abuse report as the moderation queue shows it
+type reportView struct {
+	moderation.Report
+	CreatedDay  string
+	CreatedTime string
+}
+
+// heldCount counts the posts and open reports waiting in the moderation queue, for moderators
+func heldCount(userID string) int {
+	if userID == "" || !isModerator(userID) {
+		return 0
+	}
+	var count int
+	if err := db.DB.QueryRow(`SELECT COUNT(*) FROM held_posts;`).Scan(&count); err != nil {
+		fmt.Println("Counting held posts:", err.Error())
+	}
+	reports, err := moderation.OpenCount()
+	if err != nil {
+		fmt.Println("Counting reports:", err.Error())
+	}
+	return count + reports
+}
+
+// filterPost runs a new post through the content filters, unless a moderator wrote it. A rejected post gets
+// an error page, and a held one goes to the moderation queue with its images. Then it returns true, and the ID
+// in the queue when the post was held.
+func filterPost(w http.ResponseWriter, r *http.Request, post HeldPost) (int64, bool) {
+	if isModerator(post.AuthorID) {
+		return 0, false
+	}
+	result := filter.Check(filter.Post{
+		AuthorID: post.AuthorID,
+		NewUser:  trustLevel(post.AuthorID) == trustNew,
+		Title:    post.Title,
+		Content:  post.Content,
+	})
+	switch result.Verdict {
+	case filter.Reject:
+		goToErrorPage(result.Reason, http.StatusBadRequest, w, r)
+		return 0, true
+	case filter.Pass:
+		return 0, false
+	}
+
+	if post.ExpireAction == "" {
+		post.ExpireAction = expireArchive
+	}
+	res, err := db.DB.Exec(`INSERT INTO held_posts (base_id, parent_id, author, authorID, title, content, categories, filter, reason,
+								publish_at, expires_at, expire_action)
+							VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, NULLIF(?, ''), NULLIF(?, ''), ?);`, post.BaseID, post.ParentID, post.Author,
+		post.AuthorID, post.Title, post.Content, post.Categories, result.Filter, result.Reason,
+		post.PublishAt, post.ExpiresAt, post.ExpireAction)
+	var heldID int64
+	if err == nil {
+		heldID, err = res.LastInsertId()
+	}
+	if err != nil {
+		fmt.Println("Holding post:", err.Error())
+		goToErrorPage("Error adding post", http.StatusInternalServerError, w, r)
+		return 0, true
+	}
+	if errMsg, err := ImageUploadHandler(r, 0, heldID, post.AuthorID); err != nil {
+		fmt.Println(errMsg, err.Error())
+		goToErrorPage(errMsg, http.StatusInternalServerError, w, r)
+		return heldID, true
+	}
+	if post.BaseID == 0 {
+		deleteDraft(post.AuthorID, draftThread)
+	} else {
+		deleteDraft(post.AuthorID, replyTarget(strconv.Itoa(post.ParentID)))
+	}
+	http.Redirect(w, r, "/moderation", http.StatusSeeOther)
+	return heldID, true
+}
+
+// fetchHeldPosts lists the posts waiting in the moderation queue, oldest first. Moderators see all of them,
+// others their own.
+func fetchHeldPosts(userID string, all bool, prefs userPrefs) ([]HeldPost, error) {
+	rows, err := db.DB.Query(`SELECT h.id, h.base_id, h.parent_id, h.author, COALESCE(h.authorID, ''), h.title, h.content,
+								  h.categories, h.filter, h.reason, h.created_at, COALESCE(t.title, '')
+							  FROM held_posts h LEFT JOIN posts t ON t.id = h.base_id
+							  WHERE ? OR h.authorID = ? ORDER BY h.id;`, all, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var held []HeldPost
+	for rows.Next() {
+		var h HeldPost
+		var created string
+		err := rows.Scan(&h.ID, &h.BaseID, &h.ParentID, &h.Author, &h.AuthorID, &h.Title, &h.Content,
+			&h.Categories, &h.Filter, &h.Reason, &created, &h.ThreadTitle)
+		if err != nil {
+			return nil, err
+		}
+		h.ContentHTML = markdown.Render(h.Content)
+		if h.CreatedDay, h.CreatedTime, err = timeStrings(created, prefs); err != nil {
+			fmt.Println("Error parsing held post time:", err.Error())
+		}
+		held = append(held, h)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range held {
+		held[i].Images = make(map[string]string)
+		imgRows, err := db.DB.Query(`SELECT id, original_name FROM images WHERE held_id = ?;`, held[i].ID)
+		if err != nil {
+			return nil, err
+		}
+		for imgRows.Next() {
+			var id, name string
+			if err := imgRows.Scan(&id, &name); err == nil {
+				held[i].Images["/internal/static/images/"+id] = name
+			}
+		}
+		imgRows.Close()
+	}
+	return held, nil
+}
+
+// ModerationHandler shows the moderation queue at /moderation. Moderators publish (action=approve) or remove
+// (action=reject) a held post (id=ID), which also trains the spam classifier, and resolve (action=resolve) an abuse
+// report (id=ID) once they have dealt with it. Others see their own held posts.
+func ModerationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/moderation" {
+		goToErrorPage("Page does not exist", http.StatusNotFound, w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		goToErrorPage("Method not allowed", http.StatusMethodNotAllowed, w, r)
+		return
+	}
+
+	usId, usName, validSes := ValidateSession(r)
+	if !validSes {
+		http.Redirect(w, r, "/login?return_url=/moderation", http.StatusSeeOther)
+		return
+	}
+	moderator := isModerator(usId)
+
+	if r.Method == http.MethodPost {
+		if !moderator {
+			goToErrorPage("Only moderators can do that", http.StatusForbidden, w, r)
+			return
+		}
+		id, err := strconv.Atoi(r.FormValue("id"))
+		if err != nil {
+			goToErrorPage("Invalid post ID", http.StatusBadRequest, w, r)
+			return
+		}
+		var msg string
+		var code int
+		switch r.FormValue("action") {
+		case "approve":
+			msg, code = approveHeld(id)
+		case "reject":
+			msg, code = rejectHeld(id)
+		case "resolve":
+			msg, code = resolveReport(id)
+		default:
+			msg, code = "Unknown moderation action", http.StatusBadRequest
+		}
+		if msg != "" {
+			goToErrorPage(msg, code, w, r)
+			return
+		}
+		http.Redirect(w, r, "/moderation", http.StatusSeeOther)
+		return
+	}
+
+	prefs := getUserPrefs(r, usId)
+	held, err := fetchHeldPosts(usId, moderator, prefs)
+	if err != nil {
+		fmt.Println("Fetching held posts:", err.Error())
+		goToErrorPage("Error fetching held posts", http.StatusInternalServerError, w, r)
+		return
+	}
+	var reports []reportView
+	if moderator {
+		if reports, err = fetchReports(prefs); err != nil {
+			fmt.Println("Fetching reports:", err.Error())
+			goToErrorPage("Error fetching reports", http.StatusInternalServerError, w, r)
+			return
+		}
+	}
+	data := moderationData{
+		ValidSes:     validSes,
+		UsrId:        usId,
+		UsrNm:        usName,
+		LoginURL:     "/login",
+		Lang:         prefs.Lang,
+		headerCounts: countHeader(usId),
+		Moderator:    moderator,
+		Held:         held,
+		Reports:      reports,
+	}
+	templates.Execute(w, templates.Moderation, data)
+}
+
+// fetchReports lists the open abuse reports with their times in the user's time zone
+func fetchReports(prefs userPrefs) ([]reportView, error) {
+	open, err := moderation.Open()
+	if err != nil {
+		return nil, err
+	}
+	reports := make([]reportView, len(open))
+	for i, report := range open {
+		reports[i].Report = report
+		if reports[i].CreatedDay, reports[i].CreatedTime, err = timeStrings(report.Created, prefs); err != nil {
+			fmt.Println("Error parsing report time:", err.Error())
+		}
+	}
+	return reports, nil
+}
+
+// resolveReport marks an abuse report handled, and returns what went wrong with a status code if anything
+func resolveReport(id int) (string, int) {
+	err := moderation.Resolve(int64(id))
+	if err == sql.ErrNoRows {
+		return "Report not found", http.StatusNotFound
+	}
+	if err != nil {
+		fmt.Println("Resolving report:", err.Error())
+		return "Error resolving report", http.StatusInternalServerError
+	}
+	return "", 0
+}
+
+// loadHeld reads one held post
+func loadHeld(id int) (HeldPost, error) {
+	var h HeldPost
+	var publishAt, expiresAt sql.NullString
+	err := db.DB.QueryRow(`SELECT id, base_id, parent_id, author, COALESCE(authorID, ''), title, content, categories,
+							   CASE WHEN publish_at > CURRENT_TIMESTAMP THEN strftime('%Y-%m-%d %H:%M:%S', publish_at) END,
+							   strftime('%Y-%m-%d %H:%M:%S', expires_at), expire_action
+						   FROM held_posts WHERE id = ?;`, id).
+		Scan(&h.ID, &h.BaseID, &h.ParentID, &h.Author, &h.AuthorID, &h.Title, &h.Content, &h.Categories,
+			&publishAt, &expiresAt, &h.ExpireAction)
+	h.PublishAt, h.ExpiresAt = publishAt.String, expiresAt.String // A publish time that has passed is now
+	return h, err
+}
+
+// approveHeld publishes a held post as if it had just been posted, and learns that posts like it are fine.
+// It returns what went wrong with a status code if anything.
+func approveHeld(id int) (string, int) {
+	h, err := loadHeld(id)
+	if err == sql.ErrNoRows {
+		return "Held post not found", http.StatusNotFound
+	}
+	if err != nil {
+		fmt.Println("Reading held post:", err.Error())
+		return "Error publishing post", http.StatusInternalServerError
+	}
+
+	var catIDs []int64
+	if h.BaseID == 0 {
+		var msg string
+		var code int
+		if catIDs, msg, code = parseCategories(h.Categories); msg != "" {
+			return msg, code
+		}
+	} else if msg, code := checkPostTarget(strconv.Itoa(h.ParentID), strconv.Itoa(h.BaseID), h.AuthorID); msg != "" {
+		return msg, code // The post it replied to is gone
+	}
+
+	res, err := db.DB.Exec(`INSERT INTO posts (base_id, author, authorID, title, content, parent_id, created_at, publish_at, expires_at, expire_action)
+							VALUES (?, ?, NULLIF(?, ''), ?, ?, ?, COALESCE(NULLIF(?, ''), CURRENT_TIMESTAMP), NULLIF(?, ''), NULLIF(?, ''), ?);`,
+		h.BaseID, h.Author, h.AuthorID, h.Title, h.Content, h.ParentID, h.PublishAt, h.PublishAt, h.ExpiresAt, h.ExpireAction)
+	var postID int64
+	if err == nil {
+		postID, err = res.LastInsertId()
+	}
+	if err != nil {
+		fmt.Println("Publishing held post:", err.Error())
+		return "Error publishing post", http.StatusInternalServerError
+	}
+	for _, catID := range catIDs {
+		if _, err := db.DB.Exec(`INSERT OR IGNORE INTO posts_categories (post_id, category_id) VALUES (?, ?);`, postID, catID); err != nil {
+			fmt.Println("Adding:", err.Error())
+		}
+	}
+	if _, err := db.DB.Exec(`UPDATE images SET post_id = ?, held_id = NULL WHERE held_id = ?;`, postID, id); err != nil {
+		fmt.Println("Moving held images:", err.Error())
+	}
+	if _, err := db.DB.Exec(`DELETE FROM held_posts WHERE id = ?;`, id); err != nil {
+		fmt.Println("Removing held post:", err.Error())
+	}
+
+	if h.BaseID == 0 {
+		if err := db.UpdateHotScore(db.DB, int(postID)); err != nil {
+			fmt.Println("Scoring thread:", err.Error())
+		}
+	} else {
+		publishPost(strconv.Itoa(h.BaseID), live.NewReply, postID)
+		notifyAuthorOf(strconv.Itoa(h.ParentID), h.AuthorID, h.Author, notifyReply, postID)
+	}
+	if h.PublishAt == "" {
+		saveMentions(postID, h.Content, h.AuthorID, h.Author)
+	}
+	if err := filter.Train(filter.Post{Title: h.Title, Content: h.Content}.Text(), false); err != nil {
+		fmt.Println("Training classifier:", err.Error())
+	}
+	return "", 0
+}
+
+// rejectHeld removes a held post and its images, and learns that posts like it are spam
+func rejectHeld(id int) (string, int) {
+	h, err := loadHeld(id)
+	if err == sql.ErrNoRows {
+		return "Held post not found", http.StatusNotFound
+	}
+	if err == nil {
+		_, err = db.DB.Exec(`DELETE FROM images WHERE held_id = ?;`, id) // The files go with the image cleanup
+	}
+	if err == nil {
+		_, err = db.DB.Exec(`DELETE FROM held_posts WHERE id = ?;`, id)
+	}
+	if err != nil {
+		fmt.Println("Removing held post:", err.Error())
+		return "Error removing post", http.StatusInternalServerError
+	}
+	if err := filter.Train(filter.Post{Title: h.Title, Content: h.Content}.Text(), true); err != nil {
+		fmt.Println("Training classifier:", err.Error())
+	}
+	return "", 0
+}
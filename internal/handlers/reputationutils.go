@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"forum/internal/db"
+	"net/http"
+)
+
+// Trust levels, earned with reputation and unlocking what a user can do.
+// New accounts post a few times an hour without images, trusted users also tag others' threads.
+const (
+	trustNew     = "new"
+	trustMember  = "member"
+	trustTrusted = "trusted"
+)
+
+// Reputation is the points from reactions of others, one point for each day of the account
+// and two for each thread that has stood for a week, the latter two capped
+const (
+	maxAgePoints      = 100
+	threadPoints      = 2
+	maxThreadPoints   = 100
+	memberReputation  = 10
+	trustedReputation = 200
+	newAccountDays    = 3 // Accounts are new this long whatever their reputation
+	newPostsPerHour   = 5 // Threads and replies of a new account
+)
+
+// reputation adds up a user's reputation and tells how many days old the account is
+func reputation(userID string) (points, ageDays int) {
+	var score, threads int
+	err := db.DB.QueryRow(`SELECT u.reaction_score, CAST(julianday('now') - julianday(u.created_at) AS INTEGER),
+							   (SELECT COUNT(*) FROM posts p
+								WHERE p.authorID = u.id AND p.title != '' AND p.created_at < datetime('now', '-7 days'))
+						   FROM users u WHERE u.id = ?;`, userID).Scan(&score, &ageDays, &threads)
+	if err != nil && err != sql.ErrNoRows {
+		fmt.Println("Reading reputation:", err.Error())
+	}
+	return score + min(ageDays, maxAgePoints) + min(threadPoints*threads, maxThreadPoints), ageDays
+}
+
+// trustLevel finds what a user can do from their reputation, moderators being trusted. Guests have no level.
+func trustLevel(userID string) string {
+	if userID == "" {
+		return ""
+	}
+	if isModerator(userID) {
+		return trustTrusted
+	}
+	points, ageDays := reputation(userID)
+	switch {
+	case ageDays < newAccountDays || points < memberReputation:
+		return trustNew
+	case points >= trustedReputation:
+		return trustTrusted
+	}
+	return trustMember
+}
+
+// newAccountMessage tells why a new account can't post this thread or reply: images attached.
+// The form must have been parsed. How often new accounts post is limited with the rest, see rateLimited.
+func newAccountMessage(r *http.Request, userID string) (msg string, code int) {
+	if r.MultipartForm != nil && len(r.MultipartForm.File["files"]) > 0 && trustLevel(userID) == trustNew {
+		return "New accounts can't add images yet", http.StatusForbidden
+	}
+	return "", 0
+}
+
+// canEditCategories tells if a user may change the categories of a thread: its author, trusted users and moderators
+func canEditCategories(userID, authorID string) bool {
+	return userID != "" && (userID == authorID || trustLevel(userID) == trustTrusted)
+}
@@ -0,0 +1,281 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"forum/internal/db"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// What happens to a thread when it expires
+const (
+	expireArchive = "archive" // Read-only, like after a long quiet
+	expireHide    = "hide"    // Only the author and moderators see it
+)
+
+const (
+	scheduleLayout = "2006-01-02T15:04"    // Of the datetime-local inputs, in the user's time zone
+	dbTimeLayout   = "2006-01-02 15:04:05" // Like CURRENT_TIMESTAMP, in UTC
+)
+
+// visibleThread is the condition that thread s of a list has been published and hasn't expired out of sight.
+// Its arguments, from visibleTo, let moderators see every thread and authors their own.
+const visibleThread = `(? OR s.authorID = ? OR (s.hidden = 0
+	AND (s.publish_at IS NULL OR s.publish_at <= CURRENT_TIMESTAMP)
+	AND NOT (s.expire_action = 'hide' AND s.expires_at IS NOT NULL AND s.expires_at <= CURRENT_TIMESTAMP)))`
+
+// visibleTo gives the arguments of visibleThread for a user, empty for guests
+func visibleTo(userID string) []any {
+	return []any{isModerator(userID), userID}
+}
+
+// threadVisible tells if a user can see a thread, and false when there is no such thread
+func threadVisible(threadID int, userID string) (bool, error) {
+	var visible bool
+	err := db.DB.QueryRow(`SELECT EXISTS(SELECT 1 FROM posts s WHERE s.id = ? AND s.title != '' AND `+visibleThread+`);`,
+		append([]any{threadID}, visibleTo(userID)...)...).Scan(&visible)
+	return visible, err
+}
+
+// threadSchedule tells when a thread is published and when it expires, as shown to the user
+type threadSchedule struct {
+	Scheduled    bool // Not published yet
+	Hidden       bool // Expired out of sight
+	PublishDay   string
+	PublishTime  string
+	ExpiresDay   string
+	ExpiresTime  string
+	ExpireAction string
+	PublishInput string // Values of the schedule form, in the user's time zone
+	ExpiresInput string
+}
+
+// schedule is what a new thread form or the schedule form asks, in the database's time format, empty for none
+type schedule struct {
+	PublishAt    string
+	ExpiresAt    string
+	ExpireAction string
+}
+
+// loadSchedule reads when a thread is published and expires
+func loadSchedule(th *Thread, prefs userPrefs) {
+	var publishAt, expiresAt sql.NullString
+	err := db.DB.QueryRow(`SELECT publish_at, expires_at, expire_action,
+							   COALESCE(publish_at > CURRENT_TIMESTAMP, 0),
+							   hidden OR COALESCE(expire_action = 'hide' AND expires_at <= CURRENT_TIMESTAMP, 0)
+						   FROM posts WHERE id = ?;`, th.ID).
+		Scan(&publishAt, &expiresAt, &th.ExpireAction, &th.Scheduled, &th.Hidden)
+	if err != nil {
+		fmt.Println("Reading thread schedule:", err.Error())
+		return
+	}
+	if th.Scheduled && publishAt.Valid {
+		th.PublishDay, th.PublishTime, _ = timeStrings(publishAt.String, prefs)
+		th.PublishInput = inputTime(publishAt.String, prefs)
+	}
+	if expiresAt.Valid {
+		th.ExpiresDay, th.ExpiresTime, _ = timeStrings(expiresAt.String, prefs)
+		th.ExpiresInput = inputTime(expiresAt.String, prefs)
+	}
+}
+
+// inputTime turns a time read from the database into the value of a datetime-local input
+func inputTime(stored string, prefs userPrefs) string {
+	t, err := time.Parse(time.RFC3339, stored)
+	if err != nil {
+		return ""
+	}
+	return t.In(prefs.Location).Format(scheduleLayout)
+}
+
+// parseSchedule reads the publish time, expiry and expire action of a form, the times in the user's time zone.
+// A publish time that has passed is now. It returns an error message for the first field that is wrong.
+func parseSchedule(r *http.Request, prefs userPrefs) (schedule, string) {
+	now := time.Now()
+	s := schedule{ExpireAction: r.FormValue("expire_action")}
+	if s.ExpireAction == "" {
+		s.ExpireAction = expireArchive
+	}
+	if s.ExpireAction != expireArchive && s.ExpireAction != expireHide {
+		return s, "Unknown expire action"
+	}
+
+	publish := now
+	if v := r.FormValue("publish_at"); v != "" {
+		t, err := time.ParseInLocation(scheduleLayout, v, prefs.Location)
+		if err != nil {
+			return s, "Invalid publish time"
+		}
+		if t.After(now) {
+			publish = t
+			s.PublishAt = t.UTC().Format(dbTimeLayout)
+		}
+	}
+	if v := r.FormValue("expires_at"); v != "" {
+		t, err := time.ParseInLocation(scheduleLayout, v, prefs.Location)
+		if err != nil {
+			return s, "Invalid expiry time"
+		}
+		if !t.After(publish) {
+			return s, "A thread can only expire after it is published"
+		}
+		s.ExpiresAt = t.UTC().Format(dbTimeLayout)
+	}
+	return s, ""
+}
+
+// ThreadScheduleHandler changes when a thread is published and when it expires (thread=ID, publish_at, expires_at
+// and expire_action=archive/hide). Authors can do it to their own threads and moderators to all. The publish time
+// only changes while the thread waits for it, an empty one publishing it now, and an empty expiry never expires.
+func ThreadScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/thread/schedule" {
+		goToErrorPage("Page does not exist", http.StatusNotFound, w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		goToErrorPage("Method not allowed", http.StatusMethodNotAllowed, w, r)
+		return
+	}
+
+	usId, _, validSes := ValidateSession(r)
+	if !validSes {
+		http.Redirect(w, r, "/expired", http.StatusSeeOther)
+		return
+	}
+	threadID, err := strconv.Atoi(r.FormValue("thread"))
+	if err != nil {
+		goToErrorPage("Invalid thread ID", http.StatusBadRequest, w, r)
+		return
+	}
+
+	var authorID string
+	var scheduled bool
+	err = db.DB.QueryRow(`SELECT COALESCE(authorID, ''), publish_at IS NOT NULL FROM posts WHERE id = ? AND title != '';`,
+		threadID).Scan(&authorID, &scheduled)
+	if err == sql.ErrNoRows {
+		goToErrorPage("Thread not found", http.StatusNotFound, w, r)
+		return
+	}
+	if err != nil {
+		fmt.Println("Finding thread:", err.Error())
+		goToErrorPage("Error updating thread", http.StatusInternalServerError, w, r)
+		return
+	}
+	if authorID != usId && !isModerator(usId) {
+		goToErrorPage("Only the author and moderators can do that", http.StatusForbidden, w, r)
+		return
+	}
+
+	s, msg := parseSchedule(r, getUserPrefs(r, usId))
+	if msg != "" {
+		goToErrorPage(msg, http.StatusBadRequest, w, r)
+		return
+	}
+	if !scheduled && s.PublishAt != "" {
+		goToErrorPage("The thread is published already", http.StatusBadRequest, w, r)
+		return
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		fmt.Println("Scheduling thread:", err.Error())
+		goToErrorPage("Error updating thread", http.StatusInternalServerError, w, r)
+		return
+	}
+	defer tx.Rollback()
+	if scheduled {
+		// Published when the time comes, or by the scheduler below right away
+		publish := s.PublishAt
+		if publish == "" {
+			publish = time.Now().UTC().Format(dbTimeLayout)
+		}
+		_, err = tx.Exec(`UPDATE posts SET publish_at = ?, created_at = ? WHERE id = ?;`, publish, publish, threadID)
+	}
+	if err == nil {
+		// Saving the schedule brings back a thread that expired out of sight
+		_, err = tx.Exec(`UPDATE posts SET expires_at = NULLIF(?, ''), expire_action = ?, hidden = 0 WHERE id = ?;`,
+			s.ExpiresAt, s.ExpireAction, threadID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		fmt.Println("Scheduling thread:", err.Error())
+		goToErrorPage("Error updating thread", http.StatusInternalServerError, w, r)
+		return
+	}
+	if err := db.UpdateHotScore(db.DB, threadID); err != nil {
+		fmt.Println("Scoring thread:", err.Error())
+	}
+	publishDueThreads()
+	http.Redirect(w, r, fmt.Sprintf("/thread/%d", threadID), http.StatusSeeOther)
+}
+
+// RunScheduler publishes the scheduled threads whose time has come and expires the threads whose time is up,
+// runs with dataCleanup(). Thread lists follow the times on their own, this does what publishing and expiring cause.
+func RunScheduler() {
+	publishDueThreads()
+	expireThreads()
+}
+
+// publishDueThreads publishes the scheduled threads whose time has come: they start counting for the hot order,
+// and their mentions notify
+func publishDueThreads() {
+	rows, err := db.DB.Query(`SELECT id, author, COALESCE(authorID, ''), content FROM posts
+							  WHERE publish_at IS NOT NULL AND publish_at <= CURRENT_TIMESTAMP;`)
+	if err != nil {
+		fmt.Println("Finding scheduled threads:", err.Error())
+		return
+	}
+	type dueThread struct {
+		ID                        int
+		Author, AuthorID, Content string
+	}
+	var due []dueThread
+	for rows.Next() {
+		var p dueThread
+		if err := rows.Scan(&p.ID, &p.Author, &p.AuthorID, &p.Content); err != nil {
+			fmt.Println("Reading scheduled thread:", err.Error())
+			continue
+		}
+		due = append(due, p)
+	}
+	rows.Close()
+
+	for _, p := range due {
+		// Only one publishes a thread, when a handler and the ticker find it together
+		res, err := db.DB.Exec(`UPDATE posts SET publish_at = NULL WHERE id = ? AND publish_at IS NOT NULL;`, p.ID)
+		if err != nil {
+			fmt.Println("Publishing thread:", err.Error())
+			continue
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			continue
+		}
+		if err := db.UpdateHotScore(db.DB, p.ID); err != nil {
+			fmt.Println("Scoring thread:", err.Error())
+		}
+		saveMentions(int64(p.ID), p.Content, p.AuthorID, p.Author)
+	}
+	if len(due) > 0 {
+		log.Println("Published", len(due), "scheduled threads")
+	}
+}
+
+// expireThreads archives or hides the published threads whose expiry has passed. Hidden threads are unpinned.
+func expireThreads() {
+	res, err := db.DB.Exec(`UPDATE posts SET archived = archived OR expire_action = 'archive',
+							 hidden = hidden OR expire_action = 'hide',
+							 pinned = pinned AND expire_action != 'hide', expires_at = NULL
+							 WHERE expires_at IS NOT NULL AND expires_at <= CURRENT_TIMESTAMP AND publish_at IS NULL;`)
+	if err != nil {
+		fmt.Println("Expiring threads:", err.Error())
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Println("Expired", n, "threads")
+	}
+}
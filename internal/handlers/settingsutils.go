@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"fmt"
+	"forum/internal/db"
+	"forum/internal/digest"
+	"forum/internal/i18n"
+	"forum/internal/templates"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultTimezone   = "Europe/Helsinki"
+	defaultDateFormat = "2.1.2006"
+)
+
+// dateFormats are the Go layouts users can pick from for dates
+var dateFormats = []string{"2.1.2006", "02/01/2006", "01/02/2006", "2006-01-02"}
+
+// userPrefs are the language and time settings pages are shown with
+type userPrefs struct {
+	Lang       string
+	Location   *time.Location
+	DateFormat string
+}
+
+type settingsData struct {
+	ValidSes bool
+	UsrId    string
+	UsrNm    string
+	LoginURL string
+	Lang     string
+	headerCounts
+	Message     string
+	Language    string
+	Timezone    string
+	DateFormat  string
+	Languages   map[string]string
+	DateFormats map[string]string // layout -> example date
+	Timezones   []string
+
+	NotifyReplies   bool
+	NotifyReactions bool
+	NotifyMentions  bool
+
+	Digest        string
+	Frequencies   []string
+	Subscriptions []Subscription
+
+	Reputation int
+	Trust      string
+}
+
+// commonTimezones are suggested in the settings form, any IANA zone is accepted
+var commonTimezones = []string{
+	"Europe/Helsinki", "Europe/Mariehamn", "Europe/Stockholm", "Europe/Tallinn", "Europe/London",
+	"Europe/Berlin", "Europe/Moscow", "UTC", "America/New_York", "America/Los_Angeles", "Asia/Tokyo",
+}
+
+// getUserPrefs reads the settings of a logged-in user, and negotiates the language with the browser
+func getUserPrefs(r *http.Request, userID string) userPrefs {
+	language, timezone, dateFormat := "", defaultTimezone, defaultDateFormat
+	if userID != "" {
+		err := db.DB.QueryRow(`SELECT language, timezone, date_format FROM users WHERE id = ?;`, userID).
+			Scan(&language, &timezone, &dateFormat)
+		if err != nil {
+			fmt.Println("Error reading user settings:", err.Error())
+		}
+	}
+
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		location, _ = time.LoadLocation(defaultTimezone)
+	}
+	if !validDateFormat(dateFormat) {
+		dateFormat = defaultDateFormat
+	}
+
+	return userPrefs{
+		Lang:       i18n.Negotiate(language, r.Header.Get("Accept-Language")),
+		Location:   location,
+		DateFormat: dateFormat,
+	}
+}
+
+func validDateFormat(layout string) bool {
+	for _, format := range dateFormats {
+		if layout == format {
+			return true
+		}
+	}
+	return false
+}
+
+// SettingsHandler shows and saves language and time settings of the logged-in user
+func SettingsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/settings" {
+		goToErrorPage("Page does not exist", http.StatusNotFound, w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		goToErrorPage("Method not allowed", http.StatusMethodNotAllowed, w, r)
+		return
+	}
+
+	usId, usName, validSes := ValidateSession(r)
+	if !validSes {
+		http.Redirect(w, r, "/login?return_url=/settings", http.StatusSeeOther)
+		return
+	}
+
+	data := settingsData{
+		ValidSes:    validSes,
+		UsrId:       usId,
+		UsrNm:       usName,
+		LoginURL:    "/login",
+		Languages:   i18n.Languages,
+		DateFormats: make(map[string]string),
+		Timezones:   commonTimezones,
+		Frequencies: digest.Frequencies,
+		Trust:       trustLevel(usId),
+	}
+	data.Reputation, _ = reputation(usId)
+	example := time.Date(2025, time.January, 31, 0, 0, 0, 0, time.UTC)
+	for _, layout := range dateFormats {
+		data.DateFormats[layout] = example.Format(layout)
+	}
+
+	if r.Method == http.MethodPost {
+		language, timezone, dateFormat := r.FormValue("language"), r.FormValue("timezone"), r.FormValue("date_format")
+		_, tzErr := time.LoadLocation(timezone)
+
+		switch {
+		case language != "" && !i18n.Supported(language):
+			data.Message = "Unsupported language"
+		case timezone == "" || tzErr != nil:
+			data.Message = "Unknown time zone"
+		case !validDateFormat(dateFormat):
+			data.Message = "Unsupported date format"
+		case !digest.ValidFrequency(r.FormValue("digest")):
+			data.Message = "Unsupported digest frequency"
+		default:
+			// Unchecked boxes are left out of the form. A digest turned on starts from now.
+			_, err := db.DB.Exec(`UPDATE users SET language = ?, timezone = ?, date_format = ?,
+								  notify_replies = ?, notify_reactions = ?, notify_mentions = ?,
+								  digest_sent_at = CASE WHEN digest = 'off' THEN CURRENT_TIMESTAMP ELSE digest_sent_at END,
+								  digest = ? WHERE id = ?;`,
+				language, timezone, dateFormat, r.FormValue("notify_replies") != "",
+				r.FormValue("notify_reactions") != "", r.FormValue("notify_mentions") != "", r.FormValue("digest"), usId)
+			if err != nil {
+				fmt.Println("Saving settings:", err.Error())
+				goToErrorPage("Error saving settings", http.StatusInternalServerError, w, r)
+				return
+			}
+			data.Message = "Settings saved"
+		}
+		if data.Message != "Settings saved" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}
+
+	// Show what is stored, after a possible update
+	err := db.DB.QueryRow(`SELECT language, timezone, date_format, notify_replies, notify_reactions, notify_mentions, digest
+						   FROM users WHERE id = ?;`, usId).
+		Scan(&data.Language, &data.Timezone, &data.DateFormat, &data.NotifyReplies, &data.NotifyReactions, &data.NotifyMentions,
+			&data.Digest)
+	if err != nil {
+		fmt.Println("Reading settings:", err.Error())
+	}
+	data.Lang = getUserPrefs(r, usId).Lang
+	data.headerCounts = countHeader(usId)
+	data.Subscriptions = userSubscriptions(usId)
+	data.Message = i18n.T(data.Lang, data.Message)
+
+	templates.Execute(w, templates.Settings, data)
+}
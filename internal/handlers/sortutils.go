@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"fmt"
+	"forum/internal/db"
+	"net/http"
+	"strings"
+)
+
+// Orders of thread lists
+const (
+	sortActivity = "activity" // Latest post in the thread first
+	sortNew      = "new"
+	sortTop      = "top" // Most net likes within topWindow
+	sortHot      = "hot" // Net likes weighed against age, see db.UpdateHotScore
+	sortReplies  = "replies"
+)
+
+// sortOrder is an order offered above thread lists
+type sortOrder struct {
+	Value string
+	Label string // Translated in the template
+}
+
+// sortOrders are offered in this order
+var sortOrders = []sortOrder{
+	{sortActivity, "Latest activity"},
+	{sortNew, "Newest"},
+	{sortTop, "Top"},
+	{sortHot, "Hot"},
+	{sortReplies, "Most replies"},
+}
+
+// topWindow is how far back reactions count for the top order, as an SQLite date modifier
+const topWindow = "-30 days"
+
+// threadOrders are the ORDER BY terms of each order, for a thread s
+var threadOrders = map[string]string{
+	sortActivity: `COALESCE((SELECT MAX(r.created_at) FROM posts r WHERE r.base_id = s.id), s.created_at) DESC`,
+	sortNew:      `s.created_at DESC`,
+	sortTop: `(SELECT COALESCE(SUM(CASE pr.reaction_type WHEN 'like' THEN 1 WHEN 'dislike' THEN -1 ELSE 0 END), 0)
+			   FROM post_reactions pr WHERE pr.post_id = s.id AND pr.created_at >= datetime('now', '` + topWindow + `')) DESC`,
+	sortHot:     `s.hot DESC`,
+	sortReplies: `(SELECT COUNT(*) FROM posts r WHERE r.base_id = s.id) DESC`,
+}
+
+// sortedThreads orders the threads a query selects that the viewer can see, with their reply counts. The arguments
+// of visibleTo follow those of the query. Pinned threads come first, and newer threads win ties.
+func sortedThreads(query, order string) string {
+	query = strings.TrimSuffix(strings.TrimSpace(query), ";")
+	return fmt.Sprintf(`SELECT s.id, s.author, s.title, s.content, s.created_at,
+						(SELECT COUNT(*) FROM posts r WHERE r.base_id = s.id) FROM (%s) t JOIN posts s ON s.id = t.id
+						WHERE %s ORDER BY s.pinned DESC, %s, s.id DESC;`, query, visibleThread, threadOrders[order])
+}
+
+// threadSort picks the order of a thread list: the sort parameter when there is one, otherwise the order
+// the user picked last. Logged-in users have their pick remembered.
+func threadSort(r *http.Request, userID string) string {
+	order := r.FormValue("sort")
+	if _, ok := threadOrders[order]; ok {
+		if userID != "" {
+			if _, err := db.DB.Exec(`UPDATE users SET thread_sort = ? WHERE id = ?;`, order, userID); err != nil {
+				fmt.Println("Saving thread order:", err.Error())
+			}
+		}
+		return order
+	}
+
+	if userID != "" {
+		err := db.DB.QueryRow(`SELECT thread_sort FROM users WHERE id = ?;`, userID).Scan(&order)
+		if err != nil {
+			fmt.Println("Reading thread order:", err.Error())
+		}
+		if _, ok := threadOrders[order]; ok {
+			return order
+		}
+	}
+	return sortActivity
+}
+
+// Orders of sibling replies on thread pages
+const (
+	replyOldest = "oldest"
+	replyNewest = "newest"
+	replyBest   = "best" // Most net likes
+)
+
+// replySorts are offered in this order
+var replySorts = []sortOrder{
+	{replyOldest, "Oldest"},
+	{replyNewest, "Newest"},
+	{replyBest, "Best"},
+}
+
+// replyOrders are the ORDER BY terms of each order of sibling replies, for a reply p
+var replyOrders = map[string]string{
+	replyOldest: `p.created_at, p.id`,
+	replyNewest: `p.created_at DESC, p.id DESC`,
+	replyBest: `(SELECT COALESCE(SUM(CASE pr.reaction_type WHEN 'like' THEN 1 WHEN 'dislike' THEN -1 ELSE 0 END), 0)
+				 FROM post_reactions pr WHERE pr.post_id = p.id) DESC, p.created_at, p.id`,
+}
+
+// replySort picks the order of replies from the sort parameter of a thread page, oldest first by default
+func replySort(r *http.Request) string {
+	if order := r.URL.Query().Get("sort"); replyOrders[order] != "" {
+		return order
+	}
+	return replyOldest
+}
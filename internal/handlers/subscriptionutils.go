@@ -0,0 +1,230 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"forum/internal/db"
+	"forum/internal/i18n"
+	"forum/internal/templates"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gofrs/uuid"
+)
+
+// Subscription targets
+const (
+	subscribeThread   = "thread"
+	subscribeCategory = "category"
+)
+
+// Subscription is a thread or category a user follows, listed in the settings
+type Subscription struct {
+	Type     string
+	TargetID int
+	Name     string // Thread title or category name
+}
+
+type unsubscribeData struct {
+	ValidSes bool
+	UsrId    string
+	UsrNm    string
+	LoginURL string
+	Lang     string
+	headerCounts
+	Token  string
+	Target string
+	Done   bool
+}
+
+// isSubscribed tells if a user follows a thread or category
+func isSubscribed(userID, targetType string, targetID int) bool {
+	var exists bool
+	err := db.DB.QueryRow(`SELECT EXISTS(SELECT 1 FROM subscriptions WHERE user_id = ? AND target_type = ? AND target_id = ?);`,
+		userID, targetType, targetID).Scan(&exists)
+	if err != nil {
+		fmt.Println("Checking subscription:", err.Error())
+	}
+	return exists
+}
+
+// followedCategories returns the names of the categories a user follows
+func followedCategories(userID string) map[string]bool {
+	followed := make(map[string]bool)
+	if userID == "" {
+		return followed
+	}
+	for _, sub := range userSubscriptions(userID) {
+		if sub.Type == subscribeCategory {
+			followed[sub.Name] = true
+		}
+	}
+	return followed
+}
+
+// userSubscriptions lists the threads and categories a user follows
+func userSubscriptions(userID string) []Subscription {
+	rows, err := db.DB.Query(`SELECT s.target_type, s.target_id, COALESCE(p.title, c.name)
+							  FROM subscriptions s
+							  LEFT JOIN posts p ON s.target_type = 'thread' AND p.id = s.target_id
+							  LEFT JOIN categories c ON s.target_type = 'category' AND c.id = s.target_id
+							  WHERE s.user_id = ? AND COALESCE(p.title, c.name) IS NOT NULL
+							  ORDER BY s.target_type DESC, s.id;`, userID)
+	if err != nil {
+		fmt.Println("Fetching subscriptions failed:", err.Error())
+		return nil
+	}
+	defer rows.Close()
+
+	var subs []Subscription
+	for rows.Next() {
+		var sub Subscription
+		if err := rows.Scan(&sub.Type, &sub.TargetID, &sub.Name); err != nil {
+			fmt.Println("Error reading subscription:", err.Error())
+			return subs
+		}
+		subs = append(subs, sub)
+	}
+	return subs
+}
+
+// SubscribeHandler follows or unfollows a thread (thread=ID) or a category (category=name)
+func SubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/subscribe" {
+		goToErrorPage("Page does not exist", http.StatusNotFound, w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		goToErrorPage("Method not allowed", http.StatusMethodNotAllowed, w, r)
+		return
+	}
+
+	returnURL := r.FormValue("return_url")
+	if !strings.HasPrefix(returnURL, "/") || strings.HasPrefix(returnURL, "//") {
+		returnURL = "/"
+	}
+
+	usId, _, validSes := ValidateSession(r)
+	if !validSes {
+		http.Redirect(w, r, "/login?return_url="+returnURL, http.StatusSeeOther)
+		return
+	}
+
+	var targetType string
+	var targetID int
+	var err error
+	switch {
+	case r.FormValue("thread") != "":
+		targetType = subscribeThread
+		targetID, err = strconv.Atoi(r.FormValue("thread"))
+		if err != nil {
+			goToErrorPage("Invalid thread ID", http.StatusBadRequest, w, r)
+			return
+		}
+		err = db.DB.QueryRow(`SELECT id FROM posts WHERE id = ? AND title != '';`, targetID).Scan(&targetID)
+		if err == sql.ErrNoRows {
+			goToErrorPage("Thread not found", http.StatusNotFound, w, r)
+			return
+		}
+	case r.FormValue("category") != "":
+		targetType = subscribeCategory
+		err = db.DB.QueryRow(`SELECT id FROM categories WHERE name = ?;`, r.FormValue("category")).Scan(&targetID)
+		if err == sql.ErrNoRows {
+			goToErrorPage("Category not found", http.StatusNotFound, w, r)
+			return
+		}
+	default:
+		goToErrorPage("Nothing to subscribe to", http.StatusBadRequest, w, r)
+		return
+	}
+	if err != nil {
+		fmt.Println("Finding subscription target:", err.Error())
+		goToErrorPage("Error updating subscription", http.StatusInternalServerError, w, r)
+		return
+	}
+
+	if r.FormValue("action") == "unsubscribe" {
+		_, err = db.DB.Exec(`DELETE FROM subscriptions WHERE user_id = ? AND target_type = ? AND target_id = ?;`,
+			usId, targetType, targetID)
+	} else {
+		var token uuid.UUID
+		if token, err = uuid.NewV4(); err == nil {
+			_, err = db.DB.Exec(`INSERT OR IGNORE INTO subscriptions (user_id, target_type, target_id, token) VALUES (?, ?, ?, ?);`,
+				usId, targetType, targetID, token.String())
+		}
+	}
+	if err != nil {
+		fmt.Println("Updating subscription:", err.Error())
+		goToErrorPage("Error updating subscription", http.StatusInternalServerError, w, r)
+		return
+	}
+
+	http.Redirect(w, r, returnURL, http.StatusSeeOther)
+}
+
+// UnsubscribeHandler is the one-click unsubscribe link of digest emails, working without logging in.
+// GET asks to confirm so that link scanners don't unsubscribe anyone, POST unsubscribes.
+// A subscription token ends that subscription, a digest token turns the digest off.
+func UnsubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/unsubscribe" {
+		goToErrorPage("Page does not exist", http.StatusNotFound, w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		goToErrorPage("Method not allowed", http.StatusMethodNotAllowed, w, r)
+		return
+	}
+
+	usId, usName, validSes := ValidateSession(r)
+	data := unsubscribeData{
+		ValidSes:     validSes,
+		UsrId:        usId,
+		UsrNm:        usName,
+		LoginURL:     "/login",
+		Lang:         getUserPrefs(r, usId).Lang,
+		headerCounts: countHeader(usId),
+		Token:        r.FormValue("token"),
+	}
+
+	// Find what the token is for
+	var subID int
+	var targetType, name string
+	err := db.DB.QueryRow(`SELECT s.id, s.target_type, COALESCE(p.title, c.name, '')
+						   FROM subscriptions s
+						   LEFT JOIN posts p ON s.target_type = 'thread' AND p.id = s.target_id
+						   LEFT JOIN categories c ON s.target_type = 'category' AND c.id = s.target_id
+						   WHERE s.token = ?;`, data.Token).Scan(&subID, &targetType, &name)
+	if err == sql.ErrNoRows {
+		var userID string
+		err = db.DB.QueryRow(`SELECT id FROM users WHERE digest_token = ?;`, data.Token).Scan(&userID)
+		if err == nil {
+			targetType = "digest"
+			if r.Method == http.MethodPost {
+				_, err = db.DB.Exec(`UPDATE users SET digest = 'off' WHERE id = ?;`, userID)
+			}
+		}
+	} else if err == nil && r.Method == http.MethodPost {
+		_, err = db.DB.Exec(`DELETE FROM subscriptions WHERE id = ?;`, subID)
+	}
+	if err == sql.ErrNoRows || data.Token == "" {
+		goToErrorPage("Unsubscribe link is invalid or already used", http.StatusNotFound, w, r)
+		return
+	}
+	if err != nil {
+		fmt.Println("Unsubscribing:", err.Error())
+		goToErrorPage("Error updating subscription", http.StatusInternalServerError, w, r)
+		return
+	}
+
+	switch targetType {
+	case subscribeThread:
+		data.Target = i18n.T(data.Lang, "the thread %s", name)
+	case subscribeCategory:
+		data.Target = i18n.T(data.Lang, "the category %s", name)
+	default:
+		data.Target = i18n.T(data.Lang, "digest emails")
+	}
+	data.Done = r.Method == http.MethodPost
+	templates.Execute(w, templates.Unsubscribe, data)
+}
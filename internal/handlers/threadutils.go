@@ -2,50 +2,51 @@ package handlers
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
+	"forum/internal/category"
 	"forum/internal/db"
+	"forum/internal/markdown"
+	"forum/internal/reaction"
 	"forum/internal/templates"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
-	"unicode"
 )
 
-// cleanString removes trailing and leading spaces and punctuation
-func cleanString(s string) string {
-	result := ""
-	for _, char := range strings.TrimSpace(s) {
-		if !unicode.IsPunct(char) {
-			result += string(char)
-		} else {
-			result += " "
-		}
-	}
-	return result
-}
-
-func timeStrings(created string) (string, string, error) {
+// timeStrings formats a database timestamp as day and time in the user's time zone and date format
+func timeStrings(created string, prefs userPrefs) (string, string, error) {
 	createdGoTime, err := time.Parse(time.RFC3339, created) // "created" looks something like this: 2024-12-02T15:44:52Z
 	if err != nil {
 		return "", "", err
 	}
 
-	// Convert to Finnish timezone (UTC+2)
-	location, err := time.LoadLocation("Europe/Helsinki")
-	if err != nil {
-		return "", "", err
-	}
-	createdGoTime = createdGoTime.In(location)
+	createdGoTime = createdGoTime.In(prefs.Location)
 
-	day := createdGoTime.Format("2.1.2006")
+	day := createdGoTime.Format(prefs.DateFormat)
 	time := createdGoTime.Format("15:04") //"15.04.05"
 
 	return day, time, nil
 }
 
+// errReplyNotInThread is the error of a focus on a reply that isn't in the thread
+var errReplyNotInThread = errors.New("reply not in thread")
+
+// maxReplyDepth is how deep reply trees are shown, deeper replies are behind a link that focuses on their parent
+const maxReplyDepth = 6
+
+// maxPathLength bounds the walk from a reply up to its thread
+const maxPathLength = 10000
+
+// collapseScore is the net likes at or below which a reply is shown collapsed
+const collapseScore = -5
+
+// childRepliesQuery selects the replies to a post, in an order from replyOrders
+const childRepliesQuery = `SELECT p.id, p.base_id, p.author, p.content, p.created_at FROM posts p WHERE p.parent_id = ? ORDER BY %s;`
+
 // createReplies creates a slice of Replies from database rows
-func createReplies(rows *sql.Rows, thisID int) []Reply {
+func createReplies(rows *sql.Rows, thisID int, prefs userPrefs) []Reply {
 	var err error
 	var replies []Reply
 
@@ -57,13 +58,15 @@ func createReplies(rows *sql.Rows, thisID int) []Reply {
 			return replies
 		}
 		re.ParentID, re.ContentMaxLen = thisID, contentMaxLen
+		re.ContentHTML = markdown.Render(re.Content, fetchMentions(re.ID)...)
 
-		re.CreatedDay, re.CreatedTime, err = timeStrings(re.Created)
+		re.CreatedDay, re.CreatedTime, err = timeStrings(re.Created, prefs)
 		if err != nil {
 			return replies
 		}
 
-		re.Likes, re.Dislikes = countReactions(re.ID)
+		re.reactionCounts = countReactions(re.ID)
+		re.Collapsed = re.Likes-re.Dislikes <= collapseScore
 
 		replies = append(replies, re)
 	}
@@ -71,84 +74,285 @@ func createReplies(rows *sql.Rows, thisID int) []Reply {
 	return replies
 }
 
-func recurseReplies(this *Reply) {
-	selectQueryReplies := `SELECT id, base_id, author, content, created_at FROM posts WHERE parent_id = ?;`
-	rows, err := db.DB.Query(selectQueryReplies, this.ID)
+// recurseReplies adds the replies to a reply at the given depth, down to maxReplyDepth.
+// The last level only counts its replies, for the link that continues the thread.
+func recurseReplies(this *Reply, prefs userPrefs, order string, depth int) {
+	if depth >= maxReplyDepth {
+		err := db.DB.QueryRow(`SELECT COUNT(*) FROM posts WHERE parent_id = ?;`, this.ID).Scan(&this.MoreReplies)
+		if err != nil {
+			fmt.Println("Error counting replies for reply:", err.Error())
+		}
+		return
+	}
+
+	rows, err := db.DB.Query(fmt.Sprintf(childRepliesQuery, replyOrders[order]), this.ID)
 	if err != nil {
 		fmt.Println("Error getting replies for reply:", err.Error())
 		return
 	}
 	defer rows.Close()
 
-	replies := createReplies(rows, this.ID)
+	replies := createReplies(rows, this.ID, prefs)
 
 	if len(replies) != 0 {
 		this.Replies = replies
 		for i := 0; i < len(this.Replies); i++ {
-			recurseReplies(&this.Replies[i])
+			recurseReplies(&this.Replies[i], prefs, order, depth+1)
 		}
 	}
 }
 
-func dataToThread(thread Thread) (Thread, error) {
+func dataToThread(thread Thread, prefs userPrefs) (Thread, error) {
 	var err error
-	thread.CreatedDay, thread.CreatedTime, err = timeStrings(thread.Created)
+	thread.CreatedDay, thread.CreatedTime, err = timeStrings(thread.Created, prefs)
 	if err != nil {
 		return thread, err
 	}
-	// err = json.Unmarshal([]byte(thread.Categories),
-	thread.CatsSlice = strings.Fields(thread.Categories)
-	// if err != nil {
-	// 	fmt.Println(err.Error())
-	// 	return thread, err
-	// }
+	thread.CatsSlice = fetchCategories(thread.ID)
+	thread.Categories = strings.Join(thread.CatsSlice, category.Separator+" ")
 
-	thread.Likes, thread.Dislikes = countReactions(thread.ID)
+	thread.reactionCounts = countReactions(thread.ID)
 	thread.BaseID, thread.ContentMaxLen = thread.ID, contentMaxLen
+	loadThreadState(&thread)
+	loadSchedule(&thread, prefs)
+	thread.ContentHTML = markdown.Render(thread.Content, fetchMentions(thread.ID)...)
 	return thread, nil
 }
 
-func findThread(id int) (Thread, error) {
+// findThread reads a thread with its reply tree, siblings in the given order. A focus other than 0 is the ID of
+// a reply in the thread, and the tree then starts from it.
+func findThread(id int, prefs userPrefs, order string, focus int) (Thread, error) {
 	var thread Thread
 	selectQueryThread := `SELECT id, author, title, content, created_at FROM posts WHERE id = ?;`
 	err := db.DB.QueryRow(selectQueryThread, id).Scan(&thread.ID, &thread.Author, &thread.Title, &thread.Content, &thread.Created)
 	if err != nil {
 		return thread, err
 	}
-	thread.Categories = fetchCategories(id)
+	thread, err = dataToThread(thread, prefs)
+	if err != nil {
+		return thread, err
+	}
 
-	thread, err = dataToThread(thread)
-	selectQueryReplies := `SELECT id, base_id, author, content, created_at FROM posts WHERE parent_id = ?;`
-	rows, err2 := db.DB.Query(selectQueryReplies, thread.ID)
-	if err2 != nil {
-		return thread, err2
+	if focus != 0 {
+		threadID, ancestors, err := replyPath(focus)
+		if err == sql.ErrNoRows || (err == nil && (threadID != thread.ID || focus == threadID)) {
+			return thread, errReplyNotInThread
+		}
+		if err != nil {
+			return thread, err
+		}
+		reply, err := findReply(focus, prefs)
+		if err != nil {
+			return thread, err
+		}
+		reply.Collapsed, reply.Focused = false, true // It was asked for
+		recurseReplies(&reply, prefs, order, 1)
+
+		// The replies above it are shown with just this branch
+		for i := len(ancestors) - 1; i >= 0; i-- {
+			parent, err := findReply(ancestors[i], prefs)
+			if err != nil {
+				return thread, err
+			}
+			parent.Collapsed, parent.Replies = false, []Reply{reply}
+			reply = parent
+		}
+		thread.Replies = []Reply{reply}
+		return thread, nil
+	}
+
+	rows, err := db.DB.Query(fmt.Sprintf(childRepliesQuery, replyOrders[order]), thread.ID)
+	if err != nil {
+		return thread, err
 	}
 	defer rows.Close()
 
-	replies := createReplies(rows, thread.ID)
+	replies := createReplies(rows, thread.ID, prefs)
 
 	// Add replies to replies recursively
 	for i := 0; i < len(replies); i++ {
-		recurseReplies(&(replies[i]))
+		recurseReplies(&(replies[i]), prefs, order, 1)
 	}
 
 	thread.Replies = replies
-	return thread, err
+	return thread, nil
 }
 
-// markValidity writes to each reply if the session is valid, to show reply button or not
-func markValidity(rep *Reply, valid bool, reactMap map[int]reaction) {
-	rep.ValidSes = valid
+// replyPath finds the thread a post is in, and the replies between the thread and the post from the top down.
+// A thread is in itself, with nothing between.
+func replyPath(id int) (int, []int, error) {
+	var threadID, parentID int
+	var title string
+	err := db.DB.QueryRow(`SELECT base_id, parent_id, title FROM posts WHERE id = ?;`, id).Scan(&threadID, &parentID, &title)
+	if err != nil || title != "" {
+		return id, nil, err
+	}
 
-	if reactMap[rep.ID].opinion == "like" {
-		rep.LikedNow = true
+	var ancestors []int
+	for parentID != threadID {
+		if len(ancestors) > maxPathLength { // Only a damaged database loops
+			return 0, nil, fmt.Errorf("reply %d has no path to its thread", id)
+		}
+		ancestors = append([]int{parentID}, ancestors...)
+		if err := db.DB.QueryRow(`SELECT parent_id FROM posts WHERE id = ? AND title = '';`, parentID).Scan(&parentID); err != nil {
+			return 0, nil, err
+		}
 	}
-	if reactMap[rep.ID].opinion == "dislike" {
-		rep.DislikedNow = true
+	return threadID, ancestors, nil
+}
+
+// threadOf finds the thread a post is in, the post itself for a thread
+func threadOf(postID int) (int, error) {
+	var root int
+	err := db.DB.QueryRow(`SELECT CASE WHEN base_id = 0 THEN id ELSE base_id END FROM posts WHERE id = ?;`, postID).Scan(&root)
+	return root, err
+}
+
+// checkPostTarget checks the post and thread IDs of a reply or reaction form of a user: the post must exist, the thread
+// must be the one the post is in, and the user must see the thread. It returns an error message and status for the
+// first check that fails.
+func checkPostTarget(postID, threadID, userID string) (string, int) {
+	post, err := strconv.Atoi(postID)
+	if err != nil {
+		return "Invalid post ID", http.StatusBadRequest
+	}
+	thread, err := strconv.Atoi(threadID)
+	if err != nil {
+		return "Invalid thread ID", http.StatusBadRequest
 	}
 
+	root, err := threadOf(post)
+	switch {
+	case err == sql.ErrNoRows:
+		return "Post not found", http.StatusNotFound
+	case err != nil:
+		fmt.Println("Checking post:", err.Error())
+		return "Error finding post", http.StatusInternalServerError
+	case root != thread:
+		return "The post is not in that thread", http.StatusBadRequest
+	}
+	visible, err := threadVisible(thread, userID)
+	if err != nil {
+		fmt.Println("Checking post:", err.Error())
+		return "Error finding post", http.StatusInternalServerError
+	}
+	if !visible { // Scheduled or hidden, as if it wasn't there
+		return "Post not found", http.StatusNotFound
+	}
+	return "", 0
+}
+
+// postURL is where a post is shown: the thread page at the post, or a focused view when the post is deeper than the thread page shows
+func postURL(id int) (string, error) {
+	threadID, ancestors, err := replyPath(id)
+	switch {
+	case err != nil:
+		return "", err
+	case threadID == id:
+		return fmt.Sprintf("/thread/%d", id), nil
+	case len(ancestors) < maxReplyDepth:
+		return fmt.Sprintf("/thread/%d#post-%d", threadID, id), nil
+	}
+	return fmt.Sprintf("/thread/%d?focus=%d#post-%d", threadID, id, id), nil
+}
+
+// redirectToPost sends the browser to a post after it was added or reacted to, or to the thread top if the post can't be found
+func redirectToPost(w http.ResponseWriter, r *http.Request, postID int, threadID string) {
+	url, err := postURL(postID)
+	if err != nil {
+		fmt.Println("Finding post:", err.Error())
+		url = "/thread/" + threadID
+	}
+	http.Redirect(w, r, url, http.StatusSeeOther)
+}
+
+// PostHandler is the permalink of a post at /post/{id}, redirecting to where the post is shown
+func PostHandler(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, "/post/") {
+		goToErrorPage("Page does not exist", http.StatusNotFound, w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		goToErrorPage("Method not allowed", http.StatusMethodNotAllowed, w, r)
+		return
+	}
+
+	id, err := strconv.Atoi(r.URL.Path[len("/post/"):])
+	if err != nil {
+		goToErrorPage("Invalid post ID", http.StatusBadRequest, w, r)
+		return
+	}
+	usId, _, _ := ValidateSession(r)
+	threadID, err := threadOf(id)
+	if err == nil {
+		var visible bool
+		if visible, err = threadVisible(threadID, usId); err == nil && !visible {
+			err = sql.ErrNoRows // Scheduled or hidden, as if it wasn't there
+		}
+	}
+	url := ""
+	if err == nil {
+		url, err = postURL(id)
+	}
+	if err == sql.ErrNoRows {
+		goToErrorPage("Post not found", http.StatusNotFound, w, r)
+		return
+	}
+	if err != nil {
+		fmt.Println("Finding post:", err.Error())
+		goToErrorPage("Error finding post", http.StatusInternalServerError, w, r)
+		return
+	}
+	http.Redirect(w, r, url, http.StatusFound)
+}
+
+// markValidity writes to each reply if the session is valid, to show reply button or not, and the page language
+func markValidity(rep *Reply, valid bool, given map[int]map[string]bool, lang string) {
+	rep.ValidSes, rep.Lang = valid, lang
+	rep.LikedNow, rep.DislikedNow = markGiven(&rep.reactionCounts, given[rep.ID])
+
+	for i := range rep.Replies {
+		markValidity(&rep.Replies[i], valid, given, lang)
+	}
+}
+
+// markGiven marks the emoji reactions the viewer has given on a post, and tells if they like or dislike it
+func markGiven(counts *reactionCounts, given map[string]bool) (bool, bool) {
+	for i := range counts.Emoji {
+		counts.Emoji[i].Mine = given[counts.Emoji[i].Name]
+	}
+	return given[reaction.Like], given[reaction.Dislike]
+}
+
+// givenReactions lists the reactions a user has given, by post
+func givenReactions(userID string) (map[int]map[string]bool, error) {
+	given := make(map[int]map[string]bool)
+	rows, err := db.DB.Query(`SELECT post_id, reaction_type FROM post_reactions WHERE user_id = ?;`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var postID int
+		var kind string
+		if err := rows.Scan(&postID, &kind); err != nil {
+			return nil, err
+		}
+		if given[postID] == nil {
+			given[postID] = make(map[string]bool)
+		}
+		given[postID][kind] = true
+	}
+	return given, rows.Err()
+}
+
+// attachImages gives each reply in the tree the images uploaded with it
+func attachImages(rep *Reply, images map[int]map[string]string) {
+	rep.Images = images[rep.ID]
+
 	for i := range rep.Replies {
-		markValidity(&rep.Replies[i], valid, reactMap)
+		attachImages(&rep.Replies[i], images)
 	}
 }
 
@@ -174,57 +378,61 @@ func ThreadPageHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	thread, err := findThread(threadID)
+	focus := 0
+	if f := r.URL.Query().Get("focus"); f != "" {
+		if focus, err = strconv.Atoi(f); err != nil {
+			goToErrorPage("Invalid reply ID", http.StatusBadRequest, w, r)
+			return
+		}
+	}
+
+	usId, usName, validSes := ValidateSession(r)
+	prefs := getUserPrefs(r, usId)
+	order := replySort(r)
+
+	thread, err := findThread(threadID, prefs, order, focus)
+	if err == errReplyNotInThread {
+		goToErrorPage("Reply not found", http.StatusNotFound, w, r)
+		return
+	}
 	if err != nil {
 		fmt.Println("Find thread error:", err.Error())
 		goToErrorPage("Thread not found", http.StatusNotFound, w, r)
 		return
 	}
-	// Get linked images for the thread
-	images, err := getThreadImageURL(threadID)
+	// Until it is published and after it expires out of sight, only the author and moderators see it
+	if (thread.Scheduled || thread.Hidden) && usId != thread.AuthorID && !isModerator(usId) {
+		goToErrorPage("Thread not found", http.StatusNotFound, w, r)
+		return
+	}
+	// Get linked images for the thread and its replies
+	images, err := getThreadImageURLs(threadID)
 	if err != nil {
 		fmt.Println("Error finding images:", err.Error())
 		goToErrorPage("Error loading images", http.StatusInternalServerError, w, r)
 		return
 	}
 
-	usId, usName, validSes := ValidateSession(r)
-
-	// List liked and disliked posts. Only to colour the buttons.
-	selectQueryReplies := `SELECT post_id, reaction_type FROM post_reactions WHERE user_id = ?;`
-	rows, err2 := db.DB.Query(selectQueryReplies, usId)
-	if err2 != nil {
-		fmt.Println("Error querying reactions:", err2.Error())
+	// List the reactions the user has given. Only to colour the buttons.
+	given, err := givenReactions(usId)
+	if err != nil {
+		fmt.Println("Error querying reactions:", err.Error())
+		goToErrorPage("Error fetching reactions", http.StatusInternalServerError, w, r)
 		return
 	}
 
-	reactionMap := make(map[int]reaction)
-	for rows.Next() {
-		postID := 0
-		opinion := ""
-
-		err2 := rows.Scan(&postID, &opinion)
-		if err2 != nil {
-			fmt.Println("Error reading reaction rows:", err2.Error())
-			return
-		}
-
-		reactionMap[postID] = reaction{usId, opinion}
-	}
-
+	// Replies of closed threads show no buttons, like to guests
 	for i := range thread.Replies {
-		markValidity(&thread.Replies[i], validSes, reactionMap)
+		markValidity(&thread.Replies[i], validSes && !thread.Closed(), given, prefs.Lang)
+		attachImages(&thread.Replies[i], images)
 	}
 
 	// Markers for coloring the thread buttons too
-	if reactionMap[thread.ID].opinion == "like" {
-		thread.LikedNow = true
-	}
-	if reactionMap[thread.ID].opinion == "dislike" {
-		thread.DislikedNow = true
-	}
+	thread.LikedNow, thread.DislikedNow = markGiven(&thread.reactionCounts, given[thread.ID])
 
 	loginUrl := "/login?return_url=" + r.URL.Path
-	tpd := threadPageData{thread, validSes, usId, usName, loginUrl, images}
-	templates.ThreadTmpl.Execute(w, tpd)
+	tpd := threadPageData{thread, validSes, usId, usName, loginUrl, images[thread.ID], prefs.Lang, countHeader(usId),
+		isSubscribed(usId, subscribeThread, thread.ID), isModerator(usId), order, replySorts, focus,
+		canEditCategories(usId, thread.AuthorID)}
+	templates.Execute(w, templates.Thread, tpd)
 }
@@ -0,0 +1,318 @@
+package i18n
+
+// fi is the Finnish catalog
+var fi = map[string]string{
+	// Header and footer
+	"where grit:labbers hang out and talk about their hobbies": "missä grit:labilaiset hengailevat ja juttelevat harrastuksistaan",
+	"Logged in as %s.": "Kirjautuneena: %s.",
+	"Not logged in.":   "Et ole kirjautunut.",
+	"Settings":         "Asetukset",
+	"Notifications":    "Ilmoitukset",
+	"Moderation queue": "Moderointijono",
+
+	// Front page
+	"Top 10 categories":               "Suosituimmat kategoriat",
+	"Show filter":                     "Näytä suodatin",
+	"Hide filter":                     "Piilota suodatin",
+	"Start a new thread":              "Aloita uusi ketju",
+	"Thread title":                    "Ketjun otsikko",
+	"Message":                         "Viesti",
+	"Choose category":                 "Valitse kategoria",
+	"Categories, separated by commas": "Kategoriat pilkuin eroteltuina",
+	"Add Image":                       "Lisää kuva",
+	"Start thread":                    "Aloita ketju",
+	"Clear all":                       "Tyhjennä kaikki",
+	"Log in":                          "Kirjaudu sisään",
+	"or":                              "tai",
+	"register":                        "rekisteröidy",
+	"to start posting!":               "aloittaaksesi kirjoittamisen!",
+	"Filter threads":                  "Suodata ketjuja",
+	"Categories to search, separated by commas": "Haettavat kategoriat pilkuin eroteltuina",
+	"Match any":       "Mikä tahansa",
+	"Match all":       "Kaikki",
+	"Search":          "Hae",
+	"All":             "Kaikki",
+	"Created by me":   "Omat ketjut",
+	"Liked by me":     "Tykkäämäni",
+	"Disliked by me":  "Ei-tykkäämäni",
+	"Show selection":  "Näytä valinta",
+	"Reset filter":    "Tyhjennä suodatin",
+	"posted on":       "kirjoitti",
+	"Sort by":         "Järjestys",
+	"Latest activity": "Viimeisin toiminta",
+	"Newest":          "Uusimmat",
+	"Top":             "Suosituimmat",
+	"Hot":             "Kuumat",
+	"Most replies":    "Eniten vastauksia",
+	"Session expired": "Istunto vanhentui",
+	"Session expired. Log in again and what you wrote is waiting as a draft.": "Istunto vanhentui. Kirjaudu uudelleen, niin kirjoittamasi odottaa luonnoksena.",
+	"Threads by %s": "Käyttäjän %s ketjut",
+	"Show all":      "Näytä kaikki",
+
+	// Thread page
+	"Like":                        "Tykkää",
+	"+1":                          "+1",
+	"Funny":                       "Hauska",
+	"Love":                        "Ihana",
+	"Insightful":                  "Oivaltava",
+	"Thanks":                      "Kiitos",
+	"Wow":                         "Vau",
+	"Edit categories":             "Muokkaa kategorioita",
+	"Dislike":                     "En tykkää",
+	"Add a reply":                 "Lisää vastaus",
+	"Reply":                       "Vastaa",
+	"Oldest":                      "Vanhimmat",
+	"Best":                        "Parhaat",
+	"collapsed for many dislikes": "piilotettu monen ei-tykkäyksen takia",
+	"Continue this thread":        "Jatka ketjua",
+	"You are reading one part of this thread.": "Luet yhtä osaa tästä ketjusta.",
+	"Show all replies":                         "Näytä kaikki vastaukset",
+	"Invalid reply ID":                         "Virheellinen vastauksen tunniste",
+	"Reply not found":                          "Vastausta ei löytynyt",
+	"Link to this reply":                       "Linkki tähän vastaukseen",
+	"Invalid post ID":                          "Virheellinen viestin tunniste",
+	"Post not found":                           "Viestiä ei löytynyt",
+	"Error finding post":                       "Virhe viestin haussa",
+	"The post is not in that thread":           "Viesti ei ole siinä ketjussa",
+	"Submit reply":                             "Lähetä vastaus",
+	"Clear":                                    "Tyhjennä",
+	"to join the conversation":                 "osallistuaksesi keskusteluun",
+	"Pinned":                                   "Kiinnitetty",
+	"Locked":                                   "Lukittu",
+	"Archived":                                 "Arkistoitu",
+	"Pin":                                      "Kiinnitä",
+	"Unpin":                                    "Irrota",
+	"Lock":                                     "Lukitse",
+	"Unlock":                                   "Avaa lukitus",
+	"Archive":                                  "Arkistoi",
+	"Unarchive":                                "Palauta arkistosta",
+	"This thread is locked. It takes no new replies or reactions.":                  "Tämä ketju on lukittu. Siihen ei voi enää vastata eikä reagoida.",
+	"This thread is archived. It can be read, but no longer replied or reacted to.": "Tämä ketju on arkistoitu. Sitä voi lukea, mutta siihen ei voi enää vastata eikä reagoida.",
+	"Scheduled":             "Ajastettu",
+	"Hidden":                "Piilotettu",
+	"Schedule":              "Ajastus",
+	"Publish at":            "Julkaisuaika",
+	"Expires at":            "Vanhenee",
+	"Then archive it":       "Arkistoi silloin",
+	"Then hide it":          "Piilota silloin",
+	"Published on %s at %s": "Julkaistaan %s klo %s",
+	"Archived on %s at %s":  "Arkistoidaan %s klo %s",
+	"Hidden on %s at %s":    "Piilotetaan %s klo %s",
+	"This thread isn't published yet. It takes replies and reactions once it is.": "Tätä ketjua ei ole vielä julkaistu. Siihen voi vastata ja reagoida julkaisun jälkeen.",
+	"This thread has expired. It takes no new replies or reactions.":              "Tämä ketju on vanhentunut. Siihen ei voi enää vastata eikä reagoida.",
+
+	// Categories
+	"Categories":     "Kategoriat",
+	"Subcategories":  "Alakategoriat",
+	"No threads yet": "Ei vielä ketjuja",
+	"Only admins create categories, new threads pick from this list.":                               "Vain ylläpitäjät luovat kategorioita, uudet ketjut valitsevat tästä listasta.",
+	"New categories are made when threads are started. Unused ones are removed unless edited here.": "Uudet kategoriat syntyvät ketjujen mukana. Käyttämättömät poistetaan, ellei niitä ole muokattu täällä.",
+	"New category":  "Uusi kategoria",
+	"Name":          "Nimi",
+	"Colour":        "Väri",
+	"No parent":     "Ei yläkategoriaa",
+	"Description":   "Kuvaus",
+	"Create":        "Luo",
+	"%d threads":    "%d ketjua",
+	"New name":      "Uusi nimi",
+	"Rename":        "Nimeä uudelleen",
+	"Alias":         "Vaihtoehtoinen nimi",
+	"Add alias":     "Lisää vaihtoehtoinen nimi",
+	"Aliases:":      "Vaihtoehtoiset nimet:",
+	"Remove alias":  "Poista vaihtoehtoinen nimi",
+	"Merge into":    "Yhdistä kategoriaan",
+	"Merge":         "Yhdistä",
+	"Also known as": "Tunnetaan myös nimillä",
+
+	// Login and registration
+	"Log in with your username or email":      "Kirjaudu käyttäjänimellä tai sähköpostilla",
+	"Username or Email:":                      "Käyttäjänimi tai sähköposti:",
+	"Username:":                               "Käyttäjänimi:",
+	"Email:":                                  "Sähköposti:",
+	"Password:":                               "Salasana:",
+	"Login":                                   "Kirjaudu",
+	"Don't have an account?":                  "Eikö sinulla ole tiliä?",
+	"Register":                                "Rekisteröidy",
+	"Register new user":                       "Rekisteröi uusi käyttäjä",
+	"Already have an account?":                "Onko sinulla jo tili?",
+	"Invalid username/email or password":      "Virheellinen käyttäjänimi, sähköposti tai salasana",
+	"Logged in as %s. Log out first.":         "Kirjautuneena: %s. Kirjaudu ensin ulos.",
+	"Already logged in as %s. Log out first.": "Olet jo kirjautunut käyttäjänä %s. Kirjaudu ensin ulos.",
+	"5-25 characters in username and password. Only letters, numbers and symbols allowed.": "Käyttäjänimessä ja salasanassa 5–25 merkkiä. Vain kirjaimet, numerot ja symbolit sallittu.",
+	"Invalid email address": "Virheellinen sähköpostiosoite",
+	"Name already taken":    "Nimi on jo käytössä",
+	"Email already taken":   "Sähköposti on jo käytössä",
+
+	// Settings
+	"Language":                "Kieli",
+	"Automatic":               "Automaattinen",
+	"Time zone":               "Aikavyöhyke",
+	"Date format":             "Päivämäärän muoto",
+	"Save":                    "Tallenna",
+	"Reputation":              "Maine",
+	"Trust level":             "Luottamustaso",
+	"new":                     "uusi",
+	"member":                  "jäsen",
+	"trusted":                 "luotettu",
+	"Settings saved":          "Asetukset tallennettu",
+	"Unsupported language":    "Kieltä ei tueta",
+	"Unknown time zone":       "Tuntematon aikavyöhyke",
+	"Unsupported date format": "Päivämäärän muotoa ei tueta",
+	"Error saving settings":   "Virhe asetusten tallentamisessa",
+	"Notify me when someone":  "Ilmoita minulle, kun joku",
+	"replies to my posts":     "vastaa viesteihini",
+	"reacts to my posts":      "reagoi viesteihini",
+	"mentions me":             "mainitsee minut",
+
+	// Notifications
+	"Mark all read":           "Merkitse kaikki luetuiksi",
+	"Mark read":               "Merkitse luetuksi",
+	"%s replied to your post": "%s vastasi viestiisi",
+	"%s reacted to your post": "%s reagoi viestiisi",
+	"%s mentioned you":        "%s mainitsi sinut",
+	"in":                      "ketjussa",
+	"No notifications yet":    "Ei vielä ilmoituksia",
+
+	// Subscriptions and digests
+	"Subscribe":         "Tilaa",
+	"Unsubscribe":       "Peru tilaus",
+	"Follow categories": "Seuraa kategorioita",
+	"Browse categories": "Selaa kategorioita",
+	"Subscriptions":     "Tilaukset",
+	"You don't follow any threads or categories yet.": "Et seuraa vielä ketjuja tai kategorioita.",
+	"Email digest of what I follow":                   "Sähköpostikooste seuraamistani",
+	"off":                                             "ei koostetta",
+	"daily":                                           "päivittäin",
+	"weekly":                                          "viikoittain",
+	"the thread %s":                                   "ketjusta %s",
+	"the category %s":                                 "kategoriasta %s",
+	"digest emails":                                   "koosteista",
+	"Stop getting email about %s?":                    "Lopetetaanko sähköpostit %s?",
+	"You won't get email about %s anymore.":           "Et saa enää sähköpostia %s.",
+	"Hi %s,":                                          "Hei %s,",
+	"New replies in threads you follow:":              "Uusia vastauksia seuraamissasi ketjuissa:",
+	"%d new":                                          "%d uutta",
+	"New threads in %s:":                              "Uusia ketjuja kategoriassa %s:",
+	"Unsubscribe:":                                    "Peru tilaus:",
+	"Stop these emails:":                              "Lopeta nämä sähköpostit:",
+	"Your daily digest":                               "Päivän kooste",
+	"Your weekly digest":                              "Viikon kooste",
+
+	// Moderation queue
+	"Posts waiting for review":                                       "Tarkistusta odottavat viestit",
+	"These posts are published once a moderator has looked at them.": "Nämä viestit julkaistaan, kun moderaattori on katsonut ne.",
+	"started a thread":                                               "aloitti ketjun",
+	"replied in":                                                     "vastasi ketjussa",
+	"Publish":                                                        "Julkaise",
+	"Remove as spam":                                                 "Poista roskapostina",
+	"Nothing is waiting for review":                                  "Mikään ei odota tarkistusta",
+	"Reports":                                                        "Ilmiannot",
+	"reported a message of":                                          "ilmiantoi viestin käyttäjältä",
+	"Resolve":                                                        "Merkitse käsitellyksi",
+	"No open reports":                                                "Ei avoimia ilmiantoja",
+
+	// Private messages
+	"Messages":                          "Viestit",
+	"New message":                       "Uusi viesti",
+	"To: usernames separated by commas": "Vastaanottajat pilkuilla erotettuina",
+	"Subject":                           "Aihe",
+	"Send":                              "Lähetä",
+	"No messages yet":                   "Ei vielä viestejä",
+	"Members":                           "Osallistujat",
+	"Block":                             "Estä",
+	"Unblock":                           "Poista esto",
+	"Blocked users":                     "Estetyt käyttäjät",
+	"Report":                            "Ilmianna",
+	"Send report":                       "Lähetä ilmianto",
+	"What is wrong with this message?":  "Mikä tässä viestissä on vialla?",
+	"Thank you, moderators will look into the report": "Kiitos, moderaattorit tutkivat ilmiannon",
+	"Add at least one recipient":                      "Lisää vähintään yksi vastaanottaja",
+	"Too many recipients":                             "Liikaa vastaanottajia",
+	"Unknown recipient":                               "Tuntematon vastaanottaja",
+	"You can't send messages to a user who has blocked you or whom you have blocked": "Et voi lähettää viestejä käyttäjälle, joka on estänyt sinut tai jonka olet estänyt",
+
+	// Errors
+	"ERROR": "VIRHE",
+	"In the meantime, please enjoy this comic from":                   "Sillä välin, nauti tästä sarjakuvasta:",
+	"Page does not exist":                                             "Sivua ei ole olemassa",
+	"Method not allowed":                                              "Metodi ei ole sallittu",
+	"Error fetching threads":                                          "Virhe ketjujen haussa",
+	"Error fetching replies":                                          "Virhe vastausten haussa",
+	"Request size too large":                                          "Pyyntö on liian suuri",
+	"Bad request, input length not supported":                         "Virheellinen pyyntö, syötteen pituutta ei tueta",
+	"Error adding thread":                                             "Virhe ketjun lisäämisessä",
+	"Error adding categories":                                         "Virhe kategorioiden lisäämisessä",
+	"Error adding posts-categories relations":                         "Virhe kategorioiden liittämisessä",
+	"I'm a teapot. I refuse to brew coffee!":                          "Olen teekannu. Kieltäydyn keittämästä kahvia!",
+	"Error adding reply":                                              "Virhe vastauksen lisäämisessä",
+	"Error adding reaction":                                           "Virhe reaktion lisäämisessä",
+	"Error fetching reactions":                                        "Virhe reaktioiden haussa",
+	"Unknown reaction":                                                "Tuntematon reaktio",
+	"New accounts can't add images yet":                               "Uudet tilit eivät voi vielä lisätä kuvia",
+	"New accounts can post a few times an hour, try again later":      "Uudet tilit voivat julkaista muutaman kerran tunnissa, yritä myöhemmin uudelleen",
+	"You're doing that too often, try again in a moment":              "Teet tätä liian usein, yritä hetken päästä uudelleen",
+	"Only trusted users can change the categories of others' threads": "Vain luotetut käyttäjät voivat muuttaa muiden ketjujen kategorioita",
+	"Error updating categories":                                       "Virhe kategorioiden päivittämisessä",
+	"Unknown expire action":                                           "Tuntematon vanhenemistoiminto",
+	"Invalid publish time":                                            "Virheellinen julkaisuaika",
+	"Invalid expiry time":                                             "Virheellinen vanhenemisaika",
+	"A thread can only expire after it is published":                  "Ketju voi vanhentua vasta julkaisunsa jälkeen",
+	"The thread is published already":                                 "Ketju on jo julkaistu",
+	"Only the author and moderators can do that":                      "Vain kirjoittaja ja moderaattorit voivat tehdä sen",
+	"Error generating Id for user":                                    "Virhe käyttäjätunnisteen luomisessa",
+	"Error adding user":                                               "Virhe käyttäjän lisäämisessä",
+	"No session found":                                                "Istuntoa ei löytynyt",
+	"Failed to log out":                                               "Uloskirjautuminen epäonnistui",
+	"Invalid thread ID":                                               "Virheellinen ketjun tunniste",
+	"Thread not found":                                                "Ketjua ei löytynyt",
+	"Error loading images":                                            "Virhe kuvien lataamisessa",
+	"Error parsing date":                                              "Virhe päivämäärän käsittelyssä",
+	"Failed to delete old session":                                    "Vanhan istunnon poistaminen epäonnistui",
+	"Files size is too big":                                           "Tiedostot ovat liian suuria",
+	"File cannot be opened.":                                          "Tiedostoa ei voi avata.",
+	"Invalid file type.":                                              "Virheellinen tiedostotyyppi.",
+	"Error fetching notifications":                                    "Virhe ilmoitusten haussa",
+	"Error updating notifications":                                    "Virhe ilmoitusten päivityksessä",
+	"Invalid notification ID":                                         "Virheellinen ilmoituksen tunniste",
+	"Notification not found":                                          "Ilmoitusta ei löytynyt",
+	"Category not found":                                              "Kategoriaa ei löytynyt",
+	"Nothing to subscribe to":                                         "Ei mitään tilattavaa",
+	"Error updating subscription":                                     "Virhe tilauksen päivityksessä",
+	"Unsubscribe link is invalid or already used":                     "Tilauksen perumislinkki on virheellinen tai jo käytetty",
+	"Unsupported digest frequency":                                    "Koosteen tiheyttä ei tueta",
+	"Error fetching messages":                                         "Virhe viestien haussa",
+	"Error sending message":                                           "Virhe viestin lähettämisessä",
+	"Invalid conversation ID":                                         "Virheellinen keskustelun tunniste",
+	"Conversation not found":                                          "Keskustelua ei löytynyt",
+	"User not found":                                                  "Käyttäjää ei löytynyt",
+	"Error updating block":                                            "Virhe eston päivityksessä",
+	"Invalid message ID":                                              "Virheellinen viestin tunniste",
+	"Message not found":                                               "Viestiä ei löytynyt",
+	"Error reporting message":                                         "Virhe viestin ilmiannossa",
+	"Unknown thread action":                                           "Tuntematon ketjun toiminto",
+	"Only moderators can do that":                                     "Vain moderaattorit voivat tehdä sen",
+	"Your post has words that aren't allowed here":                    "Viestissäsi on sanoja, jotka eivät ole täällä sallittuja",
+	"Error adding post":                                               "Virhe viestin lisäämisessä",
+	"Unknown moderation action":                                       "Tuntematon moderointitoiminto",
+	"Held post not found":                                             "Odottavaa viestiä ei löytynyt",
+	"Error publishing post":                                           "Virhe viestin julkaisussa",
+	"Error removing post":                                             "Virhe viestin poistamisessa",
+	"Error fetching held posts":                                       "Virhe odottavien viestien haussa",
+	"Report not found":                                                "Ilmiantoa ei löytynyt",
+	"Error resolving report":                                          "Virhe ilmiannon käsittelyssä",
+	"Error fetching reports":                                          "Virhe ilmiantojen haussa",
+	"Error updating thread":                                           "Virhe ketjun päivityksessä",
+	"Only admins can do that":                                         "Vain ylläpitäjät voivat tehdä sen",
+	"Choose categories from the list":                                 "Valitse kategoriat listasta",
+	"Error fetching categories":                                       "Virhe kategorioiden haussa",
+	"Error updating category":                                         "Virhe kategorian päivityksessä",
+	"Unknown category action":                                         "Tuntematon kategorian toiminto",
+	"Colours are written like #1a2b3c":                                "Värit kirjoitetaan muodossa #1a2b3c",
+	"Add at least one category":                                       "Lisää vähintään yksi kategoria",
+	"Category names can be at most 50 characters long":                "Kategorian nimessä voi olla enintään 50 merkkiä",
+	"A thread can have at most 10 categories":                         "Ketjulla voi olla enintään 10 kategoriaa",
+	"Category names can have letters, digits, spaces and the characters + # . - _ &": "Kategorian nimessä voi olla kirjaimia, numeroita, välilyöntejä ja merkit + # . - _ &",
+	"A category can't be under itself":                                               "Kategoria ei voi olla itsensä alla",
+	"A category can't be merged into itself":                                         "Kategoriaa ei voi yhdistää itseensä",
+	"That name is already a category or an alias":                                    "Nimi on jo kategoria tai vaihtoehtoinen nimi",
+}
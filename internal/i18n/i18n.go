@@ -0,0 +1,76 @@
+package i18n
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Default is the language used when nothing else matches
+const Default = "en"
+
+// Languages lists the supported languages by code, with their names in that language
+var Languages = map[string]string{
+	"en": "English",
+	"fi": "Suomi",
+}
+
+// catalogs map English messages to their translations. English needs no catalog, the keys are the messages.
+var catalogs = map[string]map[string]string{
+	"fi": fi,
+}
+
+// T translates a message to lang, formatting it with args if given. Unknown messages are returned untranslated.
+func T(lang, msg string, args ...any) string {
+	if translated, ok := catalogs[lang][msg]; ok {
+		msg = translated
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(msg, args...)
+	}
+	return msg
+}
+
+// Supported tells if lang has a catalog or is the default
+func Supported(lang string) bool {
+	_, ok := Languages[lang]
+	return ok
+}
+
+// Negotiate picks the language: the user's own setting first, then the best match in an Accept-Language header
+func Negotiate(userLang, acceptLanguage string) string {
+	if Supported(userLang) {
+		return userLang
+	}
+
+	type candidate struct {
+		lang string
+		q    float64
+	}
+	var candidates []candidate
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		lang := strings.ToLower(strings.TrimSpace(fields[0]))
+		if i := strings.IndexByte(lang, '-'); i > 0 {
+			lang = lang[:i] // fi-FI matches fi
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			if value, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		if Supported(lang) && q > 0 {
+			candidates = append(candidates, candidate{lang, q})
+		}
+	}
+	if len(candidates) == 0 {
+		return Default
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].q > candidates[j].q })
+	return candidates[0].lang
+}
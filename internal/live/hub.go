@@ -0,0 +1,133 @@
+package live
+
+import (
+	"errors"
+	"sync"
+)
+
+// Event types sent to thread pages
+const (
+	NewReply  = "reply"
+	Reactions = "reactions"
+)
+
+var (
+	ErrTooManyConnections = errors.New("too many live connections")
+	ErrClosed             = errors.New("live updates are shut down")
+)
+
+// Event tells subscribers of a thread that one of its posts changed
+type Event struct {
+	Type   string
+	PostID int
+}
+
+// subscriber buffers events, a slow client loses events rather than blocking publishers
+type subscriber struct {
+	events chan Event
+	client string
+}
+
+// Hub is an in-process publish/subscribe hub with one topic per thread
+type Hub struct {
+	mu           sync.Mutex
+	threads      map[int]map[*subscriber]bool
+	perClient    map[string]int
+	total        int
+	maxPerClient int
+	maxTotal     int
+	closed       bool
+}
+
+// NewHub makes a hub allowing maxPerClient connections from one client and maxTotal connections overall
+func NewHub(maxPerClient, maxTotal int) *Hub {
+	return &Hub{
+		threads:      make(map[int]map[*subscriber]bool),
+		perClient:    make(map[string]int),
+		maxPerClient: maxPerClient,
+		maxTotal:     maxTotal,
+	}
+}
+
+// Subscribe starts receiving events of a thread. The channel is closed when the hub shuts down,
+// and cancel must be called when the client goes away.
+func (h *Hub) Subscribe(threadID int, client string) (<-chan Event, func(), error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return nil, nil, ErrClosed
+	}
+	if h.perClient[client] >= h.maxPerClient || h.total >= h.maxTotal {
+		return nil, nil, ErrTooManyConnections
+	}
+
+	sub := &subscriber{events: make(chan Event, 16), client: client}
+	if h.threads[threadID] == nil {
+		h.threads[threadID] = make(map[*subscriber]bool)
+	}
+	h.threads[threadID][sub] = true
+	h.perClient[client]++
+	h.total++
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() { h.unsubscribe(threadID, sub) })
+	}
+	return sub.events, cancel, nil
+}
+
+func (h *Hub) unsubscribe(threadID int, sub *subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.threads[threadID][sub] {
+		return // Already removed by Close
+	}
+	delete(h.threads[threadID], sub)
+	if len(h.threads[threadID]) == 0 {
+		delete(h.threads, threadID)
+	}
+	h.perClient[sub.client]--
+	if h.perClient[sub.client] == 0 {
+		delete(h.perClient, sub.client)
+	}
+	h.total--
+	close(sub.events)
+}
+
+// Publish sends an event to everyone following the thread without waiting for them
+func (h *Hub) Publish(threadID int, ev Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for sub := range h.threads[threadID] {
+		select {
+		case sub.events <- ev:
+		default: // Client isn't keeping up, it can reload the page
+		}
+	}
+}
+
+// Connections returns the number of open subscriptions
+func (h *Hub) Connections() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.total
+}
+
+// Close ends every subscription and refuses new ones, for server shutdown
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	for threadID, subs := range h.threads {
+		for sub := range subs {
+			close(sub.events)
+		}
+		delete(h.threads, threadID)
+	}
+	h.perClient = make(map[string]int)
+	h.total = 0
+}
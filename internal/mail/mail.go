@@ -0,0 +1,88 @@
+package mail
+
+import (
+	"fmt"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message is a plain text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+	Headers map[string]string // Extra headers, like List-Unsubscribe
+}
+
+// Mailer sends email. FileSink writes messages to disk instead, for development and tests.
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// headerValue keeps a value on its header line
+var headerValue = strings.NewReplacer("\r", "", "\n", " ")
+
+// bytes renders the message with its headers
+func (msg Message) bytes(from string) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", headerValue.Replace(from))
+	fmt.Fprintf(&b, "To: %s\r\n", headerValue.Replace(msg.To))
+	fmt.Fprintf(&b, "Subject: %s\r\n", headerValue.Replace(msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+
+	keys := make([]string, 0, len(msg.Headers))
+	for key := range msg.Headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(&b, "%s: %s\r\n", key, headerValue.Replace(msg.Headers[key]))
+	}
+
+	b.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// FileSink writes each message as an .eml file in Dir
+type FileSink struct {
+	Dir  string
+	From string
+
+	mu sync.Mutex
+	n  int
+}
+
+func (f *FileSink) Send(msg Message) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := os.MkdirAll(f.Dir, 0755); err != nil {
+		return err
+	}
+	f.n++
+	name := fmt.Sprintf("%s-%03d.eml", time.Now().Format("20060102-150405"), f.n)
+	return os.WriteFile(filepath.Join(f.Dir, name), msg.bytes(f.From), 0644)
+}
+
+// SMTP sends messages through a mail server, logging in if Username is set
+type SMTP struct {
+	Addr     string // host:port
+	From     string
+	Username string
+	Password string
+}
+
+func (s *SMTP) Send(msg Message) error {
+	var auth smtp.Auth
+	if s.Username != "" {
+		host := strings.Split(s.Addr, ":")[0]
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+	return smtp.SendMail(s.Addr, auth, s.From, []string{msg.To}, msg.bytes(s.From))
+}
@@ -0,0 +1,94 @@
+package markdown
+
+import (
+	"html"
+	"strings"
+)
+
+// keywords common to the languages people post here (Go, JS, Python, C, SQL, shell)
+var keywords = map[string]bool{
+	"break": true, "case": true, "catch": true, "class": true, "const": true, "continue": true,
+	"def": true, "default": true, "defer": true, "do": true, "elif": true, "else": true,
+	"false": true, "for": true, "func": true, "function": true, "go": true, "if": true,
+	"import": true, "in": true, "interface": true, "let": true, "map": true, "nil": true,
+	"none": true, "null": true, "package": true, "range": true, "return": true, "select": true,
+	"from": true, "where": true, "struct": true, "switch": true, "true": true, "try": true,
+	"type": true, "var": true, "while": true, "int": true, "string": true, "bool": true,
+	"void": true, "new": true, "this": true, "self": true, "export": true, "async": true,
+	"await": true, "lambda": true, "pass": true, "fi": true, "then": true, "echo": true,
+}
+
+// highlight wraps comments, strings, numbers and keywords of code in classed spans
+func highlight(code string) string {
+	var out strings.Builder
+
+	span := func(class, text string) {
+		out.WriteString(`<span class="hl-` + class + `">` + html.EscapeString(text) + "</span>")
+	}
+
+	for i := 0; i < len(code); {
+		c := code[i]
+		rest := code[i:]
+
+		switch {
+		case strings.HasPrefix(rest, "//") || c == '#' || strings.HasPrefix(rest, "-- "):
+			end := strings.IndexByte(rest, '\n')
+			if end < 0 {
+				end = len(rest)
+			}
+			span("comment", rest[:end])
+			i += end
+
+		case strings.HasPrefix(rest, "/*"):
+			end := strings.Index(rest[2:], "*/")
+			if end < 0 {
+				end = len(rest)
+			} else {
+				end += 4
+			}
+			span("comment", rest[:end])
+			i += end
+
+		case c == '"' || c == '\'' || c == '`':
+			end := 1
+			for end < len(rest) && rest[end] != c && (c == '`' || rest[end] != '\n') {
+				if rest[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end < len(rest) {
+				end++ // closing quote
+			} else {
+				end = len(rest)
+			}
+			span("string", rest[:end])
+			i += end
+
+		case c >= '0' && c <= '9' && (i == 0 || !isWordByte(code[i-1])):
+			end := 1
+			for end < len(rest) && (isWordByte(rest[end]) || rest[end] == '.') {
+				end++
+			}
+			span("number", rest[:end])
+			i += end
+
+		case isWordByte(c):
+			end := 1
+			for end < len(rest) && isWordByte(rest[end]) {
+				end++
+			}
+			if word := rest[:end]; keywords[strings.ToLower(word)] {
+				span("keyword", word)
+			} else {
+				out.WriteString(html.EscapeString(word))
+			}
+			i += end
+
+		default:
+			out.WriteString(html.EscapeString(rest[:1]))
+			i++
+		}
+	}
+	return out.String()
+}
@@ -0,0 +1,316 @@
+package markdown
+
+import (
+	"html"
+	"html/template"
+	"regexp"
+	"strings"
+)
+
+var (
+	fenceRe   = regexp.MustCompile("^ {0,3}(```+|~~~+)\\s*([\\w+#.-]*)")
+	headingRe = regexp.MustCompile(`^ {0,3}(#{1,6})\s+(.*?)\s*#*\s*$`)
+	hrRe      = regexp.MustCompile(`^ {0,3}([-*_])(\s*([-*_]))*\s*$`)
+	ulRe      = regexp.MustCompile(`^ {0,3}[-*+]\s+`)
+	olRe      = regexp.MustCompile(`^ {0,3}\d{1,9}[.)]\s+`)
+	quoteRe   = regexp.MustCompile(`^ {0,3}> ?`)
+	mentionRe = regexp.MustCompile(`(?:^|[^\w@/-])@([A-Za-z0-9_-]+)`)
+	codeRe    = regexp.MustCompile("(?s)```.*?(```|$)|~~~.*?(~~~|$)|`[^`\n]*`")
+)
+
+// renderer holds what rendering needs besides the source
+type renderer struct {
+	mentions map[string]bool // Usernames that @mentions are linked for
+}
+
+// Render turns Markdown source of a post into sanitised HTML, linking @mentions of the given users
+func Render(src string, mentions ...string) template.HTML {
+	rd := renderer{mentions: make(map[string]bool)}
+	for _, name := range mentions {
+		rd.mentions[name] = true
+	}
+	src = strings.ReplaceAll(src, "\r\n", "\n")
+	return template.HTML(Sanitize(rd.renderBlocks(strings.Split(src, "\n"))))
+}
+
+// Mentions returns the @usernames in the source, outside code, once each
+func Mentions(src string) []string {
+	src = codeRe.ReplaceAllString(src, "")
+	var names []string
+	seen := make(map[string]bool)
+	for _, m := range mentionRe.FindAllStringSubmatch(src, -1) {
+		if len(m[1]) >= 5 && len(m[1]) <= 25 && !seen[m[1]] { // Usernames are 5-25 characters
+			seen[m[1]] = true
+			names = append(names, m[1])
+		}
+	}
+	return names
+}
+
+// renderBlocks renders lines as block elements: paragraphs, headings, lists, quotes and code
+func (rd renderer) renderBlocks(lines []string) string {
+	var out strings.Builder
+
+	for i := 0; i < len(lines); {
+		line := lines[i]
+
+		switch {
+		case strings.TrimSpace(line) == "":
+			i++
+
+		case fenceRe.MatchString(line):
+			m := fenceRe.FindStringSubmatch(line)
+			fence, lang := m[1], m[2]
+			var code []string
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), fence); i++ {
+				code = append(code, lines[i])
+			}
+			i++ // skip closing fence
+			out.WriteString(codeBlock(strings.Join(code, "\n"), lang))
+
+		case headingRe.MatchString(line):
+			m := headingRe.FindStringSubmatch(line)
+			level := string(rune('0' + len(m[1])))
+			out.WriteString("<h" + level + ">" + rd.renderInline(m[2]) + "</h" + level + ">\n")
+			i++
+
+		case hrRe.MatchString(line) && strings.Count(line, strings.TrimSpace(line)[:1]) >= 3:
+			out.WriteString("<hr>\n")
+			i++
+
+		case quoteRe.MatchString(line):
+			var quoted []string
+			for ; i < len(lines) && quoteRe.MatchString(lines[i]); i++ {
+				quoted = append(quoted, quoteRe.ReplaceAllString(lines[i], ""))
+			}
+			out.WriteString("<blockquote>\n" + rd.renderBlocks(quoted) + "</blockquote>\n")
+
+		case ulRe.MatchString(line), olRe.MatchString(line):
+			i = rd.renderList(lines, i, &out)
+
+		default:
+			var para []string
+			for ; i < len(lines) && strings.TrimSpace(lines[i]) != "" && (len(para) == 0 || !startsBlock(lines[i])); i++ {
+				para = append(para, strings.TrimSpace(lines[i]))
+			}
+			out.WriteString("<p>" + rd.renderInline(strings.Join(para, "\n")) + "</p>\n")
+		}
+	}
+	return out.String()
+}
+
+// startsBlock tells if a line interrupts a paragraph
+func startsBlock(line string) bool {
+	return fenceRe.MatchString(line) || headingRe.MatchString(line) || quoteRe.MatchString(line) ||
+		hrRe.MatchString(line) || ulRe.MatchString(line) || olRe.MatchString(line)
+}
+
+// renderList writes a list starting at lines[i] and returns the index after the list
+func (rd renderer) renderList(lines []string, i int, out *strings.Builder) int {
+	marker, tag := ulRe, "ul"
+	if olRe.MatchString(lines[i]) {
+		marker, tag = olRe, "ol"
+	}
+
+	indent := leadingSpaces(lines[i])
+	var items [][]string
+	for i < len(lines) {
+		line := lines[i]
+		if marker.MatchString(line) && leadingSpaces(line) < indent+2 {
+			items = append(items, []string{marker.ReplaceAllString(line, "")})
+		} else if strings.TrimSpace(line) != "" && (strings.HasPrefix(line, "  ") || strings.HasPrefix(line, "\t")) {
+			// Indented line continues the item, possibly as a nested list
+			last := len(items) - 1
+			items[last] = append(items[last], strings.TrimPrefix(strings.TrimPrefix(line, "\t"), "  "))
+		} else if strings.TrimSpace(line) == "" && i+1 < len(lines) && (marker.MatchString(lines[i+1]) || strings.HasPrefix(lines[i+1], "  ")) {
+			// Blank line inside the list
+		} else {
+			break
+		}
+		i++
+	}
+
+	out.WriteString("<" + tag + ">\n")
+	for _, item := range items {
+		content := rd.renderBlocks(item)
+		// Tight list items don't need their own paragraph
+		if strings.HasPrefix(content, "<p>") && strings.Count(content, "<p>") == 1 {
+			content = strings.Replace(strings.Replace(content, "<p>", "", 1), "</p>", "", 1)
+		}
+		out.WriteString("<li>" + strings.TrimSuffix(content, "\n") + "</li>\n")
+	}
+	out.WriteString("</" + tag + ">\n")
+	return i
+}
+
+func leadingSpaces(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+// codeBlock renders a fenced code block with syntax highlighting
+func codeBlock(code, lang string) string {
+	class := ""
+	if lang != "" {
+		class = ` class="language-` + html.EscapeString(strings.ToLower(lang)) + `"`
+	}
+	return "<pre><code" + class + ">" + highlight(code) + "</code></pre>\n"
+}
+
+// renderInline renders emphasis, code spans, links and line breaks inside a block
+func (rd renderer) renderInline(s string) string {
+	var out strings.Builder
+
+	for i := 0; i < len(s); {
+		c := s[i]
+		rest := s[i:]
+
+		switch {
+		case c == '\\' && i+1 < len(s) && strings.IndexByte("\\`*_{}[]()#+-.!<>|~", s[i+1]) >= 0:
+			out.WriteString(html.EscapeString(s[i+1 : i+2]))
+			i += 2
+			continue
+
+		case c == '\n':
+			out.WriteString("<br>\n")
+			i++
+			continue
+
+		case c == '`':
+			ticks := len(rest) - len(strings.TrimLeft(rest, "`"))
+			if end := strings.Index(rest[ticks:], rest[:ticks]); end >= 0 {
+				code := strings.TrimSpace(rest[ticks : ticks+end])
+				out.WriteString("<code>" + html.EscapeString(code) + "</code>")
+				i += 2*ticks + end
+				continue
+			}
+
+		case c == '[':
+			if text, url, n, ok := parseLink(rest); ok {
+				out.WriteString(`<a href="` + html.EscapeString(url) + `" rel="nofollow noopener">` + renderer{}.renderInline(text) + "</a>")
+				i += n
+				continue
+			}
+
+		case c == '<':
+			if end := strings.IndexByte(rest, '>'); end > 0 && isAutolink(rest[1:end]) {
+				url := rest[1:end]
+				out.WriteString(`<a href="` + html.EscapeString(url) + `" rel="nofollow noopener">` + html.EscapeString(url) + "</a>")
+				i += end + 1
+				continue
+			}
+
+		case c == 'h' && (strings.HasPrefix(rest, "http://") || strings.HasPrefix(rest, "https://")) && (i == 0 || !isWordByte(s[i-1])):
+			url := bareURL(rest)
+			out.WriteString(`<a href="` + html.EscapeString(url) + `" rel="nofollow noopener">` + html.EscapeString(url) + "</a>")
+			i += len(url)
+			continue
+
+		case c == '@' && (i == 0 || !isWordByte(s[i-1])):
+			if name := mentionAt(rest); rd.mentions[name] {
+				out.WriteString(`<a href="/?author=` + name + `" class="mention">@` + name + "</a>")
+				i += 1 + len(name)
+				continue
+			}
+
+		case c == '*' || c == '_':
+			if inner, n, strong, ok := parseEmphasis(s, i); ok {
+				tag := "em"
+				if strong {
+					tag = "strong"
+				}
+				out.WriteString("<" + tag + ">" + rd.renderInline(inner) + "</" + tag + ">")
+				i += n
+				continue
+			}
+		}
+
+		out.WriteString(html.EscapeString(s[i : i+1]))
+		i++
+	}
+	return out.String()
+}
+
+// parseLink reads [text](url) and returns its parts and length
+func parseLink(s string) (string, string, int, bool) {
+	closeText := strings.Index(s, "](")
+	if closeText < 0 || strings.Contains(s[1:closeText], "[") {
+		return "", "", 0, false
+	}
+	closeURL := strings.IndexByte(s[closeText:], ')')
+	if closeURL < 0 {
+		return "", "", 0, false
+	}
+	url := strings.TrimSpace(s[closeText+2 : closeText+closeURL])
+	if !SafeURL(url) {
+		return "", "", 0, false
+	}
+	return s[1:closeText], url, closeText + closeURL + 1, true
+}
+
+// parseEmphasis reads *em*, _em_, **strong** or __strong__ starting at s[i]
+func parseEmphasis(s string, i int) (string, int, bool, bool) {
+	delim := s[i : i+1]
+	if strings.HasPrefix(s[i:], delim+delim) {
+		delim += delim
+	}
+	// Underscores inside words (snake_case) are not emphasis
+	if delim[0] == '_' && i > 0 && isWordByte(s[i-1]) {
+		return "", 0, false, false
+	}
+	start := i + len(delim)
+	end := strings.Index(s[start:], delim)
+	if end <= 0 {
+		return "", 0, false, false
+	}
+	inner := s[start : start+end]
+	if strings.TrimSpace(inner) != inner || strings.Contains(inner, "\n\n") {
+		return "", 0, false, false
+	}
+	after := start + end + len(delim)
+	if delim[0] == '_' && after < len(s) && isWordByte(s[after]) {
+		return "", 0, false, false
+	}
+	return inner, after - i, len(delim) == 2, true
+}
+
+// bareURL returns the URL at the start of s without trailing punctuation
+func bareURL(s string) string {
+	end := strings.IndexAny(s, " \t\n<>\"")
+	if end < 0 {
+		end = len(s)
+	}
+	url := strings.TrimRight(s[:end], ".,;:!?'*_")
+	// Keep a closing parenthesis only if the URL opened one
+	for strings.HasSuffix(url, ")") && strings.Count(url, "(") < strings.Count(url, ")") {
+		url = url[:len(url)-1]
+	}
+	return url
+}
+
+// mentionAt returns the username after the @ at the start of s
+func mentionAt(s string) string {
+	end := 1
+	for end < len(s) && (isWordByte(s[end]) || s[end] == '-') {
+		end++
+	}
+	return s[1:end]
+}
+
+func isAutolink(s string) bool {
+	return (strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")) && !strings.ContainsAny(s, " \n<")
+}
+
+func isWordByte(b byte) bool {
+	return b == '_' || (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (b >= '0' && b <= '9')
+}
+
+// SafeURL allows web, mail and site-relative links only
+func SafeURL(url string) bool {
+	lower := strings.ToLower(url)
+	if strings.ContainsAny(url, " \n\t\"'<>") || url == "" {
+		return false
+	}
+	return strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://") ||
+		strings.HasPrefix(lower, "mailto:") || strings.HasPrefix(url, "#") ||
+		(strings.HasPrefix(url, "/") && !strings.HasPrefix(url, "//"))
+}
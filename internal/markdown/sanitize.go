@@ -0,0 +1,92 @@
+package markdown
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+// allowedTags maps each tag that may appear in a post to the attributes it may keep
+var allowedTags = map[string][]string{
+	"p": nil, "br": nil, "hr": nil, "blockquote": nil, "pre": nil,
+	"h1": nil, "h2": nil, "h3": nil, "h4": nil, "h5": nil, "h6": nil,
+	"strong": nil, "em": nil, "ul": nil, "ol": nil, "li": nil,
+	"a":    {"href", "rel", "class"},
+	"code": {"class"},
+	"span": {"class"},
+}
+
+var (
+	tagRe   = regexp.MustCompile(`^<(/?)([a-zA-Z][a-zA-Z0-9]*)((?:\s+[a-zA-Z-]+="[^"<>]*")*)\s*/?>$`)
+	attrRe  = regexp.MustCompile(`([a-zA-Z-]+)="([^"<>]*)"`)
+	classRe = regexp.MustCompile(`^(language-[\w+#.-]+|hl-[a-z]+|mention)$`)
+)
+
+// Sanitize keeps only allow-listed tags and attributes, anything else is escaped into text
+func Sanitize(s string) string {
+	var out strings.Builder
+
+	for {
+		start := strings.IndexByte(s, '<')
+		if start < 0 {
+			out.WriteString(s)
+			break
+		}
+		out.WriteString(s[:start])
+		s = s[start:]
+
+		end := strings.IndexByte(s, '>')
+		if end < 0 {
+			out.WriteString(html.EscapeString(s))
+			break
+		}
+		tag := s[:end+1]
+		s = s[end+1:]
+
+		if clean, ok := cleanTag(tag); ok {
+			out.WriteString(clean)
+		} else {
+			out.WriteString(html.EscapeString(tag))
+		}
+	}
+	return out.String()
+}
+
+// cleanTag rebuilds an allowed tag with its allowed attributes only
+func cleanTag(tag string) (string, bool) {
+	m := tagRe.FindStringSubmatch(tag)
+	if m == nil {
+		return "", false
+	}
+	closing, name := m[1], strings.ToLower(m[2])
+	allowedAttrs, ok := allowedTags[name]
+	if !ok {
+		return "", false
+	}
+	if closing != "" {
+		return "</" + name + ">", true
+	}
+
+	var b strings.Builder
+	b.WriteString("<" + name)
+	for _, attr := range attrRe.FindAllStringSubmatch(m[3], -1) {
+		key, val := strings.ToLower(attr[1]), html.UnescapeString(attr[2])
+		if !contains(allowedAttrs, key) ||
+			(key == "href" && !SafeURL(val)) ||
+			(key == "class" && !classRe.MatchString(val)) {
+			continue
+		}
+		b.WriteString(" " + key + `="` + html.EscapeString(val) + `"`)
+	}
+	b.WriteString(">")
+	return b.String(), true
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,82 @@
+package moderation
+
+import (
+	"database/sql"
+	"forum/internal/db"
+	"log"
+)
+
+// Report is a user's complaint about content, for moderators to handle
+type Report struct {
+	ID         int64
+	ReporterID string
+	TargetType string // What was reported, like "message"
+	TargetID   int64
+	AuthorID   string // Who wrote the reported content
+	Content    string // Copy of the content when reported, private messages included
+	Reason     string
+	Reporter   string // Usernames, for the moderators' list
+	Author     string
+	Created    string
+}
+
+// File stores a report as open, for moderators to handle
+func File(report Report) (Report, error) {
+	res, err := db.DB.Exec(`INSERT INTO reports (reporter_id, target_type, target_id, author_id, content, reason)
+							VALUES (?, ?, ?, ?, ?, ?);`,
+		report.ReporterID, report.TargetType, report.TargetID, report.AuthorID, report.Content, report.Reason)
+	if err != nil {
+		return report, err
+	}
+	if report.ID, err = res.LastInsertId(); err != nil {
+		return report, err
+	}
+
+	log.Printf("New report %d on %s %d\n", report.ID, report.TargetType, report.TargetID)
+	return report, nil
+}
+
+// Open lists the reports no moderator has resolved yet, oldest first
+func Open() ([]Report, error) {
+	rows, err := db.DB.Query(`SELECT r.id, COALESCE(r.reporter_id, ''), r.target_type, r.target_id, COALESCE(r.author_id, ''),
+								  r.content, r.reason, COALESCE(ru.username, ''), COALESCE(au.username, ''), r.created_at
+							  FROM reports r
+							  LEFT JOIN users ru ON ru.id = r.reporter_id
+							  LEFT JOIN users au ON au.id = r.author_id
+							  WHERE r.status = 'open' ORDER BY r.id;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var reports []Report
+	for rows.Next() {
+		var r Report
+		err := rows.Scan(&r.ID, &r.ReporterID, &r.TargetType, &r.TargetID, &r.AuthorID,
+			&r.Content, &r.Reason, &r.Reporter, &r.Author, &r.Created)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, r)
+	}
+	return reports, rows.Err()
+}
+
+// OpenCount counts the reports waiting for a moderator
+func OpenCount() (int, error) {
+	var count int
+	err := db.DB.QueryRow(`SELECT COUNT(*) FROM reports WHERE status = 'open';`).Scan(&count)
+	return count, err
+}
+
+// Resolve marks an open report handled. It returns sql.ErrNoRows when there is no such open report.
+func Resolve(id int64) error {
+	res, err := db.DB.Exec(`UPDATE reports SET status = 'resolved' WHERE id = ? AND status = 'open';`, id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err == nil && n == 0 {
+		err = sql.ErrNoRows
+	}
+	return err
+}
@@ -0,0 +1,126 @@
+// Package ratelimit counts actions, like new posts, in sliding windows and tells how long to wait when there are too many
+package ratelimit
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rule allows Limit actions in any period of Window. A zero Limit allows any number.
+type Rule struct {
+	Limit  int
+	Window time.Duration
+}
+
+// Parse reads rules like "thread=5/10m,reply=20/10m", the limit of each action over a window in Go duration syntax
+func Parse(spec string) (map[string]Rule, error) {
+	rules := make(map[string]Rule)
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		action, rule, ok := strings.Cut(part, "=")
+		limit, window, ok2 := strings.Cut(rule, "/")
+		if !ok || !ok2 || strings.TrimSpace(action) == "" {
+			return nil, fmt.Errorf("limit %q isn't like action=count/window", part)
+		}
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("limit %q has a bad count", part)
+		}
+		d, err := time.ParseDuration(window)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("limit %q has a bad window", part)
+		}
+		rules[strings.TrimSpace(action)] = Rule{n, d}
+	}
+	return rules, nil
+}
+
+// Limiter remembers when recent actions were done, per action and key, like a user or an address
+type Limiter struct {
+	mu     sync.Mutex
+	rules  map[string]Rule
+	recent map[string][]time.Time // Oldest first
+}
+
+// New makes a limiter with a rule for each limited action, other actions being free
+func New(rules map[string]Rule) *Limiter {
+	return &Limiter{rules: rules, recent: make(map[string][]time.Time)}
+}
+
+// Allow counts an action done under a key at the given time, unless the rule of the action is used up.
+// Then it tells how long until the oldest counted action leaves the window.
+func (l *Limiter) Allow(action, key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if wait := l.wait(action, key, now); wait > 0 {
+		return false, wait
+	}
+	l.record(action, key, now)
+	return true, 0
+}
+
+// Wait tells how long until an action can be done under a key, zero when it can be done at the given time.
+// Unlike Allow it doesn't count the action, for when Record does once other limits allow it too.
+func (l *Limiter) Wait(action, key string, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.wait(action, key, now)
+}
+
+// Record counts an action done under a key at the given time
+func (l *Limiter) Record(action, key string, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.record(action, key, now)
+}
+
+func (l *Limiter) wait(action, key string, now time.Time) time.Duration {
+	rule, ok := l.rules[action]
+	if !ok || rule.Limit == 0 {
+		return 0
+	}
+	id := action + " " + key
+	times := inWindow(l.recent[id], now.Add(-rule.Window))
+	l.recent[id] = times
+	if len(times) < rule.Limit {
+		return 0
+	}
+	return times[len(times)-rule.Limit].Add(rule.Window).Sub(now)
+}
+
+func (l *Limiter) record(action, key string, now time.Time) {
+	if rule, ok := l.rules[action]; ok && rule.Limit > 0 {
+		id := action + " " + key
+		l.recent[id] = append(l.recent[id], now)
+	}
+}
+
+// Prune forgets actions that have left their windows, and keys without any
+func (l *Limiter) Prune(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for id, times := range l.recent {
+		action, _, _ := strings.Cut(id, " ")
+		times = inWindow(times, now.Add(-l.rules[action].Window))
+		if len(times) == 0 {
+			delete(l.recent, id)
+		} else {
+			l.recent[id] = times
+		}
+	}
+}
+
+// inWindow leaves out the times before start
+func inWindow(times []time.Time, start time.Time) []time.Time {
+	i := 0
+	for i < len(times) && !times[i].After(start) {
+		i++
+	}
+	return times[i:]
+}
@@ -0,0 +1,111 @@
+// Package reaction defines the reactions posts can get: like and dislike, of which a user gives a post at most one,
+// and a configurable set of emoji reactions that can be given side by side.
+package reaction
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The two opinions, one per user and post
+const (
+	Like    = "like"
+	Dislike = "dislike"
+)
+
+// Kind is an emoji reaction
+type Kind struct {
+	Name  string // Stored in post_reactions.reaction_type
+	Emoji string
+	Label string // English, translated where shown
+}
+
+// catalog lists the emoji reactions that can be enabled
+var catalog = []Kind{
+	{"plus1", "👍", "+1"},
+	{"laugh", "😄", "Funny"},
+	{"heart", "❤️", "Love"},
+	{"insightful", "💡", "Insightful"},
+	{"thanks", "🙏", "Thanks"},
+	{"wow", "😮", "Wow"},
+}
+
+// Default names the emoji reactions enabled unless configured otherwise
+const Default = "plus1,laugh,heart,insightful"
+
+// enabled are the emoji reactions offered on posts, set once at startup
+var enabled []Kind
+
+func init() {
+	if err := Configure(Default); err != nil {
+		panic(err)
+	}
+}
+
+// Configure enables the emoji reactions named in a comma separated list, shown in that order.
+// An empty list leaves only like and dislike. Reactions given before they were turned off stay stored.
+func Configure(names string) error {
+	var kinds []Kind
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		kind, ok := find(name)
+		if !ok {
+			return fmt.Errorf("unknown reaction %q", name)
+		}
+		kinds = append(kinds, kind)
+	}
+	enabled = kinds
+	return nil
+}
+
+// Catalog lists the names of the emoji reactions that can be enabled
+func Catalog() []string {
+	var names []string
+	for _, kind := range catalog {
+		names = append(names, kind.Name)
+	}
+	return names
+}
+
+// Enabled returns the emoji reactions offered on posts
+func Enabled() []Kind {
+	return enabled
+}
+
+// Lookup finds an enabled emoji reaction by name
+func Lookup(name string) (Kind, bool) {
+	for _, kind := range enabled {
+		if kind.Name == name {
+			return kind, true
+		}
+	}
+	return Kind{}, false
+}
+
+// Opinion tells if a reaction is like or dislike, which replace each other
+func Opinion(name string) bool {
+	return name == Like || name == Dislike
+}
+
+// Points is what a reaction adds to the reputation of the post's author. Emoji reactions add nothing.
+func Points(name string) int {
+	switch name {
+	case Like:
+		return 10
+	case Dislike:
+		return -5
+	}
+	return 0
+}
+
+func find(name string) (Kind, bool) {
+	for _, kind := range catalog {
+		if kind.Name == name {
+			return kind, true
+		}
+	}
+	return Kind{}, false
+}
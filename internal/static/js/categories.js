@@ -2,8 +2,10 @@ function updateCategory(fieldName, selectorName) {
     const select = document.getElementById(selectorName);
     const selectedCategory = select.value;
     const categoriesInput = document.getElementById(fieldName);
-    if (!categoriesInput.value.includes(selectedCategory)) {
-        categoriesInput.value += selectedCategory + ' ';
+    const chosen = categoriesInput.value.split(',').map(c => c.trim()).filter(c => c !== '');
+    if (!chosen.includes(selectedCategory)) {
+        chosen.push(selectedCategory);
+        categoriesInput.value = chosen.join(', ');
       }
     select.selectedIndex = 0;
   }
\ No newline at end of file
@@ -0,0 +1,85 @@
+/* DRAFTS */
+// Save new threads and replies on the server while they are written, and bring them back on the next visit
+(function () {
+  const saveDelay = 1500; // Milliseconds after the last keystroke
+  const timers = new Map();
+
+  // The categories of a form, typed or picked from a list
+  function categories(form) {
+    const boxes = form.querySelectorAll('input[type="checkbox"][name="categories"]');
+    if (boxes.length > 0) {
+      return Array.from(boxes).filter(box => box.checked).map(box => box.value).join(",");
+    }
+    return form.elements.categories ? form.elements.categories.value : "";
+  }
+
+  function save(form) {
+    clearTimeout(timers.get(form));
+    timers.delete(form);
+    const body = new URLSearchParams({
+      target: form.dataset.draft,
+      thread: form.elements.baseId ? form.elements.baseId.value : "0",
+      title: form.elements.title ? form.elements.title.value : "",
+      categories: categories(form),
+      content: form.elements.content.value,
+    });
+    fetch("/drafts", { method: "POST", body: body }).catch(() => { });
+  }
+
+  function later(form) {
+    clearTimeout(timers.get(form));
+    timers.set(form, setTimeout(() => save(form), saveDelay));
+  }
+
+  // Forms of replies that arrive live are handled too
+  document.addEventListener("input", event => {
+    const form = event.target.closest("form[data-draft]");
+    if (form && event.target.type !== "file") later(form);
+  });
+  document.addEventListener("change", event => {
+    const form = event.target.closest("form[data-draft]");
+    if (form && event.target.type === "checkbox") later(form);
+  });
+  // A sent form is posted, so the server forgets its draft. A cleared one is forgotten here.
+  document.addEventListener("submit", event => {
+    const form = event.target.closest("form[data-draft]");
+    if (form) {
+      clearTimeout(timers.get(form));
+      timers.delete(form);
+    }
+  });
+  document.addEventListener("reset", event => {
+    const form = event.target.closest("form[data-draft]");
+    if (form) setTimeout(() => save(form)); // After the fields are empty
+  });
+
+  // Fill the empty fields of a form from its draft, and show the form
+  function restore(form, draft) {
+    if (form.elements.content.value !== "") return;
+    form.elements.content.value = draft.content;
+    if (form.elements.title && form.elements.title.value === "") form.elements.title.value = draft.title;
+    const picked = draft.categories.split(",");
+    form.querySelectorAll('input[name="categories"]').forEach(input => {
+      if (input.type === "checkbox") input.checked = picked.includes(input.value);
+      else if (input.value === "") input.value = draft.categories;
+    });
+
+    const container = form.closest(".reply-form-container");
+    if (container) container.style.display = "block";
+    const modal = form.closest("#newpostModal");
+    if (modal && location.hash === "#draft") modal.style.display = "block";
+    if (location.hash === "#draft") form.scrollIntoView({ block: "center" });
+  }
+
+  const forms = document.querySelectorAll("form[data-draft]");
+  if (forms.length === 0) return;
+  fetch("/drafts")
+    .then(response => response.ok ? response.json() : [])
+    .then(drafts => {
+      for (const draft of drafts) {
+        const form = document.querySelector(`form[data-draft="${draft.target}"]`);
+        if (form) restore(form, draft);
+      }
+    })
+    .catch(() => { });
+})();
@@ -39,10 +39,10 @@ document.addEventListener("DOMContentLoaded", function () {
     const savedState = sessionStorage.getItem("filter-visible");
     if (savedState === "true") {
       filterDiv.classList.add("visible");
-      updateButton(filterButton, "filter_alt_off", "Hide filter");
+      updateButton(filterButton, "filter_alt_off", filterButton.dataset.hide);
     } else {
       filterDiv.classList.remove("visible");
-      updateButton(filterButton, "filter_alt", "Show filter");
+      updateButton(filterButton, "filter_alt", filterButton.dataset.show);
     }
   }
 
@@ -53,11 +53,11 @@ document.addEventListener("DOMContentLoaded", function () {
       if (filterDiv.classList.contains("visible")) {
         filterDiv.classList.remove("visible");
         sessionStorage.setItem("filter-visible", "false");
-        updateButton(filterButton, "filter_alt", "Show filter");
+        updateButton(filterButton, "filter_alt", filterButton.dataset.show);
       } else {
         filterDiv.classList.add("visible");
         sessionStorage.setItem("filter-visible", "true");
-        updateButton(filterButton, "filter_alt_off", "Hide filter");
+        updateButton(filterButton, "filter_alt_off", filterButton.dataset.hide);
       }
     });
   }
@@ -0,0 +1,41 @@
+/* LIVE THREAD UPDATES */
+// Receive new replies and reaction counts of this thread as Server-Sent Events
+document.addEventListener("DOMContentLoaded", function () {
+  const root = document.querySelector("[data-live-thread]");
+  if (!root || !window.EventSource) return;
+
+  const source = new EventSource(`/events/${root.dataset.liveThread}`);
+
+  source.addEventListener("reply", function (event) {
+    const reply = JSON.parse(event.data);
+    if (document.getElementById(`post-${reply.id}`)) return; // Already shown
+
+    let parent = document.getElementById(`post-${reply.parentId}`);
+    if (!parent) return;
+
+    // Replies go in the parent's list, which a reply without replies doesn't have yet.
+    // A collapsed parent keeps its replies in its folded part.
+    let list = parent.querySelector(":scope > ul, :scope > div.reply > ul, :scope > details > div.reply > ul");
+    if (!list) parent = parent.querySelector(":scope > details") || parent;
+    if (!list) {
+      const container = document.createElement("div");
+      container.className = "reply";
+      list = document.createElement("ul");
+      container.appendChild(list);
+      parent.appendChild(container);
+    }
+    list.insertAdjacentHTML("beforeend", reply.html);
+  });
+
+  source.addEventListener("reactions", function (event) {
+    const counts = JSON.parse(event.data);
+    document.querySelectorAll(`[data-likes="${counts.id}"]`).forEach(el => el.textContent = counts.likes);
+    document.querySelectorAll(`[data-dislikes="${counts.id}"]`).forEach(el => el.textContent = counts.dislikes);
+    for (const [name, count] of Object.entries(counts.emoji || {})) {
+      document.querySelectorAll(`[data-emoji="${counts.id}-${name}"]`).forEach(el => el.textContent = count);
+    }
+  });
+
+  // Don't keep the connection open while navigating away
+  window.addEventListener("beforeunload", () => source.close());
+});
@@ -0,0 +1,102 @@
+/* MENTIONS */
+// Suggest usernames while typing an @mention in a post
+(function () {
+  const mentionBefore = /(^|[^\w@/-])@([A-Za-z0-9_-]{1,25})$/;
+  let list = null;       // Suggestion list shown under the textarea being typed in
+  let textarea = null;
+  let selected = 0;
+  let timer = null;
+
+  function close() {
+    if (list) list.remove();
+    list = null;
+    textarea = null;
+  }
+
+  // The partial username just before the cursor, if any
+  function currentMention(area) {
+    const match = area.value.slice(0, area.selectionStart).match(mentionBefore);
+    return match ? match[2] : null;
+  }
+
+  function choose(name) {
+    const area = textarea;
+    const before = area.value.slice(0, area.selectionStart).replace(/@[A-Za-z0-9_-]*$/, "@" + name + " ");
+    area.value = before + area.value.slice(area.selectionStart);
+    area.selectionStart = area.selectionEnd = before.length;
+    close();
+    area.focus();
+  }
+
+  function highlight(index) {
+    const items = list.querySelectorAll("li");
+    selected = (index + items.length) % items.length;
+    items.forEach((item, i) => item.classList.toggle("selected", i === selected));
+  }
+
+  function show(area, names) {
+    close();
+    if (names.length === 0) return;
+    textarea = area;
+    list = document.createElement("ul");
+    list.className = "mention-suggestions";
+    names.forEach(name => {
+      const item = document.createElement("li");
+      item.textContent = "@" + name;
+      // mousedown runs before the textarea loses focus
+      item.addEventListener("mousedown", event => {
+        event.preventDefault();
+        choose(name);
+      });
+      list.appendChild(item);
+    });
+    area.insertAdjacentElement("afterend", list);
+    highlight(0);
+  }
+
+  document.addEventListener("input", function (event) {
+    const area = event.target;
+    if (!area.matches("textarea[name='content']")) return;
+
+    clearTimeout(timer);
+    const partial = currentMention(area);
+    if (!partial) {
+      close();
+      return;
+    }
+    timer = setTimeout(() => {
+      fetch("/users/suggest?q=" + encodeURIComponent(partial))
+        .then(response => response.ok ? response.json() : [])
+        .then(names => {
+          if (currentMention(area) === partial) show(area, names);
+        })
+        .catch(close);
+    }, 150);
+  });
+
+  document.addEventListener("keydown", function (event) {
+    if (!list || event.target !== textarea) return;
+    switch (event.key) {
+      case "ArrowDown":
+        highlight(selected + 1);
+        break;
+      case "ArrowUp":
+        highlight(selected - 1);
+        break;
+      case "Enter":
+      case "Tab":
+        choose(list.querySelectorAll("li")[selected].textContent.slice(1));
+        break;
+      case "Escape":
+        close();
+        break;
+      default:
+        return;
+    }
+    event.preventDefault();
+  });
+
+  document.addEventListener("focusout", function (event) {
+    if (event.target === textarea) close();
+  });
+})();
@@ -22,24 +22,30 @@ function toggleDarkMode() {
 }
 
 /* REPLY */
-// Open and close reply-to-reply form with "Reply" button
-document.addEventListener("DOMContentLoaded", function () {
-  const buttons = document.querySelectorAll(".reply-button");
-  buttons.forEach(button => {
-    button.addEventListener("click", function () {
-      // Find the closest thread and then look for the reply-form-container sibling
-      const formContainer = this.closest(".reply-and-form").querySelector(".reply-form-container");
+// Open and close reply-to-reply form with "Reply" button, also on replies that arrive live
+document.addEventListener("click", function (event) {
+  const button = event.target.closest(".reply-button");
+  if (!button) return;
 
-      // Toggle the display of the form container
-      if (formContainer.style.display === "none" || formContainer.style.display === "") {
-        formContainer.style.display = "block";
-      } else {
-        formContainer.style.display = "none";
-      }
-    });
-  });
+  // Find the closest thread and then look for the reply-form-container sibling
+  const formContainer = button.closest(".reply-and-form").querySelector(".reply-form-container");
+
+  // Toggle the display of the form container
+  if (formContainer.style.display === "none" || formContainer.style.display === "") {
+    formContainer.style.display = "block";
+  } else {
+    formContainer.style.display = "none";
+  }
 });
 
+// List the images chosen in a reply form next to its "Add Image" button
+function showReplyFiles(input) {
+  const names = input.parentElement.querySelector(".reply-file-names");
+  if (names) {
+    names.textContent = Array.from(input.files).map(file => file.name).join(", ");
+  }
+}
+
 // category links make the filter visible
 var tags = document.getElementsByClassName("tag");
 var i;
@@ -0,0 +1,35 @@
+package static
+
+import (
+	"embed"
+	"io/fs"
+	"os"
+)
+
+// Dir is the static directory on disk, relative to the project root
+const Dir = "internal/static"
+
+// Uploaded images are not embedded, they are always served from disk
+//
+//go:embed css js templates favicon.ico index.html
+var embedded embed.FS
+
+var dev bool
+
+// SetDev makes Files read from disk instead of the binary, so edits show without a rebuild
+func SetDev(on bool) {
+	dev = on
+}
+
+// Dev tells if static files are read from disk
+func Dev() bool {
+	return dev
+}
+
+// Files returns the static files rooted at internal/static
+func Files() fs.FS {
+	if dev {
+		return os.DirFS(Dir)
+	}
+	return embedded
+}
@@ -1,47 +1,160 @@
 package templates
 
 import (
+	"errors"
 	"fmt"
-	"text/template"
+	"forum/internal/i18n"
+	"forum/internal/static"
+	"html/template"
+	"io"
+	"io/fs"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
 )
 
-var (
-	IndexTmpl    *template.Template
-	ThreadTmpl   *template.Template
-	LogTmpl      *template.Template
-	RegisterTmpl *template.Template
-	ErrorTmpl    *template.Template
+// Page names for Execute
+const (
+	Index         = "index"
+	Thread        = "thread"
+	Login         = "login"
+	Register      = "register"
+	Error         = "error"
+	Settings      = "settings"
+	Notifications = "notifications"
+	Unsubscribe   = "unsubscribe"
+	Inbox         = "inbox"
+	Conversation  = "conversation"
+	Category      = "category"
+	CategoryAdmin = "categoryadmin"
+	Moderation    = "moderation"
 )
 
-func InitTemplates() {
-	var err error
+// pages lists the files each page is parsed from, the page itself first
+var pages = map[string][]string{
+	Index:         {"index.html", "threadlist.html", "header.html", "footer.html"},
+	Thread:        {"thread.html", "header.html", "reply.html", "footer.html"},
+	Login:         {"login.html", "header.html", "footer.html"},
+	Register:      {"registerUser.html", "header.html", "footer.html"},
+	Error:         {"error.html", "header.html", "footer.html"},
+	Settings:      {"settings.html", "header.html", "footer.html"},
+	Notifications: {"notifications.html", "header.html", "footer.html"},
+	Unsubscribe:   {"unsubscribe.html", "header.html", "footer.html"},
+	Inbox:         {"inbox.html", "header.html", "footer.html"},
+	Conversation:  {"conversation.html", "header.html", "footer.html"},
+	Category:      {"category.html", "threadlist.html", "header.html", "footer.html"},
+	CategoryAdmin: {"categoryadmin.html", "header.html", "footer.html"},
+	Moderation:    {"moderation.html", "header.html", "footer.html"},
+}
 
-	head := "internal/static/templates/header.html"
-	foot := "internal/static/templates/footer.html"
+// funcs are available in every template
+var funcs = template.FuncMap{
+	"t":       i18n.T,  // {{t .Lang "message" args...}} translates a message
+	"formKey": formKey, // {{formKey}} is a new key for a form, the same if the form is sent twice
+}
 
-	IndexTmpl, err = template.ParseFiles("internal/static/templates/index.html", head, foot)
+// formKey makes a random key for a form that creates a post
+func formKey() string {
+	key, err := uuid.NewV4()
 	if err != nil {
-		fmt.Println("Error parsing template:", err)
-		return
+		return ""
 	}
-	ThreadTmpl, err = template.ParseFiles("internal/static/templates/thread.html", head, "internal/static/templates/reply.html", foot)
+	return key.String()
+}
+
+var (
+	registry   map[string]*template.Template
+	registryMu sync.RWMutex
+)
+
+// InitTemplates parses every page, and fails if any of them doesn't parse
+func InitTemplates() error {
+	files, err := fs.Sub(static.Files(), "templates")
 	if err != nil {
-		fmt.Println("Error parsing template:", err)
-		return
+		return err
 	}
-	LogTmpl, err = template.ParseFiles("internal/static/templates/login.html", head, foot)
-	if err != nil {
-		fmt.Println("Error parsing template:", err)
-		return
+
+	parsed := make(map[string]*template.Template)
+	var errs []error
+	for name, pageFiles := range pages {
+		tmpl, err := template.New(pageFiles[0]).Funcs(funcs).ParseFS(files, pageFiles...)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("parsing %s page: %w", name, err))
+			continue
+		}
+		parsed[name] = tmpl
 	}
-	RegisterTmpl, err = template.ParseFiles("internal/static/templates/registerUser.html", head, foot)
-	if err != nil {
-		fmt.Println("Error parsing template:", err)
-		return
+	if len(errs) > 0 {
+		return errors.Join(errs...)
 	}
-	ErrorTmpl, err = template.ParseFiles("internal/static/templates/error.html", head, foot)
+
+	registryMu.Lock()
+	registry = parsed
+	registryMu.Unlock()
+	return nil
+}
+
+// Watch re-parses the templates whenever a template file changes on disk, for development mode.
+// A template that fails to parse is logged and the previous version stays in use.
+func Watch(interval time.Duration) {
+	lastChange := latestChange()
+	ticker := time.NewTicker(interval)
+	go func() {
+		for range ticker.C {
+			changed := latestChange()
+			if !changed.After(lastChange) {
+				continue
+			}
+			lastChange = changed
+			if err := InitTemplates(); err != nil {
+				log.Println("Error reloading templates:", err)
+				continue
+			}
+			log.Println("Templates reloaded")
+		}
+	}()
+}
+
+// latestChange returns the newest modification time among the template files
+func latestChange() time.Time {
+	var latest time.Time
+	fs.WalkDir(static.Files(), "templates", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+		return nil
+	})
+	return latest
+}
+
+// Execute writes the named page with data
+func Execute(w io.Writer, name string, data any) error {
+	registryMu.RLock()
+	tmpl, ok := registry[name]
+	registryMu.RUnlock()
+	if !ok {
+		return fmt.Errorf("template %q not registered", name)
+	}
+
+	err := tmpl.Execute(w, data)
 	if err != nil {
-		fmt.Println("Error parsing template:", err)
-		return
+		fmt.Println("Error executing template", name+":", err)
+	}
+	return err
+}
+
+// ExecutePart writes a template defined within a page, like a single reply of the thread page
+func ExecutePart(w io.Writer, page, part string, data any) error {
+	registryMu.RLock()
+	tmpl, ok := registry[page]
+	registryMu.RUnlock()
+	if !ok {
+		return fmt.Errorf("template %q not registered", page)
 	}
+	return tmpl.ExecuteTemplate(w, part, data)
 }
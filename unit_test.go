@@ -1,8 +1,16 @@
 package main
 
 import (
+	"forum/internal/category"
 	"forum/internal/db"
 	"forum/internal/handlers"
+	"forum/internal/i18n"
+	"forum/internal/markdown"
+	"forum/internal/ratelimit"
+	"forum/internal/reaction"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -102,3 +110,215 @@ func TestSaveSession(t *testing.T) {
 		t.Errorf("saveSession returned error: %v", err)
 	}
 }
+
+func TestReconcileImages(t *testing.T) {
+	Testinit()
+	defer db.DB.Close()
+
+	dir := t.TempDir()
+	old := time.Now().Add(-2 * time.Hour)
+	writeImage := func(name string) {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("img"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(path, old, old)
+	}
+
+	db.DB.Exec(`INSERT INTO posts (id, author, title, content) VALUES (1, 'testuser', 'title', 'content');`)
+	writeImage("kept.png")   // file with row and post
+	writeImage("orphan.jpg") // file without row
+	writeImage("nopost.gif") // file with row, but no post
+	db.DB.Exec(`INSERT INTO images (id, post_id) VALUES ('kept.png', 1), ('missing.png', 1), ('nopost.gif', 2);`)
+
+	report, err := db.ReconcileImages(dir, true)
+	if err != nil {
+		t.Fatalf("dry run returned error: %v", err)
+	}
+	if len(report.OrphanFiles) != 2 || len(report.DanglingRows) != 2 || report.Reclaimed != 6 {
+		t.Errorf("dry run report = %+v; want 2 orphan files, 2 dangling rows, 6 bytes", report)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "orphan.jpg")); err != nil {
+		t.Errorf("dry run removed a file: %v", err)
+	}
+
+	if _, err := db.ReconcileImages(dir, false); err != nil {
+		t.Fatalf("reconcile returned error: %v", err)
+	}
+	var rows int
+	db.DB.QueryRow(`SELECT COUNT(*) FROM images;`).Scan(&rows)
+	if rows != 1 {
+		t.Errorf("images rows after reconcile = %d; want 1", rows)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 || entries[0].Name() != "kept.png" {
+		t.Errorf("files after reconcile = %v; want only kept.png", entries)
+	}
+}
+
+func TestRenderMarkdown(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    string
+		notWant string
+	}{
+		{"**bold** and *em*", "<strong>bold</strong> and <em>em</em>", ""},
+		{"snake_case_name", "snake_case_name", "<em>"},
+		{"<script>alert(1)</script>", "&lt;script&gt;", "<script>"},
+		{"[x](javascript:alert(1))", "[x]", "<a"},
+		{"see https://go.dev/doc.", `<a href="https://go.dev/doc" rel="nofollow noopener">`, ""},
+		{"```go\nfunc main() {}\n```", `<code class="language-go"><span class="hl-keyword">func</span>`, ""},
+		{"- one\n- two", "<ul>\n<li>one</li>", ""},
+	}
+
+	for _, test := range tests {
+		result := string(markdown.Render(test.input))
+		if !strings.Contains(result, test.want) {
+			t.Errorf("Render(%q) = %q; want it to contain %q", test.input, result, test.want)
+		}
+		if test.notWant != "" && strings.Contains(result, test.notWant) {
+			t.Errorf("Render(%q) = %q; don't want it to contain %q", test.input, result, test.notWant)
+		}
+	}
+}
+
+func TestParseMentions(t *testing.T) {
+	src := "Hi @alice_1 and @bob-22!\nmail me@example.com, `@coder1` and @alice_1 again\n```\n@insidecode\n```"
+	got := markdown.Mentions(src)
+	if strings.Join(got, " ") != "alice_1 bob-22" {
+		t.Errorf("Mentions() = %v; want [alice_1 bob-22]", got)
+	}
+
+	rendered := string(markdown.Render("thanks @alice_1 and @nobody1", "alice_1"))
+	if !strings.Contains(rendered, `<a href="/?author=alice_1" class="mention">@alice_1</a>`) || strings.Contains(rendered, "nobody1</a>") {
+		t.Errorf("Render() with mentions = %q", rendered)
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	input := `<p onclick="x()">hi</p><img src=x onerror=alert(1)><a href="javascript:x">a</a><code class="hl-keyword">k</code>`
+	want := `<p>hi</p>&lt;img src=x onerror=alert(1)&gt;<a>a</a><code class="hl-keyword">k</code>`
+	if result := markdown.Sanitize(input); result != want {
+		t.Errorf("Sanitize() = %q; want %q", result, want)
+	}
+}
+
+func TestNegotiateLanguage(t *testing.T) {
+	tests := []struct {
+		userLang       string
+		acceptLanguage string
+		expected       string
+	}{
+		{"", "", "en"},
+		{"", "fi-FI,fi;q=0.9,en;q=0.8", "fi"},
+		{"", "de-DE,en;q=0.5,fi;q=0.7", "fi"},
+		{"", "de-DE", "en"},
+		{"en", "fi", "en"},
+		{"xx", "fi", "fi"},
+	}
+
+	for _, test := range tests {
+		result := i18n.Negotiate(test.userLang, test.acceptLanguage)
+		if result != test.expected {
+			t.Errorf("Negotiate(%q, %q) = %v; want %v", test.userLang, test.acceptLanguage, result, test.expected)
+		}
+	}
+}
+
+func TestNormalizeCategories(t *testing.T) {
+	if got := category.Normalize("  ＧＯ  Straße "); got != "go strasse" {
+		t.Errorf("Normalize() = %q; want %q", got, "go strasse")
+	}
+
+	got, err := category.Parse("C++, node.js，Machine  Learning, c++,")
+	if err != nil || strings.Join(got, "|") != "c++|node.js|machine learning" {
+		t.Errorf("Parse() = %q, %v; want [c++ node.js machine learning]", got, err)
+	}
+
+	tests := []struct {
+		input string
+		err   error
+	}{
+		{" , ", category.ErrEmpty},
+		{"<script>", category.ErrCharacters},
+		{"+++", category.ErrCharacters},
+		{strings.Repeat("a", category.NameMaxLen+1), category.ErrTooLong},
+		{strings.Repeat("a,b,", 6), nil},
+		{"a,b,c,d,e,f,g,h,i,j,k", category.ErrTooMany},
+		{"kahvi, äidinkieli, 日本語", nil},
+	}
+	for _, test := range tests {
+		if _, err := category.Parse(test.input); err != test.err {
+			t.Errorf("Parse(%q) error = %v; want %v", test.input, err, test.err)
+		}
+	}
+
+	if slug := category.Slug("C++ & C#"); slug != "c-plus-plus-and-c-sharp" {
+		t.Errorf("Slug() = %q; want c-plus-plus-and-c-sharp", slug)
+	}
+}
+
+func TestConfigureReactions(t *testing.T) {
+	defer reaction.Configure(reaction.Default)
+
+	if err := reaction.Configure("heart, wow"); err != nil {
+		t.Fatalf("Configure() error = %v", err)
+	}
+	if kinds := reaction.Enabled(); len(kinds) != 2 || kinds[1].Name != "wow" {
+		t.Errorf("Enabled() = %v; want heart and wow", kinds)
+	}
+	if _, ok := reaction.Lookup("laugh"); ok {
+		t.Error("Lookup() found a reaction that isn't enabled")
+	}
+	if err := reaction.Configure("heart,poop"); err == nil {
+		t.Error("Configure() accepted an unknown reaction")
+	}
+}
+
+func TestSlidingWindow(t *testing.T) {
+	rules, err := ratelimit.Parse("reply=2/1m, thread=0/1h")
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	limiter := ratelimit.New(rules)
+	start := time.Now()
+	for i, step := range []struct {
+		after time.Duration
+		ok    bool
+		wait  time.Duration
+	}{
+		{0, true, 0},
+		{20 * time.Second, true, 0},
+		{40 * time.Second, false, 20 * time.Second},
+		{61 * time.Second, true, 0}, // The first one has left the window
+		{70 * time.Second, false, 10 * time.Second},
+	} {
+		ok, wait := limiter.Allow("reply", "alice", start.Add(step.after))
+		if ok != step.ok || wait != step.wait {
+			t.Errorf("step %d: Allow() = %v, %v; want %v, %v", i, ok, wait, step.ok, step.wait)
+		}
+	}
+	if ok, _ := limiter.Allow("reply", "bob", start.Add(70*time.Second)); !ok {
+		t.Error("one user's replies limited another")
+	}
+	if ok, _ := limiter.Allow("thread", "alice", start); !ok {
+		t.Error("a zero limit limited")
+	}
+
+	// Waiting counts nothing, recording does
+	for i := 0; i < 3; i++ {
+		if wait := limiter.Wait("reply", "carol", start); wait != 0 {
+			t.Fatalf("Wait() counted the action, now waiting %v", wait)
+		}
+	}
+	limiter.Record("reply", "carol", start)
+	limiter.Record("reply", "carol", start)
+	if wait := limiter.Wait("reply", "carol", start.Add(time.Second)); wait != 59*time.Second {
+		t.Errorf("Wait() after two recorded replies = %v, want 59s", wait)
+	}
+	for _, bad := range []string{"reply=2", "reply=x/1m", "reply=2/soon", "=2/1m"} {
+		if _, err := ratelimit.Parse(bad); err == nil {
+			t.Errorf("Parse(%q) accepted a bad rule", bad)
+		}
+	}
+}